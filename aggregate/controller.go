@@ -0,0 +1,172 @@
+// Package aggregate combines several service registries into one
+package aggregate
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kyessenov/envoymesh/kube"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// Controller fans in several registries. A hostname belongs to the first
+// registry with a service of that hostname, and the instances of the
+// hostname are taken from that registry only. The handlers of all
+// registries are serialized on the queue of the aggregate, so jobs
+// scheduled on the aggregate never run concurrently with the handlers.
+type Controller struct {
+	registries []model.Controller
+	queue      kube.Queue
+
+	// merge the instances of all registries
+	merge bool
+}
+
+// NewController creates an aggregate of the registries in order of
+// precedence
+func NewController(registries ...model.Controller) *Controller {
+	return &Controller{
+		registries: registries,
+		queue:      kube.NewQueue(1 * time.Second),
+	}
+}
+
+// NewMergedController creates an aggregate of the registries of several
+// clusters. The services are taken from the registries in order of
+// precedence as in NewController, but the instances of a "hostname:port"
+// are concatenated from all registries, so that the replicas of a service
+// in every cluster are endpoints of the service.
+func NewMergedController(registries ...model.Controller) *Controller {
+	c := NewController(registries...)
+	c.merge = true
+	return c
+}
+
+// owners maps the hostnames to the index of the first registry with a
+// service of the hostname, and returns the services of the owners sorted by
+// hostname
+func (c *Controller) owners() (map[string]int, []*model.Service) {
+	owners := make(map[string]int)
+	services := make([]*model.Service, 0)
+	for i, registry := range c.registries {
+		for _, service := range registry.Services() {
+			if owner, exists := owners[service.Hostname]; exists {
+				if owner != i {
+					glog.V(2).Infof("service %s of registry %d shadowed by registry %d", service.Hostname, i, owner)
+				}
+				continue
+			}
+			owners[service.Hostname] = i
+			services = append(services, service)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Hostname < services[j].Hostname })
+	return owners, services
+}
+
+// Services implements a service catalog operation
+func (c *Controller) Services() []*model.Service {
+	_, services := c.owners()
+	return services
+}
+
+// Instances implements a service catalog operation. Instances keyed by
+// "hostname:port" of a hostname without a service are kept from the first
+// registry that has them.
+func (c *Controller) Instances() map[string][]model.Endpoint {
+	if c.merge {
+		return c.mergedInstances()
+	}
+	owners, _ := c.owners()
+	out := make(map[string][]model.Endpoint)
+	for i, registry := range c.registries {
+		for key, endpoints := range registry.Instances() {
+			host := strings.SplitN(key, ":", 2)[0]
+			if owner, exists := owners[host]; exists && owner != i {
+				continue
+			}
+			if _, exists := out[key]; exists {
+				continue
+			}
+			out[key] = endpoints
+		}
+	}
+	return out
+}
+
+// mergedInstances concatenates the instances of the registries in order
+func (c *Controller) mergedInstances() map[string][]model.Endpoint {
+	out := make(map[string][]model.Endpoint)
+	for _, registry := range c.registries {
+		for key, endpoints := range registry.Instances() {
+			out[key] = append(out[key], endpoints...)
+		}
+	}
+	return out
+}
+
+// Workload returns the workload from the first registry that knows it.
+// Errors other than ErrUnknownWorkload are returned if no registry has the
+// workload.
+func (c *Controller) Workload(id string) (model.Instance, error) {
+	err := model.ErrUnknownWorkload
+	for _, registry := range c.registries {
+		instance, lookup := registry.Workload(id)
+		if lookup == nil {
+			return instance, nil
+		}
+		if lookup != model.ErrUnknownWorkload {
+			err = lookup
+		}
+	}
+	return model.Instance{}, err
+}
+
+// clusterRegistry is a registry of the workloads of a named cluster
+type clusterRegistry interface {
+	ClusterName() string
+}
+
+// ClusterWorkload returns the workload from the registry of the cluster.
+// Registries without a cluster name are not searched.
+func (c *Controller) ClusterWorkload(cluster, id string) (model.Instance, error) {
+	for _, registry := range c.registries {
+		if named, ok := registry.(clusterRegistry); ok && named.ClusterName() == cluster {
+			return registry.Workload(id)
+		}
+	}
+	return model.Instance{}, model.ErrUnknownWorkload
+}
+
+// RegisterServiceHandler notifies about changes to the services of any
+// registry
+func (c *Controller) RegisterServiceHandler(f func()) {
+	for _, registry := range c.registries {
+		registry.RegisterServiceHandler(func() { c.QueueSchedule(f) })
+	}
+}
+
+// RegisterEndpointHandler notifies about changes to the instances of any
+// registry
+func (c *Controller) RegisterEndpointHandler(f func()) {
+	for _, registry := range c.registries {
+		registry.RegisterEndpointHandler(func() { c.QueueSchedule(f) })
+	}
+}
+
+// Run the registries and the queue until a signal is received
+func (c *Controller) Run(stop <-chan struct{}) {
+	go c.queue.Run(stop)
+	for _, registry := range c.registries {
+		go registry.Run(stop)
+	}
+	<-stop
+	glog.V(2).Info("Aggregate controller terminated")
+}
+
+// QueueSchedule ...
+func (c *Controller) QueueSchedule(job func()) {
+	c.queue.Push(kube.NewTask(func(interface{}, model.Event) error { job(); return nil }, nil, model.EventUpdate))
+}
@@ -0,0 +1,166 @@
+package aggregate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kyessenov/envoymesh/memory"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func service(hostname string, port int) *model.Service {
+	return &model.Service{
+		Hostname: hostname,
+		Ports:    model.PortList{{Name: "http", Port: port, Protocol: model.ProtocolHTTP}},
+	}
+}
+
+func TestServicesAndInstances(t *testing.T) {
+	first, second := memory.NewRegistry(), memory.NewRegistry()
+	first.SetServices([]*model.Service{service("b.com", 80)})
+	first.SetInstances(map[string][]model.Endpoint{
+		"b.com:http": {{IP: "10.1.0.1", Port: 80}},
+	})
+	second.SetServices([]*model.Service{service("a.com", 80), service("b.com", 8080)})
+	second.SetInstances(map[string][]model.Endpoint{
+		"a.com:http": {{IP: "10.2.0.1", Port: 80}},
+		"b.com:http": {{IP: "10.2.0.2", Port: 8080}},
+		"c.com:http": {{IP: "10.2.0.3", Port: 80}},
+	})
+	c := NewController(first, second)
+
+	// the first registry owns the conflicting hostname
+	want := []*model.Service{service("a.com", 80), service("b.com", 80)}
+	if got := c.Services(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Services() => %v, want %v", got, want)
+	}
+	wantInstances := map[string][]model.Endpoint{
+		"a.com:http": {{IP: "10.2.0.1", Port: 80}},
+		"b.com:http": {{IP: "10.1.0.1", Port: 80}},
+		"c.com:http": {{IP: "10.2.0.3", Port: 80}},
+	}
+	if got := c.Instances(); !reflect.DeepEqual(got, wantInstances) {
+		t.Errorf("Instances() => %v, want %v", got, wantInstances)
+	}
+}
+
+func TestMergedInstances(t *testing.T) {
+	east, west := memory.NewRegistry(), memory.NewRegistry()
+	east.SetServices([]*model.Service{service("a.com", 80)})
+	east.SetInstances(map[string][]model.Endpoint{
+		"a.com:http": {{IP: "10.1.0.1", Port: 80, Locality: "east"}},
+	})
+	west.SetServices([]*model.Service{service("a.com", 8080), service("b.com", 80)})
+	west.SetInstances(map[string][]model.Endpoint{
+		"a.com:http": {{IP: "10.2.0.1", Port: 8080, Locality: "west"}},
+		"b.com:http": {{IP: "10.2.0.2", Port: 80, Locality: "west"}},
+	})
+	c := NewMergedController(east, west)
+
+	// the services are taken in order of precedence
+	want := []*model.Service{service("a.com", 80), service("b.com", 80)}
+	if got := c.Services(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Services() => %v, want %v", got, want)
+	}
+	// the endpoints of a service are merged across the registries
+	wantInstances := map[string][]model.Endpoint{
+		"a.com:http": {{IP: "10.1.0.1", Port: 80, Locality: "east"}, {IP: "10.2.0.1", Port: 8080, Locality: "west"}},
+		"b.com:http": {{IP: "10.2.0.2", Port: 80, Locality: "west"}},
+	}
+	if got := c.Instances(); !reflect.DeepEqual(got, wantInstances) {
+		t.Errorf("Instances() => %v, want %v", got, wantInstances)
+	}
+}
+
+type failingRegistry struct {
+	*memory.Registry
+}
+
+func (failingRegistry) Workload(string) (model.Instance, error) {
+	return model.Instance{}, errors.New("registry unavailable")
+}
+
+func TestWorkload(t *testing.T) {
+	first, second := memory.NewRegistry(), memory.NewRegistry()
+	first.SetWorkloads(map[string]model.Instance{"default/a": {UID: "first"}})
+	second.SetWorkloads(map[string]model.Instance{"default/a": {UID: "second"}, "default/b": {UID: "second"}})
+	c := NewController(first, failingRegistry{memory.NewRegistry()}, second)
+
+	for id, want := range map[string]string{"default/a": "first", "default/b": "second"} {
+		if instance, err := c.Workload(id); err != nil || instance.UID != want {
+			t.Errorf("Workload(%q) => %v, %v, want %q", id, instance, err, want)
+		}
+	}
+	if _, err := c.Workload("default/c"); err == nil || err == model.ErrUnknownWorkload {
+		t.Errorf("Workload of a failing registry => %v, want the registry error", err)
+	}
+	if _, err := NewController(first, second).Workload("default/c"); err != model.ErrUnknownWorkload {
+		t.Errorf("Workload of a missing workload => %v, want %v", err, model.ErrUnknownWorkload)
+	}
+}
+
+type namedRegistry struct {
+	*memory.Registry
+	name string
+}
+
+func (r namedRegistry) ClusterName() string {
+	return r.name
+}
+
+func TestClusterWorkload(t *testing.T) {
+	east, west := memory.NewRegistry(), memory.NewRegistry()
+	east.SetWorkloads(map[string]model.Instance{"default/a": {UID: "east"}})
+	west.SetWorkloads(map[string]model.Instance{"default/a": {UID: "west"}})
+	c := NewMergedController(namedRegistry{east, "east"}, namedRegistry{west, "west"})
+
+	// the same workload ID is looked up in the registry of its cluster
+	for cluster, want := range map[string]string{"east": "east", "west": "west"} {
+		if instance, err := c.ClusterWorkload(cluster, "default/a"); err != nil || instance.UID != want {
+			t.Errorf("ClusterWorkload(%q, default/a) => %v, %v, want %q", cluster, instance, err, want)
+		}
+	}
+	if _, err := c.ClusterWorkload("north", "default/a"); err != model.ErrUnknownWorkload {
+		t.Errorf("ClusterWorkload of an unknown cluster => %v, want %v", err, model.ErrUnknownWorkload)
+	}
+	if _, err := c.ClusterWorkload("west", "default/b"); err != model.ErrUnknownWorkload {
+		t.Errorf("ClusterWorkload of a missing workload => %v, want %v", err, model.ErrUnknownWorkload)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	first, second := memory.NewRegistry(), memory.NewRegistry()
+	c := NewController(first, second)
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Run(stop)
+
+	services := make(chan string, 2)
+	c.RegisterServiceHandler(func() { services <- "services" })
+	c.RegisterEndpointHandler(func() { services <- "instances" })
+
+	// handlers wait for the jobs scheduled on the aggregate
+	blocked := make(chan struct{})
+	c.QueueSchedule(func() { <-blocked })
+	second.SetServices([]*model.Service{service("a.com", 80)})
+	select {
+	case got := <-services:
+		t.Fatalf("handler %s ran concurrently with a job of the aggregate", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(blocked)
+
+	first.SetInstances(map[string][]model.Endpoint{})
+	for _, want := range []string{"services", "instances"} {
+		select {
+		case got := <-services:
+			if got != want {
+				t.Errorf("got handler %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler %s was not notified", want)
+		}
+	}
+}
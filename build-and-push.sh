@@ -8,7 +8,7 @@ DOCKER_HUB="${DOCKER_HUB:-gcr.io/istio-testing}"
 DOCKER_TAG="${DOCKER_TAG:-latest}"
 
 echo Building sidecar
-CGO_ENABLED=0 GOOS=linux go build -o docker/agent-linux github.com/kyessenov/envoymesh/cmd/agent
+CGO_ENABLED=0 GOOS=linux go build -ldflags "-X main.version=${DOCKER_TAG}" -o docker/agent-linux github.com/kyessenov/envoymesh/cmd/agent
 cp bootstrap.jsonnet docker/
 docker build -f docker/Dockerfile.sidecar -t ${DOCKER_HUB}/envoysidecar:${DOCKER_TAG} docker
 
@@ -0,0 +1,246 @@
+// Package ca implements a certificate authority issuing SPIFFE workload
+// certificates to the proxies
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	// rootTTL is the validity of a self-signed root certificate
+	rootTTL = 365 * 24 * time.Hour
+
+	// clockSkew backdates certificates to tolerate clock differences
+	clockSkew = 5 * time.Minute
+)
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// CA mints short-lived certificates for the identities of the nodes and
+// rotates them when two thirds of their lifetime has passed. CA is safe for
+// concurrent use.
+type CA struct {
+	// Identity resolves the SPIFFE identity of a node, e.g.
+	// "spiffe://cluster.local/ns/default/sa/bookinfo". It must be set
+	// before issuing certificates.
+	Identity func(node string) (string, error)
+
+	// Key maps the ID of a node to the key of its certificate, e.g.
+	// "namespace/name" for IDs with an IP, so that the IDs of a node share
+	// its certificate and Forget takes the same key. The ID is the key if
+	// unset.
+	Key func(node string) string
+
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+	ttl     time.Duration
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu     sync.Mutex
+	issued map[string]*issued
+}
+
+type issued struct {
+	identity string
+	chain    []byte
+	key      []byte
+	rotation time.Time
+}
+
+// NewSelfSignedCA creates a CA with a new self-signed root for the
+// organization issuing certificates valid for the TTL
+func NewSelfSignedCA(org string, ttl time.Duration) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{org}},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(rootTTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewCA(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		ttl)
+}
+
+// NewCA creates a CA from a PEM-encoded signing certificate and key, e.g.
+// loaded from a Kubernetes secret
+func NewCA(certPEM, keyPEM []byte, ttl time.Duration) (*CA, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("invalid CA certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+	key, err := parseKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid certificate TTL %v", ttl)
+	}
+	return &CA{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		key:     key,
+		ttl:     ttl,
+		now:     time.Now,
+		issued:  make(map[string]*issued),
+	}, nil
+}
+
+func parseKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("invalid CA key PEM")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported CA key: %v", err)
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported CA key type %T", key)
+	}
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// RootCert returns the PEM-encoded CA certificate
+func (ca *CA) RootCert() ([]byte, error) {
+	return ca.certPEM, nil
+}
+
+// Certificate returns the PEM-encoded certificate chain and key of the node.
+// The certificate is re-issued if it is due for rotation or the identity of
+// the node has changed.
+func (ca *CA) Certificate(node string) ([]byte, []byte, error) {
+	if ca.Identity == nil {
+		return nil, nil, errors.New("missing identity resolver")
+	}
+	identity, err := ca.Identity(node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := node
+	if ca.Key != nil {
+		key = ca.Key(node)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	now := ca.now()
+	if cert, exists := ca.issued[key]; exists && cert.identity == identity && now.Before(cert.rotation) {
+		return cert.chain, cert.key, nil
+	}
+
+	cert, err := ca.sign(identity, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca.issued[key] = cert
+	return cert.chain, cert.key, nil
+}
+
+// Forget drops the certificate of a node by its key
+func (ca *CA) Forget(key string) {
+	ca.mu.Lock()
+	delete(ca.issued, key)
+	ca.mu.Unlock()
+}
+
+// sign issues a certificate with the identity as the URI subject alternative name
+func (ca *CA) sign(identity string, now time.Time) (*issued, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	san, err := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(identity)}})
+	if err != nil {
+		return nil, err
+	}
+	expiry := now.Add(ca.ttl)
+	if expiry.After(ca.cert.NotAfter) {
+		expiry = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     expiry,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		// the subject is empty so the alternative name must be critical
+		ExtraExtensions: []pkix.Extension{{Id: oidSubjectAltName, Critical: true, Value: san}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &issued{
+		identity: identity,
+		chain:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		rotation: now.Add(expiry.Sub(now) * 2 / 3),
+	}, nil
+}
@@ -0,0 +1,155 @@
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const identity = "spiffe://cluster.local/ns/default/sa/bookinfo"
+
+func parseCert(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("invalid PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func uriSAN(t *testing.T, cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if name.Tag == 6 {
+				return string(name.Bytes)
+			}
+		}
+	}
+	return ""
+}
+
+func TestCertificate(t *testing.T) {
+	ca, err := NewSelfSignedCA("cluster.local", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities := map[string]string{"default/pod1": identity}
+	ca.Identity = func(node string) (string, error) {
+		if id, exists := identities[node]; exists {
+			return id, nil
+		}
+		return "", errors.New("unknown node")
+	}
+	now := time.Now()
+	ca.now = func() time.Time { return now }
+
+	chain, key, err := ca.Certificate("default/pod1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) == 0 {
+		t.Error("missing key")
+	}
+	root, _ := ca.RootCert()
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(root)
+	cert := parseCert(t, chain)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Errorf("certificate does not verify against the root: %v", err)
+	}
+	if got := uriSAN(t, cert); got != identity {
+		t.Errorf("got identity %q, want %q", got, identity)
+	}
+	if cert.NotAfter.After(now.Add(time.Hour)) {
+		t.Errorf("certificate expires at %v, after the TTL", cert.NotAfter)
+	}
+
+	// the certificate is cached until rotation
+	now = now.Add(30 * time.Minute)
+	if again, _, _ := ca.Certificate("default/pod1"); string(again) != string(chain) {
+		t.Error("expected the cached certificate")
+	}
+	now = now.Add(15 * time.Minute)
+	rotated, _, err := ca.Certificate("default/pod1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rotated) == string(chain) {
+		t.Error("expected a rotated certificate")
+	}
+
+	// a change of identity re-issues the certificate
+	identities["default/pod1"] = "spiffe://cluster.local/ns/default/sa/other"
+	changed, _, err := ca.Certificate("default/pod1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := uriSAN(t, parseCert(t, changed)); got != identities["default/pod1"] {
+		t.Errorf("got identity %q, want %q", got, identities["default/pod1"])
+	}
+
+	if _, _, err := ca.Certificate("default/unknown"); err == nil {
+		t.Error("expected an error for an unknown node")
+	}
+}
+
+func TestForget(t *testing.T) {
+	ca, err := NewSelfSignedCA("cluster.local", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.Identity = func(string) (string, error) { return identity, nil }
+	ca.Key = func(node string) string { return strings.Join(strings.Split(node, "/")[:2], "/") }
+
+	// the IDs of a node share the certificate of its key
+	chain, _, err := ca.Certificate("default/pod1/10.1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _, _ := ca.Certificate("default/pod1/10.1.1.1"); string(again) != string(chain) {
+		t.Error("expected the cached certificate of the key")
+	}
+	ca.Forget("default/pod1")
+	if len(ca.issued) != 0 {
+		t.Errorf("certificates of the forgotten key are kept: %v", ca.issued)
+	}
+	if again, _, _ := ca.Certificate("default/pod1/10.1.1.0"); string(again) == string(chain) {
+		t.Error("expected a new certificate after Forget")
+	}
+}
+
+func TestNewCA(t *testing.T) {
+	if _, err := NewCA([]byte("invalid"), []byte("invalid"), time.Hour); err == nil {
+		t.Error("expected an error for invalid PEM")
+	}
+	ca, err := NewSelfSignedCA("cluster.local", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.Identity = func(string) (string, error) { return identity, nil }
+	leaf, key, err := ca.Certificate("default/pod1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCA(leaf, key, time.Hour); err == nil {
+		t.Error("expected an error for a certificate that is not a CA")
+	}
+	root, _ := ca.RootCert()
+	if _, err := NewCA(root, key, 0); err == nil {
+		t.Error("expected an error for a zero TTL")
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
 
 	jsonnet "github.com/google/go-jsonnet"
 )
@@ -19,6 +21,12 @@ func main() {
 	}
 	vm.TLAVar("ads_host", ads)
 	vm.TLAVar("id", id)
+	vm.TLAVar("cluster", cluster)
+	metadata, err := nodeMetadata()
+	if err != nil {
+		log.Fatal(err)
+	}
+	vm.TLACode("metadata", metadata)
 	out, err := vm.EvaluateSnippet(script, string(content))
 	if err != nil {
 		log.Fatal(err)
@@ -41,13 +49,55 @@ func main() {
 	}
 }
 
+// nodeMetadata describes the workload to the controller in the node metadata
+func nodeMetadata() (string, error) {
+	metadata := map[string]interface{}{
+		"sidecar_version": version,
+		"intercept_mode":  interceptMode,
+	}
+	values := map[string]string{
+		"pod_ip":          podIP,
+		"namespace":       namespace,
+		"service_account": serviceAccount,
+	}
+	for key, value := range values {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	// the token authenticates the proxy for its workload certificate
+	if content, err := ioutil.ReadFile(tokenPath); err == nil {
+		metadata["token"] = strings.TrimSpace(string(content))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if labels != "" {
+		parsed := make(map[string]string)
+		if err := json.Unmarshal([]byte(labels), &parsed); err != nil {
+			return "", err
+		}
+		metadata["labels"] = parsed
+	}
+	out, err := json.Marshal(metadata)
+	return string(out), err
+}
+
+// version of the sidecar, set at build time
+var version = "unknown"
+
 var (
-	envoy   string
-	config  string
-	ads     string
-	script  string
-	id      string
-	cluster string
+	envoy          string
+	config         string
+	ads            string
+	script         string
+	id             string
+	cluster        string
+	podIP          string
+	namespace      string
+	serviceAccount string
+	labels         string
+	interceptMode  string
+	tokenPath      string
 )
 
 func init() {
@@ -57,4 +107,11 @@ func init() {
 	flag.StringVar(&script, "script", "bootstrap.jsonnet", "bootstrap script")
 	flag.StringVar(&id, "id", "unknown-id", "Workload ID")
 	flag.StringVar(&cluster, "cluster", "unknown-cluster", "Service cluster")
+	flag.StringVar(&podIP, "ip", "", "Pod IP")
+	flag.StringVar(&namespace, "namespace", "", "Pod namespace")
+	flag.StringVar(&serviceAccount, "service-account", "", "Pod service account")
+	flag.StringVar(&labels, "labels", "", "Pod labels as a JSON object")
+	flag.StringVar(&interceptMode, "intercept-mode", "REDIRECT", "Traffic interception mode of the iptables rules")
+	flag.StringVar(&tokenPath, "token", "/var/run/secrets/kubernetes.io/serviceaccount/token",
+		"Pod service account token authenticating the proxy for certificates (skipped if missing)")
 }
@@ -0,0 +1,133 @@
+// Command authz is a reference external authorization service for the
+// envoy.ext_authz filters. It allows requests matching any of the rules in a
+// file and denies the rest.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2alpha"
+	"github.com/ghodss/yaml"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/golang/glog"
+	"github.com/kyessenov/envoymesh/model"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	flag.Parse()
+
+	rules, err := loadRules(rulesFile)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("loaded %d rules from %s", len(rules), rulesFile)
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		glog.Fatalf("failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	auth.RegisterAuthorizationServer(grpcServer, &server{rules: rules, trustDomain: trustDomain})
+	if err = grpcServer.Serve(lis); err != nil {
+		glog.Error(err)
+	}
+}
+
+// loadRules reads a YAML or JSON list of authorization rules
+func loadRules(path string) ([]*model.AuthorizationRule, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*model.AuthorizationRule, 0)
+	if err := yaml.Unmarshal(content, &out); err != nil {
+		return nil, fmt.Errorf("invalid rules in %s: %v", path, err)
+	}
+	policy := model.AuthorizationPolicy{Action: model.AuthorizationAllow, Rules: out}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rules in %s: %v", path, err)
+	}
+	return out, nil
+}
+
+// server allows the requests matching any of the rules
+type server struct {
+	rules []*model.AuthorizationRule
+
+	// trustDomain of the SPIFFE identities of the namespaces in the rules
+	trustDomain string
+}
+
+// Check implements AuthorizationServer
+func (s *server) Check(ctx context.Context, req *auth.CheckRequest) (*auth.CheckResponse, error) {
+	principal := req.GetAttributes().GetSource().GetPrincipal()
+	http := req.GetAttributes().GetRequest().GetHttp()
+	for _, rule := range s.rules {
+		if matches(rule, s.trustDomain, principal, http) {
+			glog.V(2).Infof("allow %q %s %s", principal, http.GetMethod(), http.GetPath())
+			return &auth.CheckResponse{Status: &rpc.Status{Code: int32(rpc.OK)}}, nil
+		}
+	}
+	glog.V(2).Infof("deny %q %s %s", principal, http.GetMethod(), http.GetPath())
+	return &auth.CheckResponse{Status: &rpc.Status{Code: int32(rpc.PERMISSION_DENIED)}}, nil
+}
+
+// matches checks the conditions of a rule. Namespaces match the SPIFFE
+// identities of the trust domain. Connections without HTTP attributes only
+// match rules without HTTP conditions.
+func matches(rule *model.AuthorizationRule, trustDomain, principal string, http *auth.AttributeContext_HttpRequest) bool {
+	if len(rule.Principals) > 0 && !matchAny(rule.Principals, func(p string) bool { return p == principal }) {
+		return false
+	}
+	if len(rule.Namespaces) > 0 && !matchAny(rule.Namespaces, func(ns string) bool {
+		return strings.HasPrefix(principal, fmt.Sprintf("spiffe://%s/ns/%s/sa/", trustDomain, ns))
+	}) {
+		return false
+	}
+	if rule.HTTPOnly() && http == nil {
+		return false
+	}
+	if len(rule.Paths) > 0 && !matchAny(rule.Paths, func(path string) bool { return matchPath(path, http.Path) }) {
+		return false
+	}
+	if len(rule.Methods) > 0 && !matchAny(rule.Methods, func(method string) bool { return method == http.Method }) {
+		return false
+	}
+	return true
+}
+
+// matchPath matches the path exactly, or by prefix if the rule path ends
+// with "*"
+func matchPath(rule, path string) bool {
+	if strings.HasSuffix(rule, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(rule, "*"))
+	}
+	return rule == path
+}
+
+func matchAny(values []string, match func(string) bool) bool {
+	for _, value := range values {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	port        int
+	rulesFile   string
+	trustDomain string
+)
+
+func init() {
+	flag.IntVar(&port, "port", 9191, "gRPC port")
+	flag.StringVar(&rulesFile, "rules", "rules.yaml", "File with the allow rules")
+	flag.StringVar(&trustDomain, "trust-domain", "cluster.local", "Trust domain of the SPIFFE identities of the namespaces in the rules")
+}
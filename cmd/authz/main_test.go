@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2alpha"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func TestMatches(t *testing.T) {
+	get := &auth.AttributeContext_HttpRequest{Method: "GET", Path: "/api/v1"}
+	testCases := []struct {
+		name      string
+		rule      *model.AuthorizationRule
+		principal string
+		http      *auth.AttributeContext_HttpRequest
+		want      bool
+	}{
+		{"empty rule", &model.AuthorizationRule{}, "", nil, true},
+		{"principal", &model.AuthorizationRule{Principals: []string{"spiffe://cluster.local/ns/default/sa/bookinfo"}},
+			"spiffe://cluster.local/ns/default/sa/bookinfo", get, true},
+		{"other principal", &model.AuthorizationRule{Principals: []string{"spiffe://cluster.local/ns/default/sa/bookinfo"}},
+			"spiffe://cluster.local/ns/default/sa/other", get, false},
+		{"namespace", &model.AuthorizationRule{Namespaces: []string{"default"}},
+			"spiffe://cluster.local/ns/default/sa/bookinfo", get, true},
+		{"namespace of another trust domain", &model.AuthorizationRule{Namespaces: []string{"default"}},
+			"spiffe://evil.com/ns/default/sa/bookinfo", get, false},
+		{"namespace inside another identity", &model.AuthorizationRule{Namespaces: []string{"default"}},
+			"spiffe://cluster.local/ns/other/sa/x/ns/default/sa/bookinfo", get, false},
+		{"namespace prefix", &model.AuthorizationRule{Namespaces: []string{"def"}},
+			"spiffe://cluster.local/ns/default/sa/bookinfo", get, false},
+		{"unauthenticated namespace", &model.AuthorizationRule{Namespaces: []string{"default"}}, "", get, false},
+		{"path and method", &model.AuthorizationRule{Paths: []string{"/api*"}, Methods: []string{"GET"}}, "", get, true},
+		{"other method", &model.AuthorizationRule{Paths: []string{"/api*"}, Methods: []string{"POST"}}, "", get, false},
+		{"HTTP rule without HTTP", &model.AuthorizationRule{Paths: []string{"*"}}, "", nil, false},
+	}
+	for _, test := range testCases {
+		if got := matches(test.rule, "cluster.local", test.principal, test.http); got != test.want {
+			t.Errorf("%s: matches => %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	testCases := []struct {
+		rule, path string
+		want       bool
+	}{
+		{"/api", "/api", true},
+		{"/api", "/api/v1", false},
+		{"/api*", "/api/v1", true},
+		{"/api*", "/apiv1", true},
+		{"/api/*", "/api", false},
+		{"*", "/", true},
+		{"*", "/anything", true},
+	}
+	for _, test := range testCases {
+		if got := matchPath(test.rule, test.path); got != test.want {
+			t.Errorf("matchPath(%q, %q) => %t, want %t", test.rule, test.path, got, test.want)
+		}
+	}
+}
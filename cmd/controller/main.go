@@ -1,16 +1,30 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"strings"
+	"time"
 
-	"github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	metrics "github.com/envoyproxy/go-control-plane/envoy/service/metrics/v2"
 	"github.com/envoyproxy/go-control-plane/pkg/server"
 	"github.com/golang/glog"
+	"github.com/kyessenov/envoymesh/aggregate"
+	"github.com/kyessenov/envoymesh/ca"
+	"github.com/kyessenov/envoymesh/consul"
 	"github.com/kyessenov/envoymesh/envoy"
+	"github.com/kyessenov/envoymesh/file"
+	"github.com/kyessenov/envoymesh/kube"
+	"github.com/kyessenov/envoymesh/memory"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 )
 
@@ -18,22 +32,92 @@ func main() {
 	flag.Parse()
 	stop := make(chan struct{})
 
-	generator, err := envoy.NewKubeGenerator(kubeconfig)
+	// certificates are only served to proxies authenticated by their
+	// service account tokens
+	if (builtinCA || certDir != "") && registry != "kubernetes" {
+		glog.Fatalf("certificates require the kubernetes registry to authenticate the proxies")
+	}
+	var certs envoy.CertificateProvider
+	var authority *ca.CA
+	switch {
+	case builtinCA:
+		var err error
+		if authority, err = createCA(); err != nil {
+			glog.Fatal(err)
+		}
+		certs = authority
+	case certDir != "":
+		certs = &envoy.FileCertificates{Dir: certDir}
+	}
+	// mutual TLS is only configured with a root certificate
+	if mtls && certs == nil {
+		glog.Fatalf("--mtls requires workload certificates, set --ca or --certs")
+	}
+
+	generator, err := createGenerator(envoy.GeneratorOptions{
+		Script:            script,
+		ScriptPollPeriod:  scriptPollPeriod,
+		EntriesPollPeriod: registryPollPeriod,
+		Native:            native,
+		MutualTLS:         mtls,
+		Certificates:      certs,
+		AccessLog:         accessLogPath != "",
+		NodeGracePeriod:   nodeGracePeriod,
+		Incremental:       incremental,
+		ServiceEntries:    serviceEntries,
+	})
 	if err != nil {
 		glog.Fatal(err)
 	}
+	if authority != nil {
+		authority.Identity = generator.Identity
+		authority.Key = envoy.NodeKey
+	}
 
 	srv := server.NewServer(generator.Cache(), generator)
-	grpcServer := grpc.NewServer()
+	var ads discovery.AggregatedDiscoveryServiceServer = srv
+	if incremental {
+		ads = envoy.NewDeltaServer(srv, generator.DeltaCache(), generator.ID, generator)
+	}
+	grpcServer := grpc.NewServer(grpc.StreamInterceptor(envoy.ValidateNodes))
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		glog.Fatalf("failed to listen: %v", err)
 	}
-	v2.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv)
+	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, ads)
+	proxyMetrics := envoy.NewMetricsServer()
+	metrics.RegisterMetricsServiceServer(grpcServer, proxyMetrics)
+	if certs != nil {
+		secrets := envoy.NewSecretServer(certs, generator)
+		discovery.RegisterSecretDiscoveryServiceServer(grpcServer, secrets)
+		go secrets.Run(stop, refreshPeriod())
+	}
+	if accessLogPath != "" {
+		sink, err := os.OpenFile(accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer sink.Close()
+		accesslog.RegisterAccessLogServiceServer(grpcServer, envoy.NewAccessLogServer(sink, generator.WorkloadUID))
+	}
 
 	go generator.Run(stop)
 
-	// expose profiling endpoint
+	// expose profiling, generation status, control plane metrics, and proxy
+	// stats endpoints
+	http.HandleFunc("/debug/script", func(w http.ResponseWriter, _ *http.Request) {
+		if err := generator.ScriptError(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	http.HandleFunc("/debug/nodes", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(generator.NodeStatus())
+	})
+	http.Handle("/stats/proxies", proxyMetrics)
+	http.Handle("/metrics", promhttp.Handler())
 	go http.ListenAndServe(":15005", nil)
 
 	if err = grpcServer.Serve(lis); err != nil {
@@ -41,12 +125,130 @@ func main() {
 	}
 }
 
+// createGenerator creates a generator for the selected service registry
+func createGenerator(options envoy.GeneratorOptions) (*envoy.Generator, error) {
+	switch registry {
+	case "kubernetes":
+		if remoteClusters == "" {
+			return envoy.NewKubeGenerator(kubeconfig, options)
+		}
+		remotes, err := kube.LoadKubeconfigs(strings.Split(remoteClusters, ","))
+		if err != nil {
+			return nil, err
+		}
+		return envoy.NewMultiClusterGenerator(kubeconfig, clusterName, remotes, options)
+	case "file":
+		files, err := file.NewRegistry(file.Options{
+			Services:   servicesPath,
+			Instances:  instancesPath,
+			Workloads:  workloadsPath,
+			Config:     configPath,
+			PollPeriod: registryPollPeriod,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return envoy.NewGenerator(files, files, options)
+	case "consul":
+		catalog := consul.NewController(consul.ControllerOptions{Address: consulAddress})
+		if configPath == "" {
+			return envoy.NewGenerator(catalog, memory.NewConfigStore(memory.Config{}), options)
+		}
+		// the config file is polled by a file registry without services
+		files, err := file.NewRegistry(file.Options{Config: configPath, PollPeriod: registryPollPeriod})
+		if err != nil {
+			return nil, err
+		}
+		return envoy.NewGenerator(aggregate.NewController(catalog, files), files, options)
+	default:
+		return nil, fmt.Errorf("unknown registry %q", registry)
+	}
+}
+
+// createCA loads the CA root from a secret or creates a self-signed root.
+// The self-signed root changes on every restart, which breaks the mutual
+// TLS between the proxies until they all receive new certificates, so the
+// secret is required with --mtls.
+func createCA() (*ca.CA, error) {
+	if caSecret == "" {
+		if mtls {
+			return nil, errors.New("--ca-secret is required with --mtls, a self-signed root changes on every restart")
+		}
+		glog.Warning("WARNING: the built-in CA uses a self-signed root that is regenerated on every restart; " +
+			"set --ca-secret to keep the certificates of the proxies valid across restarts")
+		return ca.NewSelfSignedCA("cluster.local", certTTL)
+	}
+	parts := strings.Split(caSecret, "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid CA secret %q, want namespace/name", caSecret)
+	}
+	_, client, err := kube.CreateInterface(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	cert, key, err := kube.GetCASecret(client, parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return ca.NewCA(cert, key, certTTL)
+}
+
+// refreshPeriod checks for rotated certificates well before the CA rotates them
+func refreshPeriod() time.Duration {
+	if builtinCA && certTTL/10 < time.Minute {
+		return certTTL / 10
+	}
+	return time.Minute
+}
+
 var (
-	kubeconfig string
-	port       int
+	kubeconfig         string
+	port               int
+	script             string
+	scriptPollPeriod   time.Duration
+	registryPollPeriod time.Duration
+	native             bool
+	mtls               bool
+	certDir            string
+	builtinCA          bool
+	caSecret           string
+	certTTL            time.Duration
+	accessLogPath      string
+	nodeGracePeriod    time.Duration
+	incremental        bool
+	serviceEntries     string
+	registry           string
+	servicesPath       string
+	instancesPath      string
+	workloadsPath      string
+	consulAddress      string
+	configPath         string
+	clusterName        string
+	remoteClusters     string
 )
 
 func init() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Use a Kubernetes configuration file instead of in-cluster configuration")
+	flag.StringVar(&remoteClusters, "remote-kubeconfigs", "", "Comma-separated kubeconfig files or directories of kubeconfig files of remote clusters, named after the files")
+	flag.StringVar(&clusterName, "cluster-name", "local", "Name of the cluster of --kubeconfig, the locality of its endpoints with remote clusters")
 	flag.IntVar(&port, "port", 8080, "ADS port")
+	flag.StringVar(&registry, "registry", "kubernetes", "Service registry, kubernetes, file, or consul")
+	flag.StringVar(&servicesPath, "services", "", "File registry: YAML or JSON list of services")
+	flag.StringVar(&instancesPath, "instances", "", "File registry: YAML or JSON map of instances by hostname:port")
+	flag.StringVar(&workloadsPath, "workloads", "", "File registry: YAML or JSON map of workloads by namespace/name")
+	flag.StringVar(&consulAddress, "consul", "http://127.0.0.1:8500", "Consul registry: address of the Consul HTTP API")
+	flag.StringVar(&configPath, "config", "", "File and Consul registries: YAML or JSON file with route_rules, authorization_policies, external_authorizations, sidecars, and service_entries")
+	flag.StringVar(&script, "script", "envoy.jsonnet", "Envoy config generation script")
+	flag.DurationVar(&scriptPollPeriod, "script-poll", 5*time.Second, "Interval between checks of the script for changes (0 disables reloading)")
+	flag.DurationVar(&registryPollPeriod, "registry-poll", 5*time.Second, "Interval between checks of --service-entries, --config, and the files of the file registry for changes (0 disables reloading)")
+	flag.StringVar(&serviceEntries, "service-entries", "", "YAML or JSON file with a list of service entries (empty disables the file)")
+	flag.DurationVar(&nodeGracePeriod, "node-grace-period", 5*time.Minute, "Time to keep the config of a disconnected node before removing it (5m if zero)")
+	flag.BoolVar(&incremental, "incremental", false, "Serve the incremental xDS protocol with per-resource versions in addition to the state of the world")
+	flag.BoolVar(&native, "native", false, "Use the built-in config generator instead of the script")
+	flag.BoolVar(&mtls, "mtls", false, "Require mutual TLS for ports that inherit the mesh authentication policy (requires --ca or --certs)")
+	flag.BoolVar(&builtinCA, "ca", false, "Issue workload certificates with the built-in CA instead of reading --certs")
+	flag.StringVar(&caSecret, "ca-secret", "", "Secret namespace/name with ca-cert.pem and ca-key.pem of the built-in CA (required with --mtls, self-signed root regenerated on every restart if empty)")
+	flag.DurationVar(&certTTL, "cert-ttl", time.Hour, "Validity of workload certificates issued by the built-in CA")
+	flag.StringVar(&accessLogPath, "access-log", "", "File receiving the access logs of the proxies as JSON lines (empty logs to the proxy stdout)")
+	flag.StringVar(&certDir, "certs", "", "Directory with root-cert.pem, cert-chain.pem and key.pem served to the proxies over SDS (empty disables TLS)")
 }
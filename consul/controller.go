@@ -0,0 +1,269 @@
+// Package consul implements a service registry backed by the catalog and
+// health APIs of Consul
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kyessenov/envoymesh/memory"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// ControllerOptions stores the configurable attributes of a Controller
+type ControllerOptions struct {
+	// Address of the Consul HTTP API, e.g. "http://127.0.0.1:8500"
+	Address string
+
+	// Datacenter of the services, the datacenter of the agent if empty
+	Datacenter string
+
+	// WaitTime bounds the duration of the blocking queries
+	WaitTime time.Duration
+
+	// RetryDelay is the delay after a failed query
+	RetryDelay time.Duration
+}
+
+// Controller watches the Consul services with blocking queries and serves
+// the passing instances of the services. Services are named
+// "<name>.service.consul" with a single port from the port tag, named after
+// the protocol tag, in the namespace of the namespace tag, and the
+// "key=value" tags of the instances are their labels. Consul does not know the workloads of the proxies, so the
+// controller has none.
+type Controller struct {
+	*memory.Registry
+	options ControllerOptions
+	client  *http.Client
+
+	// catalog tags and passing instances by service name
+	mu      sync.Mutex
+	tags    map[string][]string
+	entries map[string][]*healthEntry
+}
+
+// NewController creates a Consul controller
+func NewController(options ControllerOptions) *Controller {
+	if options.WaitTime <= 0 {
+		options.WaitTime = 5 * time.Minute
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = time.Second
+	}
+	return &Controller{
+		Registry: memory.NewRegistry(),
+		options:  options,
+		client:   &http.Client{},
+		tags:     make(map[string][]string),
+		entries:  make(map[string][]*healthEntry),
+	}
+}
+
+// Run watches the catalog until a signal is received
+func (c *Controller) Run(stop <-chan struct{}) {
+	go c.Registry.Run(stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	c.watchCatalog(ctx)
+	glog.V(2).Info("Consul controller terminated")
+}
+
+// query performs a blocking query and returns the index of the result.
+// The query returns when the result changes after the index, or after the
+// wait time.
+func (c *Controller) query(ctx context.Context, path string, params url.Values, index uint64, out interface{}) (uint64, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%ds", int(c.options.WaitTime.Seconds())))
+	}
+	if c.options.Datacenter != "" {
+		params.Set("dc", c.options.Datacenter)
+	}
+	req, err := http.NewRequest("GET", c.options.Address+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("query %s: %s: %s", path, resp.Status, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return 0, err
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("query %s: invalid index: %v", path, err)
+	}
+	// the index must be reset if it goes backwards, e.g. after a restart of
+	// the Consul servers
+	if next < index {
+		next = 0
+	}
+	return next, nil
+}
+
+// retry waits for the retry delay and returns false if the context is done
+func (c *Controller) retry(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	glog.Warningf("Consul query failed, retrying after %v: %v", c.options.RetryDelay, err)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(c.options.RetryDelay):
+		return true
+	}
+}
+
+// watchCatalog watches the service names and starts a watch of the
+// instances of each service
+func (c *Controller) watchCatalog(ctx context.Context) {
+	watches := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range watches {
+			cancel()
+		}
+	}()
+
+	var index uint64
+	for {
+		services := make(map[string][]string)
+		next, err := c.query(ctx, "/v1/catalog/services", nil, index, &services)
+		if err != nil {
+			if !c.retry(ctx, err) {
+				return
+			}
+			continue
+		}
+		index = next
+		c.setTags(services)
+
+		for name := range services {
+			if _, exists := watches[name]; exists || name == "consul" {
+				continue
+			}
+			glog.V(2).Infof("watching Consul service %s", name)
+			serviceCtx, cancel := context.WithCancel(ctx)
+			watches[name] = cancel
+			go c.watchService(serviceCtx, name)
+		}
+		for name, cancel := range watches {
+			if _, exists := services[name]; !exists {
+				glog.V(2).Infof("Consul service %s removed", name)
+				cancel()
+				delete(watches, name)
+				c.setEntries(name, nil)
+			}
+		}
+	}
+}
+
+// watchService watches the passing instances of a service
+func (c *Controller) watchService(ctx context.Context, name string) {
+	var index uint64
+	for {
+		entries := make([]*healthEntry, 0)
+		params := url.Values{"passing": []string{"true"}}
+		next, err := c.query(ctx, "/v1/health/service/"+url.PathEscape(name), params, index, &entries)
+		if err != nil {
+			if !c.retry(ctx, err) {
+				return
+			}
+			continue
+		}
+		index = next
+		if !c.setWatchedEntries(ctx, name, entries) {
+			return
+		}
+	}
+}
+
+// setTags updates the catalog tags of the services and notifies the
+// handlers of changes
+func (c *Controller) setTags(tags map[string][]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tags = tags
+	c.update()
+}
+
+// setEntries updates the instances of a service, or removes the service if
+// the entries are nil, and notifies the handlers of changes
+func (c *Controller) setEntries(name string, entries []*healthEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entries == nil {
+		delete(c.entries, name)
+	} else {
+		c.entries[name] = entries
+	}
+	c.update()
+}
+
+// setWatchedEntries updates the instances of a service unless its watch is
+// cancelled, and returns false if it is. The watch is cancelled before the
+// service is removed, so checking it under the lock keeps a late response
+// from restoring a removed service.
+func (c *Controller) setWatchedEntries(ctx context.Context, name string, entries []*healthEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	c.entries[name] = entries
+	c.update()
+	return true
+}
+
+// update converts the services with their instances, skipping the services
+// without a usable port, and notifies the handlers of changes. The caller
+// must hold the lock.
+func (c *Controller) update() {
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	services := make([]*model.Service, 0, len(names))
+	instances := make(map[string][]model.Endpoint)
+	for _, name := range names {
+		port, err := servicePort(c.tags[name], c.entries[name])
+		if err != nil {
+			glog.V(2).Infof("skipping Consul service %s: %v", name, err)
+			continue
+		}
+		services = append(services, convertService(name, c.tags[name], port))
+		for key, endpoints := range convertInstances(name, port, c.entries[name]) {
+			instances[key] = endpoints
+		}
+	}
+
+	if !reflect.DeepEqual(services, c.Services()) {
+		c.SetServices(services)
+	}
+	if !reflect.DeepEqual(instances, c.Instances()) {
+		c.SetInstances(instances)
+	}
+}
@@ -0,0 +1,260 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// fakeConsul serves the catalog and health APIs with blocking queries
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services map[string][]*healthEntry
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, changed: make(chan struct{}), services: make(map[string][]*healthEntry)}
+}
+
+func (f *fakeConsul) set(name string, entries []*healthEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if entries == nil {
+		delete(f.services, name)
+	} else {
+		f.services[name] = entries
+	}
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// block until the index changes
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	f.mu.Lock()
+	for index == f.index {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+
+	var out interface{}
+	switch {
+	case r.URL.Path == "/v1/catalog/services":
+		// the catalog has the tags of all instances of a service
+		services := map[string][]string{"consul": {}}
+		for name, entries := range f.services {
+			tags := make([]string, 0)
+			seen := make(map[string]bool)
+			for _, entry := range entries {
+				for _, tag := range entry.Service.Tags {
+					if !seen[tag] {
+						seen[tag] = true
+						tags = append(tags, tag)
+					}
+				}
+			}
+			services[name] = tags
+		}
+		out = services
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		if r.URL.Query().Get("passing") == "" {
+			http.Error(w, "expected a query of passing instances", http.StatusBadRequest)
+			return
+		}
+		entries := f.services[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")]
+		if entries == nil {
+			entries = []*healthEntry{}
+		}
+		out = entries
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func entry(node, address, id string, port int, tags ...string) *healthEntry {
+	out := &healthEntry{}
+	out.Node.Node = node
+	out.Node.Address = address
+	out.Service.ID = id
+	out.Service.Port = port
+	out.Service.Tags = tags
+	return out
+}
+
+func TestConvertTags(t *testing.T) {
+	tags := []string{"version=v1", "canary", "protocol=HTTP", "port=80", "namespace=billing", "zone=a=b"}
+	want := model.Labels{"version": "v1", "canary": "", "zone": "a=b"}
+	if got := convertTags(tags); !reflect.DeepEqual(got, want) {
+		t.Errorf("convertTags(%v) => %v, want %v", tags, got, want)
+	}
+	for tag, want := range map[string]model.Protocol{
+		"protocol=http":  model.ProtocolHTTP,
+		"protocol=grpc":  model.ProtocolGRPC,
+		"protocol=bogus": model.ProtocolTCP,
+		"http":           model.ProtocolTCP,
+	} {
+		if got := convertProtocol([]string{tag}); got != want {
+			t.Errorf("convertProtocol(%q) => %v, want %v", tag, got, want)
+		}
+	}
+	for want, tags := range map[string][]string{
+		"billing": {"namespace=billing"},
+		"default": {"namespace=", "namespace"},
+	} {
+		if got := serviceNamespace(tags); got != want {
+			t.Errorf("serviceNamespace(%v) => %q, want %q", tags, got, want)
+		}
+	}
+}
+
+func TestServicePort(t *testing.T) {
+	entries := []*healthEntry{entry("node1", "10.0.0.1", "web1", 8080), entry("node2", "10.0.0.2", "web2", 8081)}
+	testCases := []struct {
+		tags    []string
+		entries []*healthEntry
+		want    *model.Port
+	}{
+		// the tags declare the port regardless of the instances
+		{[]string{"protocol=http", "port=80"}, entries, &model.Port{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}},
+		{[]string{"port=80"}, nil, &model.Port{Name: "tcp", Port: 80, Protocol: model.ProtocolTCP}},
+		// instances on the same port without a port tag
+		{[]string{"protocol=grpc"}, entries[:1], &model.Port{Name: "grpc", Port: 8080, Protocol: model.ProtocolGRPC}},
+		// no usable port
+		{nil, entries, nil},
+		{nil, nil, nil},
+		{[]string{"port=http"}, entries[:1], nil},
+		{[]string{"port=0"}, entries[:1], nil},
+	}
+	for _, test := range testCases {
+		got, err := servicePort(test.tags, test.entries)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("servicePort(%v) => %v, want an error", test.tags, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("servicePort(%v) => %v, %v, want %v", test.tags, got, err, test.want)
+		}
+	}
+}
+
+func TestSetWatchedEntries(t *testing.T) {
+	c := NewController(ControllerOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	if !c.setWatchedEntries(ctx, "db", []*healthEntry{entry("node1", "10.0.0.1", "db1", 5432)}) {
+		t.Fatal("entries of a current watch rejected")
+	}
+
+	// the response of a cancelled watch arrives after the removal
+	cancel()
+	c.setEntries("db", nil)
+	if c.setWatchedEntries(ctx, "db", []*healthEntry{entry("node1", "10.0.0.1", "db1", 5432)}) {
+		t.Error("entries of a cancelled watch accepted")
+	}
+	if services := c.Services(); len(services) != 0 {
+		t.Errorf("got services %v of a removed service", services)
+	}
+}
+
+func TestController(t *testing.T) {
+	fake := newFakeConsul()
+	db := entry("node1", "10.0.0.1", "db1", 5432)
+	db.Service.Address = "10.1.0.1"
+	fake.set("db", []*healthEntry{db})
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	c := NewController(ControllerOptions{Address: server.URL, RetryDelay: 10 * time.Millisecond})
+	notified := make(chan struct{}, 100)
+	c.RegisterServiceHandler(func() { notified <- struct{}{} })
+	c.RegisterEndpointHandler(func() { notified <- struct{}{} })
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Run(stop)
+
+	// wait for the handlers until the registry matches
+	expect := func(services []*model.Service, instances map[string][]model.Endpoint) {
+		deadline := time.After(5 * time.Second)
+		for {
+			if reflect.DeepEqual(c.Services(), services) && reflect.DeepEqual(c.Instances(), instances) {
+				return
+			}
+			select {
+			case <-notified:
+			case <-deadline:
+				t.Fatalf("got services %v and instances %v, want %v and %v",
+					c.Services(), c.Instances(), services, instances)
+			}
+		}
+	}
+
+	// the service address takes precedence over the node address
+	dbService := &model.Service{
+		Hostname:  "db.service.consul",
+		Namespace: "default",
+		Ports:     model.PortList{{Name: "tcp", Port: 5432, Protocol: model.ProtocolTCP}},
+	}
+	dbEndpoints := []model.Endpoint{{IP: "10.1.0.1", Port: 5432, UID: "consul://node1/db1", Labels: model.Labels{}}}
+	expect([]*model.Service{dbService}, map[string][]model.Endpoint{"db.service.consul:tcp": dbEndpoints})
+
+	// new services and instances are watched
+	fake.set("web", []*healthEntry{
+		entry("node2", "10.0.0.2", "web2", 8080, "protocol=http", "version=v2", "namespace=frontend"),
+		entry("node1", "10.0.0.1", "web1", 8080, "protocol=http", "version=v1", "namespace=frontend"),
+	})
+	web := &model.Service{
+		Hostname:  "web.service.consul",
+		Namespace: "frontend",
+		Ports:     model.PortList{{Name: "http", Port: 8080, Protocol: model.ProtocolHTTP}},
+	}
+	webEndpoints := []model.Endpoint{
+		{IP: "10.0.0.1", Port: 8080, UID: "consul://node1/web1", Labels: model.Labels{"version": "v1"}},
+		{IP: "10.0.0.2", Port: 8080, UID: "consul://node2/web2", Labels: model.Labels{"version": "v2"}},
+	}
+	expect([]*model.Service{dbService, web}, map[string][]model.Endpoint{
+		"db.service.consul:tcp":   dbEndpoints,
+		"web.service.consul:http": webEndpoints,
+	})
+
+	// services without a usable port are skipped
+	fake.set("cache", []*healthEntry{
+		entry("node1", "10.0.0.1", "cache1", 6379),
+		entry("node2", "10.0.0.2", "cache2", 6380),
+	})
+	fake.set("web", []*healthEntry{
+		entry("node2", "10.0.0.2", "web2", 8080, "protocol=http", "version=v2", "namespace=frontend", "port=80"),
+		entry("node1", "10.0.0.1", "web1", 8080, "protocol=http", "version=v1", "namespace=frontend", "port=80"),
+	})
+	web.Ports[0].Port = 80
+	expect([]*model.Service{dbService, web}, map[string][]model.Endpoint{
+		"db.service.consul:tcp":   dbEndpoints,
+		"web.service.consul:http": webEndpoints,
+	})
+
+	// removed services are removed with their instances
+	fake.set("db", nil)
+	expect([]*model.Service{web}, map[string][]model.Endpoint{"web.service.consul:http": webEndpoints})
+}
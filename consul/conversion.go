@@ -0,0 +1,173 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+const (
+	// protocolTag declares the protocol of a service, e.g. "protocol=http".
+	// The protocol defaults to TCP.
+	protocolTag = "protocol"
+
+	// portTag declares the port of a service, e.g. "port=9080". The port
+	// defaults to the port of the instances if they all have the same.
+	portTag = "port"
+
+	// namespaceTag declares the namespace of a service for the sidecars,
+	// e.g. "namespace=billing". The namespace defaults to "default".
+	namespaceTag = "namespace"
+
+	// hostnameSuffix is the DNS suffix of Consul services
+	hostnameSuffix = "service.consul"
+)
+
+// healthEntry is an instance of a service as returned by the health API
+type healthEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string   `json:"ID"`
+		Service string   `json:"Service"`
+		Tags    []string `json:"Tags"`
+		Address string   `json:"Address"`
+		Port    int      `json:"Port"`
+	} `json:"Service"`
+}
+
+var protocols = map[string]model.Protocol{
+	"grpc":  model.ProtocolGRPC,
+	"http":  model.ProtocolHTTP,
+	"http2": model.ProtocolHTTP2,
+	"https": model.ProtocolHTTPS,
+	"mongo": model.ProtocolMongo,
+	"redis": model.ProtocolRedis,
+	"tcp":   model.ProtocolTCP,
+	"udp":   model.ProtocolUDP,
+}
+
+// convertTags maps the "key=value" tags to labels. Tags without a value are
+// labels with an empty value, and the protocol, port, and namespace tags are
+// not labels.
+func convertTags(tags []string) model.Labels {
+	out := make(model.Labels, len(tags))
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if parts[0] == protocolTag || parts[0] == portTag || parts[0] == namespaceTag {
+			continue
+		}
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		out[parts[0]] = value
+	}
+	return out
+}
+
+// convertProtocol returns the protocol declared by the tags
+func convertProtocol(tags []string) model.Protocol {
+	if value, exists := tagValue(tags, protocolTag); exists {
+		if protocol, exists := protocols[strings.ToLower(value)]; exists {
+			return protocol
+		}
+	}
+	return model.ProtocolTCP
+}
+
+func serviceHostname(name string) string {
+	return fmt.Sprintf("%s.%s", name, hostnameSuffix)
+}
+
+// tagValue returns the value of the first "key=value" tag of the key in
+// sorted order
+func tagValue(tags []string, key string) (string, bool) {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	for _, tag := range sorted {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) == 2 && parts[0] == key {
+			return parts[1], true
+		}
+	}
+	return "", false
+}
+
+// servicePort is the port of a service, named after its protocol. The port
+// and the protocol are taken from the catalog tags of the service, which
+// are the tags of all its instances. Services without a port tag have the
+// port of their instances if they all listen on the same port.
+func servicePort(tags []string, entries []*healthEntry) (*model.Port, error) {
+	protocol := convertProtocol(tags)
+	number := 0
+	if value, exists := tagValue(tags, portTag); exists {
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port tag %q", value)
+		}
+		number = port
+	} else {
+		for _, entry := range entries {
+			if number != 0 && entry.Service.Port != number {
+				return nil, errors.New("instances listen on different ports without a port tag")
+			}
+			number = entry.Service.Port
+		}
+		if number <= 0 {
+			return nil, errors.New("no port tag and no instances with a port")
+		}
+	}
+	return &model.Port{
+		Name:     strings.ToLower(string(protocol)),
+		Port:     number,
+		Protocol: protocol,
+	}, nil
+}
+
+// serviceNamespace returns the namespace declared by the tags
+func serviceNamespace(tags []string) string {
+	if value, exists := tagValue(tags, namespaceTag); exists && value != "" {
+		return value
+	}
+	return "default"
+}
+
+// convertService produces the service of a Consul service in the namespace
+// of its catalog tags
+func convertService(name string, tags []string, port *model.Port) *model.Service {
+	return &model.Service{
+		Hostname:  serviceHostname(name),
+		Namespace: serviceNamespace(tags),
+		Ports:     model.PortList{port},
+	}
+}
+
+// convertInstances produces the endpoints of a Consul service sorted by
+// address. The service address takes precedence over the node address.
+func convertInstances(name string, port *model.Port, entries []*healthEntry) map[string][]model.Endpoint {
+	endpoints := make([]model.Endpoint, 0, len(entries))
+	for _, entry := range entries {
+		ip := entry.Service.Address
+		if ip == "" {
+			ip = entry.Node.Address
+		}
+		endpoints = append(endpoints, model.Endpoint{
+			IP:     ip,
+			Port:   entry.Service.Port,
+			UID:    fmt.Sprintf("consul://%s/%s", entry.Node.Node, entry.Service.ID),
+			Labels: convertTags(entry.Service.Tags),
+		})
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].IP < endpoints[j].IP ||
+			endpoints[i].IP == endpoints[j].IP && endpoints[i].Port < endpoints[j].Port
+	})
+	return map[string][]model.Endpoint{serviceHostname(name) + ":" + port.Name: endpoints}
+}
@@ -0,0 +1,116 @@
+package envoy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+)
+
+// AccessLogEntry is a line of the aggregated access log
+type AccessLogEntry struct {
+	// Time the entry was received by the controller
+	Time time.Time `json:"time"`
+
+	// UID of the workload of the node in the registry, or the workload key
+	// of nodes missing from the registry
+	UID string `json:"uid"`
+
+	// Cluster of the node
+	Cluster string `json:"cluster,omitempty"`
+
+	// Log is the name of the log, i.e. the stat prefix of the listener
+	Log string `json:"log"`
+
+	// HTTP is the HTTP access log entry as reported by Envoy
+	HTTP json.RawMessage `json:"http"`
+}
+
+// AccessLogServer aggregates the access logs streamed by the proxies into
+// JSON lines
+type AccessLogServer struct {
+	marshaler jsonpb.Marshaler
+
+	// uid resolves the workload UID of a node ID
+	uid func(node string) string
+
+	// now is replaced in tests
+	now func() time.Time
+
+	mu  sync.Mutex
+	out *json.Encoder
+}
+
+// NewAccessLogServer creates an access log service writing to the sink,
+// labeling the entries with the workload UIDs of the nodes, e.g.
+// Generator.WorkloadUID
+func NewAccessLogServer(sink io.Writer, uid func(node string) string) *AccessLogServer {
+	return &AccessLogServer{
+		marshaler: jsonpb.Marshaler{OrigName: true},
+		uid:       uid,
+		now:       time.Now,
+		out:       json.NewEncoder(sink),
+	}
+}
+
+// StreamAccessLogs implements AccessLogServiceServer
+func (s *AccessLogServer) StreamAccessLogs(stream accesslog.AccessLogService_StreamAccessLogsServer) error {
+	// only the first message of a stream carries the identifier
+	var identifier *accesslog.StreamAccessLogsMessage_Identifier
+	var uid string
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&accesslog.StreamAccessLogsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Identifier != nil {
+			identifier = msg.Identifier
+			uid = s.uid(identifier.GetNode().GetId())
+		}
+
+		entries := make([]AccessLogEntry, 0)
+		for _, entry := range msg.GetHttpLogs().GetLogEntry() {
+			data, err := s.marshal(entry)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, AccessLogEntry{HTTP: data})
+		}
+		if err := s.write(identifier, uid, entries); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *AccessLogServer) marshal(entry proto.Message) (json.RawMessage, error) {
+	data, err := s.marshaler.MarshalToString(entry)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+// write appends the entries labeled with the identity of the node
+func (s *AccessLogServer) write(identifier *accesslog.StreamAccessLogsMessage_Identifier, uid string,
+	entries []AccessLogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, entry := range entries {
+		entry.Time = now
+		entry.UID = uid
+		entry.Cluster = identifier.GetNode().GetCluster()
+		entry.Log = identifier.GetLogName()
+		if err := s.out.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
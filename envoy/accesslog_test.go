@@ -0,0 +1,106 @@
+package envoy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	filter "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
+	"github.com/kyessenov/envoymesh/memory"
+	"github.com/kyessenov/envoymesh/model"
+	"google.golang.org/grpc"
+)
+
+type fakeAccessLogStream struct {
+	grpc.ServerStream
+	messages []*accesslog.StreamAccessLogsMessage
+	closed   bool
+}
+
+func (f *fakeAccessLogStream) Recv() (*accesslog.StreamAccessLogsMessage, error) {
+	if len(f.messages) == 0 {
+		return nil, io.EOF
+	}
+	msg := f.messages[0]
+	f.messages = f.messages[1:]
+	return msg, nil
+}
+
+func (f *fakeAccessLogStream) SendAndClose(*accesslog.StreamAccessLogsResponse) error {
+	f.closed = true
+	return nil
+}
+
+func httpLogs(paths ...string) *accesslog.StreamAccessLogsMessage_HttpLogs {
+	entries := make([]*filter.HTTPAccessLogEntry, 0, len(paths))
+	for _, path := range paths {
+		entries = append(entries, &filter.HTTPAccessLogEntry{Request: &filter.HTTPRequestProperties{Path: path}})
+	}
+	return &accesslog.StreamAccessLogsMessage_HttpLogs{
+		HttpLogs: &accesslog.StreamAccessLogsMessage_HTTPAccessLogEntries{LogEntry: entries},
+	}
+}
+
+func TestStreamAccessLogs(t *testing.T) {
+	var sink bytes.Buffer
+	registry := memory.NewRegistry()
+	registry.SetWorkloads(map[string]model.Instance{"default/pod1": {UID: "kubernetes://pod1.default"}})
+	g := &Generator{controller: registry}
+	server := NewAccessLogServer(&sink, g.WorkloadUID)
+	now := time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)
+	server.now = func() time.Time { return now }
+
+	// only the first message carries the identifier
+	stream := &fakeAccessLogStream{messages: []*accesslog.StreamAccessLogsMessage{
+		{
+			Identifier: &accesslog.StreamAccessLogsMessage_Identifier{
+				Node:    &core.Node{Id: "default/pod1/10.1.1.0", Cluster: "productpage"},
+				LogName: "in_HTTP_9080",
+			},
+			LogEntries: httpLogs("/a", "/b"),
+		},
+		{LogEntries: httpLogs("/c")},
+	}}
+	if err := server.StreamAccessLogs(stream); err != nil {
+		t.Fatal(err)
+	}
+	if !stream.closed {
+		t.Error("stream not closed")
+	}
+
+	decoder := json.NewDecoder(&sink)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		var entry struct {
+			AccessLogEntry
+			HTTP struct {
+				Request struct {
+					Path string `json:"path"`
+				} `json:"request"`
+			} `json:"http"`
+		}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.UID != "kubernetes://pod1.default" || entry.Cluster != "productpage" || entry.Log != "in_HTTP_9080" {
+			t.Errorf("got identity %q/%q/%q", entry.UID, entry.Cluster, entry.Log)
+		}
+		if !entry.Time.Equal(now) {
+			t.Errorf("got time %v, want %v", entry.Time, now)
+		}
+		if entry.HTTP.Request.Path != path {
+			t.Errorf("got path %q, want %q", entry.HTTP.Request.Path, path)
+		}
+	}
+	if decoder.More() {
+		t.Error("unexpected access log entries")
+	}
+
+	// nodes missing from the registry are labeled with their workload keys
+	if uid := g.WorkloadUID("default/pod2/10.1.1.1"); uid != "default/pod2" {
+		t.Errorf("WorkloadUID of a missing workload => %q", uid)
+	}
+}
@@ -0,0 +1,46 @@
+package envoy
+
+import (
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// endpointAuthorization returns the external authorization service of a
+// workload endpoint, preferring the configurations that list the service of
+// the endpoint over the namespace-wide ones
+func endpointAuthorization(authzs []*model.ExternalAuthorization, ep model.Endpoint) *model.ExternalAuthorization {
+	for _, authz := range authzs {
+		for _, service := range authz.Services {
+			if service == ep.Service {
+				return authz
+			}
+		}
+	}
+	for _, authz := range authzs {
+		if len(authz.Services) == 0 {
+			return authz
+		}
+	}
+	return nil
+}
+
+// extAuthzFilters calls the external authorization service before the
+// requests or connections reach the workload
+func extAuthzFilters(authz *model.ExternalAuthorization, http bool, prefix string) []object {
+	if authz == nil {
+		return nil
+	}
+	service := object{
+		"envoy_grpc": object{"cluster_name": clusterKey(authz.Host, authz.Port)},
+	}
+	if authz.Timeout != "" {
+		service["timeout"] = authz.Timeout
+	}
+	config := object{"grpc_service": service}
+	if authz.FailureModeAllow {
+		config["failure_mode_allow"] = true
+	}
+	if !http {
+		config["stat_prefix"] = prefix
+	}
+	return []object{{"name": "envoy.ext_authz", "config": config}}
+}
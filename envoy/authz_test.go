@@ -0,0 +1,49 @@
+package envoy
+
+import (
+	"testing"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func TestEndpointAuthorization(t *testing.T) {
+	namespace := &model.ExternalAuthorization{Name: "default", Namespace: "default", Host: "authz", Port: "grpc"}
+	service := &model.ExternalAuthorization{
+		Name:      "ratings",
+		Namespace: "default",
+		Services:  []string{"ratings.default.svc.cluster.local"},
+		Host:      "authz",
+		Port:      "grpc",
+	}
+	authzs := []*model.ExternalAuthorization{namespace, service}
+
+	cases := []struct {
+		service string
+		want    *model.ExternalAuthorization
+	}{
+		{"ratings.default.svc.cluster.local", service},
+		{"reviews.default.svc.cluster.local", namespace},
+		{"", namespace},
+	}
+	for _, c := range cases {
+		if got := endpointAuthorization(authzs, model.Endpoint{Service: c.service}); got != c.want {
+			t.Errorf("endpointAuthorization(%q) => %v, want %v", c.service, got, c.want)
+		}
+	}
+	if got := endpointAuthorization([]*model.ExternalAuthorization{service}, model.Endpoint{}); got != nil {
+		t.Errorf("endpointAuthorization() => %v, want none", got)
+	}
+
+	filters := extAuthzFilters(service, false, "in_TCP_90")
+	if len(filters) != 1 || filters[0]["name"] != "envoy.ext_authz" {
+		t.Fatalf("unexpected filters %v", filters)
+	}
+	config := filters[0]["config"].(object)
+	if config["stat_prefix"] != "in_TCP_90" {
+		t.Errorf("got stat prefix %v", config["stat_prefix"])
+	}
+	cluster := config["grpc_service"].(object)["envoy_grpc"].(object)["cluster_name"]
+	if cluster != "authz:grpc" {
+		t.Errorf("got cluster %v, want authz:grpc", cluster)
+	}
+}
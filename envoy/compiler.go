@@ -1,40 +1,28 @@
 package envoy
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"reflect"
+	"time"
 
-	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/envoyproxy/go-control-plane/pkg/cache"
-	"github.com/gogo/protobuf/jsonpb"
 	"github.com/golang/glog"
-	jsonnet "github.com/google/go-jsonnet"
 	"github.com/kyessenov/envoymesh/model"
 )
 
-type output struct {
-	Listeners []interface{} `json:"listeners"`
-	Routes    []interface{} `json:"routes"`
-	Clusters  []interface{} `json:"clusters"`
-	Endpoints []interface{} `json:"endpoints"`
-}
-
 // Compiler represents a repeatedly executed compilation job
 type Compiler struct {
-	count int
-
-	// TODO: sharing of VM and script AST
-	vm     *jsonnet.VM
-	script string
+	count     int
+	generator ConfigGenerator
 
 	// inputs
 	uid       string
+	namespace string
 	domain    string
-	services  []*model.Service
-	instance  model.Instance
-	instances map[string][]model.Endpoint
+	input     Input
+
+	// last requested inputs, committed or not
+	last Input
 
 	// outputs
 	listeners []cache.Resource
@@ -43,107 +31,100 @@ type Compiler struct {
 	endpoints []cache.Resource
 }
 
-// NewCompiler instantiates a jsonnet compiler
-func NewCompiler(name, namespace, suffix string) (*Compiler, error) {
-	glog.Infof("prepare jsonnet VM")
-	vm := jsonnet.MakeVM()
-	content, err := ioutil.ReadFile("envoy.jsonnet")
-	if err != nil {
-		return nil, err
-	}
+// NewCompiler instantiates a compiler for a shared config generator
+func NewCompiler(generator ConfigGenerator, name, namespace, suffix string) *Compiler {
 	return &Compiler{
-		vm:        vm,
-		script:    string(content),
+		generator: generator,
 		uid:       fmt.Sprintf("kubernetes://%s.%s", name, namespace),
+		namespace: namespace,
 		domain:    fmt.Sprintf("%s.svc.%s", namespace, suffix),
 		listeners: make([]cache.Resource, 0),
 		routes:    make([]cache.Resource, 0),
 		clusters:  make([]cache.Resource, 0),
 		endpoints: make([]cache.Resource, 0),
-	}, nil
+	}
 }
 
-// Update re-compiles if necessary and returns true only then
-func (g *Compiler) Update(services []*model.Service, instance model.Instance, instances map[string][]model.Endpoint) (bool, error) {
-	if reflect.DeepEqual(services, g.services) && reflect.DeepEqual(instance, g.instance) && reflect.DeepEqual(instances, g.instances) {
-		return false, nil
+// Update re-compiles if necessary and returns true only then.
+// Changes to instances alone only regenerate endpoints and keep the
+// previously compiled listeners, routes, and clusters.
+// Inputs and outputs are committed only if compilation succeeds, so a failed
+// compilation keeps the last good outputs and is retried on the next update.
+func (g *Compiler) Update(in Input) (bool, error) {
+	in.Domain = g.domain
+	in.AuthorizationPolicies = selectPolicies(in.AuthorizationPolicies, g.namespace, in.Instance.Labels)
+	in.ExternalAuthorizations = selectAuthorizations(in.ExternalAuthorizations, g.namespace)
+	g.last = in
+	config := in
+	config.Instances = g.input.Instances
+	if reflect.DeepEqual(config, g.input) {
+		if reflect.DeepEqual(in.Instances, g.input.Instances) {
+			return false, nil
+		}
+		g.count++
+		glog.Infof("generating endpoints %d for %s", g.count, g.uid)
+		g.endpoints = buildEndpoints(g.clusters, in.Instances)
+		g.input = in
+		return true, nil
 	}
 
 	g.count++
-	g.services = services
-	g.instance = instance
-	g.instances = instances
-
-	servicesJSON, err := json.Marshal(g.services)
-	if err != nil {
-		return false, err
-	}
-	instanceJSON, err := json.Marshal(g.instance)
-	if err != nil {
-		return false, err
-	}
-	instancesJSON, err := json.Marshal(g.instances)
-	if err != nil {
-		return false, err
-	}
-
 	glog.Infof("generating snapshot %d for %s", g.count, g.uid)
-	g.vm.TLACode("services", string(servicesJSON))
-	g.vm.TLACode("instance", string(instanceJSON))
-	g.vm.TLACode("instances", string(instancesJSON))
-	g.vm.TLAVar("domain", g.domain)
-	in, err := g.vm.EvaluateSnippet("envoy.jsonnet", g.script)
+	warnPolicies(g.uid, in.AuthorizationPolicies, in.Instance.Endpoints, in.Security)
+	start := time.Now()
+	out, err := g.generator.Generate(&in)
+	compileDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		return true, err
+		compileErrors.Inc()
+		return false, err
 	}
-	glog.Infof("finished evaluation %d for %s", g.count, g.uid)
+	glog.Infof("finished generation %d for %s", g.count, g.uid)
 
-	out := output{}
-	if err := json.Unmarshal([]byte(in), &out); err != nil {
-		return true, err
-	}
+	g.input = in
+	g.clusters = out.Clusters
+	g.routes = out.Routes
+	g.listeners = out.Listeners
+	g.endpoints = out.Endpoints
+	return true, nil
+}
 
-	g.clusters = make([]cache.Resource, 0)
-	for _, cluster := range out.Clusters {
-		l := v2.Cluster{}
-		s, _ := json.Marshal(cluster)
-		if err := jsonpb.UnmarshalString(string(s), &l); err != nil {
-			return true, err
-		}
-		g.clusters = append(g.clusters, &l)
-	}
-
-	g.routes = make([]cache.Resource, 0)
-	for _, route := range out.Routes {
-		r := v2.RouteConfiguration{}
-		s, _ := json.Marshal(route)
-		if err := jsonpb.UnmarshalString(string(s), &r); err != nil {
-			return true, err
-		}
-		g.routes = append(g.routes, &r)
+// recompile produces a compiler for the same node with a different config
+// generator. It compiles the last requested inputs, so a node that failed
+// to compile with the previous generator is compiled from its actual inputs
+// rather than from the empty committed inputs.
+func (g *Compiler) recompile(generator ConfigGenerator) (*Compiler, error) {
+	out := &Compiler{
+		count:     g.count,
+		generator: generator,
+		uid:       g.uid,
+		namespace: g.namespace,
+		domain:    g.domain,
 	}
+	_, err := out.Update(g.last)
+	return out, err
+}
 
-	g.listeners = make([]cache.Resource, 0)
-	for _, listener := range out.Listeners {
-		l := v2.Listener{}
-		s, _ := json.Marshal(listener)
-		if err := jsonpb.UnmarshalString(string(s), &l); err != nil {
-			return true, err
+// selectPolicies returns the authorization policies of a workload
+func selectPolicies(policies []*model.AuthorizationPolicy, namespace string, labels model.Labels) []*model.AuthorizationPolicy {
+	out := make([]*model.AuthorizationPolicy, 0)
+	for _, policy := range policies {
+		if policy.AppliesTo(namespace, labels) {
+			out = append(out, policy)
 		}
-		g.listeners = append(g.listeners, &l)
 	}
+	return out
+}
 
-	g.endpoints = make([]cache.Resource, 0)
-	for _, endpoint := range out.Endpoints {
-		e := v2.ClusterLoadAssignment{}
-		s, _ := json.Marshal(endpoint)
-		if err := jsonpb.UnmarshalString(string(s), &e); err != nil {
-			return true, err
+// selectAuthorizations returns the external authorization services of a
+// namespace
+func selectAuthorizations(authzs []*model.ExternalAuthorization, namespace string) []*model.ExternalAuthorization {
+	out := make([]*model.ExternalAuthorization, 0)
+	for _, authz := range authzs {
+		if authz.Namespace == namespace {
+			out = append(out, authz)
 		}
-		g.endpoints = append(g.endpoints, &e)
 	}
-
-	return true, nil
+	return out
 }
 
 // Snapshot ...
@@ -151,3 +132,13 @@ func (g *Compiler) Snapshot(version int) cache.Snapshot {
 	return cache.NewSnapshot(fmt.Sprintf("%d", version),
 		g.endpoints, g.clusters, g.routes, g.listeners)
 }
+
+// Resources returns the outputs by type URL
+func (g *Compiler) Resources() map[string][]cache.Resource {
+	return map[string][]cache.Resource{
+		cache.EndpointType: g.endpoints,
+		cache.ClusterType:  g.clusters,
+		cache.RouteType:    g.routes,
+		cache.ListenerType: g.listeners,
+	}
+}
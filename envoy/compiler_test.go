@@ -0,0 +1,155 @@
+package envoy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+const testScript = "../envoy.jsonnet"
+
+func loadJSON(t testing.TB, path string, out interface{}) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadFixtures(t testing.TB) ([]*model.Service, model.Instance, map[string][]model.Endpoint) {
+	var services []*model.Service
+	var instance model.Instance
+	var instances map[string][]model.Endpoint
+	loadJSON(t, "../testdata/services.json", &services)
+	loadJSON(t, "../testdata/instance.json", &instance)
+	loadJSON(t, "../testdata/instances.json", &instances)
+	return services, instance, instances
+}
+
+func TestCompilerUpdate(t *testing.T) {
+	program, err := LoadProgram(testScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, instance, instances := loadFixtures(t)
+
+	compiler := NewCompiler(program, "pod1", "ns2", suffix)
+	updated, err := compiler.Update(Input{Services: services, Instance: instance, Instances: instances})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated {
+		t.Error("first update must compile")
+	}
+	if len(compiler.listeners) == 0 || len(compiler.routes) == 0 ||
+		len(compiler.clusters) == 0 || len(compiler.endpoints) == 0 {
+		t.Errorf("got empty outputs: %d listeners, %d routes, %d clusters, %d endpoints",
+			len(compiler.listeners), len(compiler.routes), len(compiler.clusters), len(compiler.endpoints))
+	}
+
+	if updated, _ = compiler.Update(Input{Services: services, Instance: instance, Instances: instances}); updated {
+		t.Error("repeated update must not compile")
+	}
+
+	// compilers sharing the program produce identical outputs
+	other := NewCompiler(program, "pod1", "ns2", suffix)
+	if _, err = other.Update(Input{Services: services, Instance: instance, Instances: instances}); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.listeners) != len(compiler.listeners) || len(other.clusters) != len(compiler.clusters) {
+		t.Errorf("got different outputs from a shared program")
+	}
+}
+
+func TestCompilerUpdateFailure(t *testing.T) {
+	services, instance, instances := loadFixtures(t)
+	broken, err := NewProgram("broken.jsonnet", `
+function(services, instance, instances, rules, policies, authz, security, telemetry, domain)
+    { listeners: [], routes: [], clusters: [{ name: 'x', type: 'UNKNOWN' }], endpoints: [] }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compiler := NewCompiler(broken, "pod1", "ns2", suffix)
+	for i := 0; i < 2; i++ {
+		updated, err := compiler.Update(Input{Services: services, Instance: instance, Instances: instances})
+		if err == nil || updated {
+			t.Fatalf("Update => (%t, %v), want an error", updated, err)
+		}
+	}
+	if compiler.input.Services != nil || compiler.input.Instances != nil || len(compiler.clusters) != 0 {
+		t.Error("failed compilation must not commit inputs or outputs")
+	}
+}
+
+func TestRecompileFailedNode(t *testing.T) {
+	program, err := LoadProgram(testScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, instance, instances := loadFixtures(t)
+	broken, err := NewProgram("broken.jsonnet", `
+function(services, instance, instances, rules, policies, authz, security, telemetry, domain)
+    { listeners: [], routes: [], clusters: [{ name: 'x', type: 'UNKNOWN' }], endpoints: [] }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compiler := NewCompiler(broken, "pod1", "ns2", suffix)
+	if _, err := compiler.Update(Input{Services: services, Instance: instance, Instances: instances}); err == nil {
+		t.Fatal("expected an error for the broken script")
+	}
+
+	// a node without committed inputs is recompiled from its last inputs
+	next, err := compiler.recompile(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.listeners) == 0 || len(next.clusters) == 0 || len(next.endpoints) == 0 {
+		t.Errorf("got empty outputs: %d listeners, %d clusters, %d endpoints",
+			len(next.listeners), len(next.clusters), len(next.endpoints))
+	}
+	if next.input.Services == nil || next.input.Instances == nil {
+		t.Error("recompilation must commit the last inputs")
+	}
+}
+
+// BenchmarkSharedProgram compiles node configs with a single parsed program
+func BenchmarkSharedProgram(b *testing.B) {
+	program, err := LoadProgram(testScript)
+	if err != nil {
+		b.Fatal(err)
+	}
+	services, instance, instances := loadFixtures(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		compiler := NewCompiler(program, fmt.Sprintf("pod%d", i), "default", suffix)
+		if _, err := compiler.Update(Input{Services: services, Instance: instance, Instances: instances}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkProgramPerCompiler reads and parses the script for every node as
+// compilers used to do
+func BenchmarkProgramPerCompiler(b *testing.B) {
+	services, instance, instances := loadFixtures(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		program, err := LoadProgram(testScript)
+		if err != nil {
+			b.Fatal(err)
+		}
+		compiler := NewCompiler(program, fmt.Sprintf("pod%d", i), "default", suffix)
+		if _, err := compiler.Update(Input{Services: services, Instance: instance, Instances: instances}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
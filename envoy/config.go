@@ -0,0 +1,64 @@
+package envoy
+
+import (
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// Input is the mesh state visible to a node
+type Input struct {
+	// Domain of the node namespace, e.g. "default.svc.cluster.local"
+	Domain   string
+	Services []*model.Service
+	Instance model.Instance
+
+	// Instances by cluster name, including subsets of the route rules
+	Instances  map[string][]model.Endpoint
+	RouteRules []*model.RouteRule
+
+	// AuthorizationPolicies applicable to the workload of the node
+	AuthorizationPolicies []*model.AuthorizationPolicy
+
+	// ExternalAuthorizations in the namespace of the node
+	ExternalAuthorizations []*model.ExternalAuthorization
+
+	Security  Security
+	Telemetry Telemetry
+}
+
+// Security is the mesh-wide transport security configuration. Mutual TLS is
+// disabled without a root certificate.
+type Security struct {
+	// MutualTLS is the policy of ports that inherit the mesh policy
+	MutualTLS bool `json:"mutual_tls"`
+
+	// RootCert is the PEM-encoded certificate to verify peers
+	RootCert string `json:"root_cert"`
+
+	// SDSCluster is the bootstrap cluster of the secret discovery service
+	SDSCluster string `json:"sds_cluster"`
+
+	// TrustDomain of the workload identities, e.g. "cluster.local"
+	TrustDomain string `json:"trust_domain"`
+}
+
+// Telemetry is the mesh-wide configuration of the proxy telemetry. Access
+// logs are written to stdout without an access log cluster.
+type Telemetry struct {
+	// AccessLogCluster is the bootstrap cluster of the access log service
+	AccessLogCluster string `json:"access_log_cluster"`
+}
+
+// Config is the set of xDS resources for a node
+type Config struct {
+	Listeners []cache.Resource
+	Routes    []cache.Resource
+	Clusters  []cache.Resource
+	Endpoints []cache.Resource
+}
+
+// ConfigGenerator translates the mesh state into Envoy configuration
+type ConfigGenerator interface {
+	// Generate produces the complete configuration for a node
+	Generate(in *Input) (*Config, error)
+}
@@ -0,0 +1,426 @@
+package envoy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/envoyproxy/go-control-plane/pkg/server"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// deltaTypes are the resource types in the order of the pushes, so that
+// clusters are updated before their endpoints and listeners before their
+// routes
+var deltaTypes = []string{cache.ClusterType, cache.EndpointType, cache.ListenerType, cache.RouteType}
+
+// DeltaCache tracks the resources of the nodes with per-resource versions
+// for the incremental xDS protocol. A resource keeps its version until its
+// content changes, so only the changed resources are sent to the nodes.
+type DeltaCache struct {
+	mu    sync.Mutex
+	nodes map[string]*deltaNode
+}
+
+type deltaNode struct {
+	version   string
+	resources map[string]map[string]versionedResource
+
+	// changed is closed on the next update of the node
+	changed chan struct{}
+
+	// streams counts the open streams of the node
+	streams int
+}
+
+type versionedResource struct {
+	name     string
+	version  string
+	resource cache.Resource
+}
+
+// NewDeltaCache creates an empty cache
+func NewDeltaCache() *DeltaCache {
+	return &DeltaCache{nodes: make(map[string]*deltaNode)}
+}
+
+func (c *DeltaCache) node(key string) *deltaNode {
+	node, exists := c.nodes[key]
+	if !exists {
+		node = &deltaNode{
+			resources: make(map[string]map[string]versionedResource),
+			changed:   make(chan struct{}),
+		}
+		c.nodes[key] = node
+	}
+	return node
+}
+
+// SetResources updates the resources of a node by type URL. Resources equal
+// to the previous ones keep their version, and the others are assigned the
+// snapshot version.
+func (c *DeltaCache) SetResources(key, version string, resources map[string][]cache.Resource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node := c.node(key)
+	out := make(map[string]map[string]versionedResource, len(resources))
+	for typeURL, items := range resources {
+		previous := node.resources[typeURL]
+		out[typeURL] = make(map[string]versionedResource, len(items))
+		for _, item := range items {
+			name := cache.GetResourceName(item)
+			if last, exists := previous[name]; exists && proto.Equal(last.resource, item) {
+				out[typeURL][name] = last
+				continue
+			}
+			out[typeURL][name] = versionedResource{name: name, version: version, resource: item}
+		}
+	}
+	node.version = version
+	node.resources = out
+	close(node.changed)
+	node.changed = make(chan struct{})
+}
+
+// ClearNode removes the resources of a node. The resources of a node with
+// open streams are kept, since the streams would otherwise tell the proxy
+// that every resource was removed, e.g. when a node reconnects as its grace
+// period expires.
+func (c *DeltaCache) ClearNode(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if node, exists := c.nodes[key]; exists {
+		if node.streams > 0 {
+			glog.V(2).Infof("keeping the resources of node %v with open streams", key)
+			return
+		}
+		close(node.changed)
+		delete(c.nodes, key)
+	}
+}
+
+// open registers an open stream of a node
+func (c *DeltaCache) open(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.node(key).streams++
+}
+
+// release unregisters a closed stream of a node
+func (c *DeltaCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if node, exists := c.nodes[key]; exists {
+		node.streams--
+	}
+}
+
+// watch returns the snapshot version and the resources of a node, and a
+// channel closed on the next update of the node
+func (c *DeltaCache) watch(key string) (string, map[string]map[string]versionedResource, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node := c.node(key)
+	return node.version, node.resources, node.changed
+}
+
+// deltaSubscription is the state of a resource type on an incremental stream
+type deltaSubscription struct {
+	// wildcard subscriptions receive all resources of the type, e.g. the
+	// listeners and clusters
+	wildcard bool
+	names    map[string]bool
+
+	// versions of the resources acknowledged by the node
+	versions map[string]string
+
+	// responses awaiting an acknowledgement in the order they were sent
+	pending []deltaResponse
+}
+
+// deltaResponse is a change of the resources sent to the node
+type deltaResponse struct {
+	nonce    string
+	versions map[string]string
+	removed  []string
+}
+
+func newDeltaSubscription(req *v2.IncrementalDiscoveryRequest) *deltaSubscription {
+	out := &deltaSubscription{
+		wildcard: len(req.ResourceNamesSubscribe) == 0 &&
+			(req.TypeUrl == cache.ClusterType || req.TypeUrl == cache.ListenerType),
+		names:    make(map[string]bool),
+		versions: make(map[string]string),
+	}
+	for name, version := range req.InitialResourceVersions {
+		out.versions[name] = version
+	}
+	return out
+}
+
+// update applies the subscription changes of a request and returns true if
+// the subscribed names changed
+func (sub *deltaSubscription) update(req *v2.IncrementalDiscoveryRequest) bool {
+	changed := false
+	for _, name := range req.ResourceNamesSubscribe {
+		if !sub.names[name] {
+			sub.names[name] = true
+			changed = true
+		}
+	}
+	for _, name := range req.ResourceNamesUnsubscribe {
+		if sub.names[name] {
+			delete(sub.names, name)
+			delete(sub.versions, name)
+			for _, resp := range sub.pending {
+				delete(resp.versions, name)
+			}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// acknowledge applies the response with the nonce to the versions of the
+// node if the node accepted it. A rejected response is dropped, so that its
+// resources are sent again with the next change of the node.
+func (sub *deltaSubscription) acknowledge(nonce string, accepted bool) {
+	for i, resp := range sub.pending {
+		if resp.nonce != nonce {
+			continue
+		}
+		if accepted {
+			for name, version := range resp.versions {
+				sub.versions[name] = version
+			}
+			for _, name := range resp.removed {
+				delete(sub.versions, name)
+			}
+		}
+		sub.pending = append(sub.pending[:i], sub.pending[i+1:]...)
+		return
+	}
+}
+
+// known returns the versions of the resources known to the node once it
+// acknowledges the pending responses
+func (sub *deltaSubscription) known() map[string]string {
+	out := make(map[string]string, len(sub.versions))
+	for name, version := range sub.versions {
+		out[name] = version
+	}
+	for _, resp := range sub.pending {
+		for name, version := range resp.versions {
+			out[name] = version
+		}
+		for _, name := range resp.removed {
+			delete(out, name)
+		}
+	}
+	return out
+}
+
+// diff returns the subscribed resources with versions unknown to the node and
+// the names of the removed resources sorted by name
+func (sub *deltaSubscription) diff(resources map[string]versionedResource) ([]versionedResource, []string) {
+	known := sub.known()
+	updated := make([]versionedResource, 0)
+	for name, resource := range resources {
+		if !sub.wildcard && !sub.names[name] {
+			continue
+		}
+		if known[name] != resource.version {
+			updated = append(updated, resource)
+		}
+	}
+	removed := make([]string, 0)
+	for name := range known {
+		if _, exists := resources[name]; !exists {
+			removed = append(removed, name)
+		}
+	}
+	sort.Slice(updated, func(i, j int) bool { return updated[i].name < updated[j].name })
+	sort.Strings(removed)
+	return updated, removed
+}
+
+// DeltaServer serves the incremental variant of ADS from a delta cache and
+// delegates the state of the world protocol to the embedded server
+type DeltaServer struct {
+	server.Server
+
+	cache     *DeltaCache
+	callbacks server.Callbacks
+
+	// id maps the nodes to the keys of the cache
+	id func(*core.Node) string
+
+	streams int64
+	nonce   int64
+}
+
+// NewDeltaServer creates an ADS server with support for incremental streams.
+// The callbacks are notified of the incremental streams as well.
+func NewDeltaServer(sotw server.Server, cache *DeltaCache, id func(*core.Node) string, callbacks server.Callbacks) *DeltaServer {
+	return &DeltaServer{
+		Server:    sotw,
+		cache:     cache,
+		callbacks: callbacks,
+		id:        id,
+	}
+}
+
+// IncrementalAggregatedResources implements AggregatedDiscoveryServiceServer
+func (s *DeltaServer) IncrementalAggregatedResources(stream discovery.AggregatedDiscoveryService_IncrementalAggregatedResourcesServer) error {
+	// incremental stream IDs are negative to never collide with the IDs of
+	// the state of the world streams
+	id := -atomic.AddInt64(&s.streams, 1)
+	ctx := stream.Context()
+	defer adsStreamCounts.close(id)
+	if s.callbacks != nil {
+		if err := s.callbacks.OnStreamOpen(ctx, id, ""); err != nil {
+			return err
+		}
+		defer s.callbacks.OnStreamClosed(id)
+	}
+
+	requests := make(chan *v2.IncrementalDiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// the node is set by the first request, and the stream is notified of
+	// the changes of the node after that
+	var node *core.Node
+	var changed <-chan struct{}
+	subscriptions := make(map[string]*deltaSubscription)
+
+	for {
+		select {
+		case req := <-requests:
+			if node == nil {
+				if req.Node == nil {
+					return status.Error(codes.InvalidArgument, "missing node in the first request")
+				}
+				node = req.Node
+				key := s.id(node)
+				s.cache.open(key)
+				defer s.cache.release(key)
+			}
+			if req.ErrorDetail != nil {
+				glog.Warningf("node %v rejected %s nonce %q: %s",
+					node.GetId(), req.TypeUrl, req.ResponseNonce, req.ErrorDetail.Message)
+			}
+			sub, exists := subscriptions[req.TypeUrl]
+			if !exists {
+				sub = newDeltaSubscription(req)
+				subscriptions[req.TypeUrl] = sub
+			}
+			if req.ResponseNonce != "" {
+				sub.acknowledge(req.ResponseNonce, req.ErrorDetail == nil)
+			}
+			updated := sub.update(req)
+			if s.callbacks != nil {
+				s.callbacks.OnStreamRequest(id, &v2.DiscoveryRequest{
+					Node:          node,
+					TypeUrl:       req.TypeUrl,
+					ResourceNames: req.ResourceNamesSubscribe,
+					ResponseNonce: req.ResponseNonce,
+				})
+			}
+			// acknowledgements without subscription changes need no reply
+			if exists && !updated {
+				continue
+			}
+			// the new watch replaces the pending notification, so the
+			// changes of the other subscribed types are sent as well
+			next, err := s.sendAll(stream, id, node, subscriptions)
+			if err != nil {
+				return err
+			}
+			changed = next
+		case <-changed:
+			next, err := s.sendAll(stream, id, node, subscriptions)
+			if err != nil {
+				return err
+			}
+			changed = next
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sendAll pushes the changes of every subscribed type and returns the
+// notification of the next change
+func (s *DeltaServer) sendAll(stream discovery.AggregatedDiscoveryService_IncrementalAggregatedResourcesServer,
+	id int64, node *core.Node, subscriptions map[string]*deltaSubscription) (<-chan struct{}, error) {
+	version, resources, changed := s.cache.watch(s.id(node))
+	for _, typeURL := range deltaTypes {
+		if sub, exists := subscriptions[typeURL]; exists {
+			if err := s.send(stream, id, typeURL, version, sub, resources[typeURL]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return changed, nil
+}
+
+// send pushes the changes of a resource type unknown to the node, if any
+func (s *DeltaServer) send(stream discovery.AggregatedDiscoveryService_IncrementalAggregatedResourcesServer,
+	id int64, typeURL, version string, sub *deltaSubscription, resources map[string]versionedResource) error {
+	updated, removed := sub.diff(resources)
+	if len(updated) == 0 && len(removed) == 0 {
+		return nil
+	}
+	out := &v2.IncrementalDiscoveryResponse{
+		SystemVersionInfo: version,
+		Resources:         make([]v2.Resource, 0, len(updated)),
+		RemovedResources:  removed,
+		Nonce:             fmt.Sprintf("%d", atomic.AddInt64(&s.nonce, 1)),
+	}
+	resp := deltaResponse{nonce: out.Nonce, versions: make(map[string]string, len(updated)), removed: removed}
+	for _, resource := range updated {
+		resp.versions[resource.name] = resource.version
+	}
+	sub.pending = append(sub.pending, resp)
+	for _, resource := range updated {
+		data, err := types.MarshalAny(resource.resource)
+		if err != nil {
+			return err
+		}
+		out.Resources = append(out.Resources, v2.Resource{
+			Version:  resource.version,
+			Resource: data,
+		})
+	}
+	adsResponses.WithLabelValues(typeURL).Inc()
+	adsStreamCounts.response(id, typeURL)
+	return stream.Send(out)
+}
@@ -0,0 +1,278 @@
+package envoy
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/gogo/googleapis/google/rpc"
+	"github.com/gogo/protobuf/types"
+	"github.com/kyessenov/envoymesh/model"
+	"google.golang.org/grpc"
+)
+
+func TestDeltaCacheVersions(t *testing.T) {
+	c := NewDeltaCache()
+	c.SetResources("ns1/pod1", "1", map[string][]cache.Resource{
+		cache.ClusterType: {&v2.Cluster{Name: "a"}, &v2.Cluster{Name: "b"}},
+	})
+	_, _, changed := c.watch("ns1/pod1")
+	c.SetResources("ns1/pod1", "2", map[string][]cache.Resource{
+		cache.ClusterType: {&v2.Cluster{Name: "a"}, &v2.Cluster{Name: "b", LbPolicy: v2.Cluster_RANDOM}},
+	})
+	select {
+	case <-changed:
+	default:
+		t.Error("watch was not notified of the update")
+	}
+
+	version, resources, _ := c.watch("ns1/pod1")
+	if version != "2" {
+		t.Errorf("got snapshot version %q, want 2", version)
+	}
+	got := map[string]string{}
+	for name, resource := range resources[cache.ClusterType] {
+		got[name] = resource.version
+	}
+	if want := map[string]string{"a": "1", "b": "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got versions %v, want %v", got, want)
+	}
+}
+
+// fakeEnvoy is an incremental ADS client
+type fakeEnvoy struct {
+	t      *testing.T
+	stream discovery.AggregatedDiscoveryService_IncrementalAggregatedResourcesClient
+}
+
+func (f *fakeEnvoy) send(req *v2.IncrementalDiscoveryRequest) {
+	if err := f.stream.Send(req); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// recv returns the names of the updated and removed resources of the next
+// response, and acknowledges it
+func (f *fakeEnvoy) recv(typeURL string) ([]string, []string) {
+	resp, err := f.stream.Recv()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	updated := make([]string, 0)
+	for _, resource := range resp.Resources {
+		var message types.DynamicAny
+		if err = types.UnmarshalAny(resource.Resource, &message); err != nil {
+			f.t.Fatal(err)
+		}
+		name := cache.GetResourceName(message.Message.(cache.Resource))
+		if resource.Resource.GetTypeUrl() != typeURL {
+			f.t.Errorf("got resource %q of type %q, want %q", name, resource.Resource.GetTypeUrl(), typeURL)
+		}
+		updated = append(updated, name)
+	}
+	f.send(&v2.IncrementalDiscoveryRequest{TypeUrl: typeURL, ResponseNonce: resp.Nonce})
+	return updated, append([]string{}, resp.RemovedResources...)
+}
+
+func (f *fakeEnvoy) expect(typeURL string, updated, removed []string) {
+	gotUpdated, gotRemoved := f.recv(typeURL)
+	if !reflect.DeepEqual(gotUpdated, updated) || !reflect.DeepEqual(gotRemoved, removed) {
+		f.t.Errorf("got updated %v and removed %v, want %v and %v", gotUpdated, gotRemoved, updated, removed)
+	}
+}
+
+func deltaResources(clusters []cache.Resource, endpoints map[string][]model.Endpoint) map[string][]cache.Resource {
+	return map[string][]cache.Resource{
+		cache.ClusterType:  clusters,
+		cache.EndpointType: buildEndpoints(clusters, endpoints),
+	}
+}
+
+func edsCluster(name string, lb v2.Cluster_LbPolicy) *v2.Cluster {
+	return &v2.Cluster{
+		Name:             name,
+		Type:             v2.Cluster_EDS,
+		LbPolicy:         lb,
+		EdsClusterConfig: &v2.Cluster_EdsClusterConfig{ServiceName: name},
+	}
+}
+
+// startDeltaServer serves the cache over a local connection and opens an
+// incremental stream. The returned function stops the server.
+func startDeltaServer(t *testing.T, c *DeltaCache, id func(*core.Node) string) (*fakeEnvoy, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.StreamInterceptor(ValidateNodes))
+	discovery.RegisterAggregatedDiscoveryServiceServer(srv, NewDeltaServer(nil, c, id, nil))
+	go srv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		srv.Stop()
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	stop := func() {
+		cancel()
+		conn.Close()
+		srv.Stop()
+	}
+	stream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).IncrementalAggregatedResources(ctx)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return &fakeEnvoy{t: t, stream: stream}, stop
+}
+
+func TestIncrementalAggregatedResources(t *testing.T) {
+	c := NewDeltaCache()
+	endpoints := map[string][]model.Endpoint{
+		"a": {{IP: "10.1.1.0", Port: 80}},
+		"b": {{IP: "10.1.1.1", Port: 80}},
+	}
+	c.SetResources("ns1/pod1", "1", deltaResources([]cache.Resource{edsCluster("a", 0), edsCluster("b", 0)}, endpoints))
+
+	envoy, stop := startDeltaServer(t, c, func(node *core.Node) string { return node.Id })
+	defer stop()
+
+	// clusters are a wildcard subscription, and endpoints are subscribed by
+	// cluster
+	envoy.send(&v2.IncrementalDiscoveryRequest{Node: &core.Node{Id: "ns1/pod1"}, TypeUrl: cache.ClusterType})
+	envoy.expect(cache.ClusterType, []string{"a", "b"}, []string{})
+	envoy.send(&v2.IncrementalDiscoveryRequest{TypeUrl: cache.EndpointType, ResourceNamesSubscribe: []string{"a", "b"}})
+	envoy.expect(cache.EndpointType, []string{"a", "b"}, []string{})
+
+	// only the changed endpoints are sent
+	endpoints["b"] = []model.Endpoint{{IP: "10.1.1.2", Port: 80}}
+	c.SetResources("ns1/pod1", "2", deltaResources([]cache.Resource{edsCluster("a", 0), edsCluster("b", 0)}, endpoints))
+	envoy.expect(cache.EndpointType, []string{"b"}, []string{})
+
+	// a changed cluster is sent before the removal of its endpoints
+	c.SetResources("ns1/pod1", "3", deltaResources([]cache.Resource{edsCluster("a", v2.Cluster_RANDOM)}, endpoints))
+	envoy.expect(cache.ClusterType, []string{"a"}, []string{"b"})
+	envoy.expect(cache.EndpointType, []string{}, []string{"b"})
+
+	// unchanged resources produce no response
+	c.SetResources("ns1/pod1", "4", deltaResources([]cache.Resource{edsCluster("a", v2.Cluster_RANDOM)}, endpoints))
+	responses := make(chan error, 1)
+	go func() {
+		_, err := envoy.stream.Recv()
+		responses <- err
+	}()
+	select {
+	case err := <-responses:
+		t.Fatalf("unexpected response (error %v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestIncrementalUpdateRacesSubscribe(t *testing.T) {
+	c := NewDeltaCache()
+	endpoints := map[string][]model.Endpoint{
+		"a": {{IP: "10.1.1.0", Port: 80}},
+		"b": {{IP: "10.1.1.1", Port: 80}},
+	}
+	c.SetResources("ns1/pod1", "1", deltaResources([]cache.Resource{edsCluster("a", 0), edsCluster("b", 0)}, endpoints))
+
+	// the node ID is resolved right before the server watches the cache, so
+	// an update injected there lands between a request and its watch
+	updates := make(chan func(), 1)
+	envoy, stop := startDeltaServer(t, c, func(node *core.Node) string {
+		select {
+		case update := <-updates:
+			update()
+		default:
+		}
+		return node.Id
+	})
+	defer stop()
+
+	envoy.send(&v2.IncrementalDiscoveryRequest{Node: &core.Node{Id: "ns1/pod1"}, TypeUrl: cache.ClusterType})
+	envoy.expect(cache.ClusterType, []string{"a", "b"}, []string{})
+	envoy.send(&v2.IncrementalDiscoveryRequest{TypeUrl: cache.EndpointType, ResourceNamesSubscribe: []string{"a"}})
+	envoy.expect(cache.EndpointType, []string{"a"}, []string{})
+
+	// a cluster update races a subscription to more endpoints, and the node
+	// receives both
+	updates <- func() {
+		c.SetResources("ns1/pod1", "2", deltaResources([]cache.Resource{
+			edsCluster("a", v2.Cluster_RANDOM), edsCluster("b", 0)}, endpoints))
+	}
+	envoy.send(&v2.IncrementalDiscoveryRequest{TypeUrl: cache.EndpointType, ResourceNamesSubscribe: []string{"b"}})
+	envoy.expect(cache.ClusterType, []string{"a"}, []string{})
+	envoy.expect(cache.EndpointType, []string{"b"}, []string{})
+}
+
+func TestIncrementalRejectedResources(t *testing.T) {
+	c := NewDeltaCache()
+	endpoints := map[string][]model.Endpoint{"a": {{IP: "10.1.1.0", Port: 80}}}
+	c.SetResources("ns1/pod1", "1", deltaResources([]cache.Resource{edsCluster("a", 0), edsCluster("b", 0)}, endpoints))
+	envoy, stop := startDeltaServer(t, c, func(node *core.Node) string { return node.Id })
+	defer stop()
+
+	// the node rejects the clusters
+	envoy.send(&v2.IncrementalDiscoveryRequest{Node: &core.Node{Id: "ns1/pod1"}, TypeUrl: cache.ClusterType})
+	resp, err := envoy.stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	envoy.send(&v2.IncrementalDiscoveryRequest{
+		TypeUrl:       cache.ClusterType,
+		ResponseNonce: resp.Nonce,
+		ErrorDetail:   &rpc.Status{Message: "invalid cluster"},
+	})
+	// the rejected clusters are sent again with the next push to the node
+	envoy.send(&v2.IncrementalDiscoveryRequest{TypeUrl: cache.EndpointType, ResourceNamesSubscribe: []string{"a"}})
+	envoy.expect(cache.ClusterType, []string{"a", "b"}, []string{})
+	envoy.expect(cache.EndpointType, []string{"a"}, []string{})
+
+	// acknowledged clusters are not sent again
+	c.SetResources("ns1/pod1", "2", deltaResources([]cache.Resource{edsCluster("a", v2.Cluster_RANDOM), edsCluster("b", 0)}, endpoints))
+	envoy.expect(cache.ClusterType, []string{"a"}, []string{})
+}
+
+func TestClearNodeWithStream(t *testing.T) {
+	c := NewDeltaCache()
+	c.SetResources("ns1/pod1", "1", map[string][]cache.Resource{
+		cache.ClusterType: {edsCluster("a", 0)},
+	})
+	envoy, stop := startDeltaServer(t, c, func(node *core.Node) string { return node.Id })
+	envoy.send(&v2.IncrementalDiscoveryRequest{Node: &core.Node{Id: "ns1/pod1"}, TypeUrl: cache.ClusterType})
+	envoy.expect(cache.ClusterType, []string{"a"}, []string{})
+
+	// the resources of a node with an open stream are kept
+	c.ClearNode("ns1/pod1")
+	if _, resources, _ := c.watch("ns1/pod1"); len(resources[cache.ClusterType]) != 1 {
+		t.Errorf("got resources %v of the cleared node", resources)
+	}
+	c.SetResources("ns1/pod1", "2", map[string][]cache.Resource{
+		cache.ClusterType: {edsCluster("a", 0), edsCluster("b", 0)},
+	})
+	envoy.expect(cache.ClusterType, []string{"b"}, []string{})
+
+	// the resources are removed once the stream is closed
+	stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.ClearNode("ns1/pod1")
+		c.mu.Lock()
+		_, exists := c.nodes["ns1/pod1"]
+		c.mu.Unlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resources of the closed node were not cleared")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,112 @@
+package envoy
+
+import (
+	"sort"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/gogo/protobuf/types"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// buildEndpoints produces load assignments for all EDS clusters natively,
+// mirroring the endpoints section of envoy.jsonnet
+func buildEndpoints(clusters []cache.Resource, instances map[string][]model.Endpoint) []cache.Resource {
+	out := make([]cache.Resource, 0)
+	for _, resource := range clusters {
+		cluster, ok := resource.(*v2.Cluster)
+		if !ok || cluster.EdsClusterConfig == nil {
+			continue
+		}
+		name := cluster.EdsClusterConfig.ServiceName
+		out = append(out, buildLoadAssignment(name, instances[name]))
+	}
+	return out
+}
+
+// buildLoadAssignment produces a load assignment for a cluster name with
+// the endpoints grouped by locality in order of the locality names
+func buildLoadAssignment(name string, endpoints []model.Endpoint) *v2.ClusterLoadAssignment {
+	out := &v2.ClusterLoadAssignment{
+		ClusterName: name,
+		Endpoints:   make([]endpoint.LocalityLbEndpoints, 0),
+	}
+
+	localities := make([]string, 0)
+	lbEndpoints := make(map[string][]endpoint.LbEndpoint)
+	for _, ep := range endpoints {
+		if _, exists := lbEndpoints[ep.Locality]; !exists {
+			localities = append(localities, ep.Locality)
+		}
+		lbEndpoints[ep.Locality] = append(lbEndpoints[ep.Locality], endpoint.LbEndpoint{
+			Endpoint: &endpoint.Endpoint{
+				Address: &core.Address{
+					Address: &core.Address_SocketAddress{
+						SocketAddress: &core.SocketAddress{
+							Address:       ep.IP,
+							PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(ep.Port)},
+						},
+					},
+				},
+			},
+			Metadata: &core.Metadata{
+				FilterMetadata: map[string]*types.Struct{
+					"mixer": {
+						Fields: map[string]*types.Value{
+							"uid": {Kind: &types.Value_StringValue{StringValue: ep.UID}},
+						},
+					},
+				},
+			},
+		})
+	}
+	sort.Strings(localities)
+	for _, locality := range localities {
+		group := endpoint.LocalityLbEndpoints{LbEndpoints: lbEndpoints[locality]}
+		if locality != "" {
+			group.Locality = &core.Locality{Zone: locality}
+		}
+		out.Endpoints = append(out.Endpoints, group)
+	}
+	return out
+}
+
+// subsetInstances adds the instances of the subsets used by route rules,
+// keyed by the subset cluster names
+func subsetInstances(services []*model.Service, instances map[string][]model.Endpoint, rules []*model.RouteRule) map[string][]model.Endpoint {
+	if len(rules) == 0 {
+		return instances
+	}
+
+	out := make(map[string][]model.Endpoint, len(instances))
+	for key, endpoints := range instances {
+		out[key] = endpoints
+	}
+
+	hosts := make(map[string]*model.Service, len(services))
+	for _, service := range services {
+		hosts[service.Hostname] = service
+	}
+
+	for _, rule := range rules {
+		service, exists := hosts[rule.Host]
+		if !exists {
+			continue
+		}
+		for _, port := range service.Ports {
+			key := clusterKey(service.Hostname, port.Name)
+			for _, labels := range rule.Subsets() {
+				subset := make([]model.Endpoint, 0)
+				for _, ep := range instances[key] {
+					if labels.SubsetOf(ep.Labels) {
+						subset = append(subset, ep)
+					}
+				}
+				out[model.SubsetKey(key, labels)] = subset
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+package envoy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func TestBuildEndpoints(t *testing.T) {
+	clusters := []cache.Resource{
+		&v2.Cluster{Name: "in.80"},
+		&v2.Cluster{
+			Name: "hello.default.svc.cluster.local:http",
+			EdsClusterConfig: &v2.Cluster_EdsClusterConfig{
+				ServiceName: "hello.default.svc.cluster.local:http",
+				EdsConfig:   &core.ConfigSource{ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}}},
+			},
+		},
+		&v2.Cluster{
+			Name: "world.default.svc.cluster.local:http",
+			EdsClusterConfig: &v2.Cluster_EdsClusterConfig{
+				ServiceName: "world.default.svc.cluster.local:http",
+			},
+		},
+	}
+	instances := map[string][]model.Endpoint{
+		"hello.default.svc.cluster.local:http": {
+			{IP: "10.0.0.1", Port: 8080, UID: "pod2.ns3"},
+			{IP: "10.0.0.2", Port: 8080, UID: "pod3.ns3"},
+		},
+	}
+
+	out := buildEndpoints(clusters, instances)
+	if len(out) != 2 {
+		t.Fatalf("buildEndpoints => got %d assignments, want 2", len(out))
+	}
+
+	hello := out[0].(*v2.ClusterLoadAssignment)
+	if hello.ClusterName != "hello.default.svc.cluster.local:http" {
+		t.Errorf("got cluster name %q", hello.ClusterName)
+	}
+	if len(hello.Endpoints) != 1 || len(hello.Endpoints[0].LbEndpoints) != 2 {
+		t.Fatalf("got endpoints %v, want two endpoints in one locality", hello.Endpoints)
+	}
+	lb := hello.Endpoints[0].LbEndpoints[1]
+	if addr := lb.Endpoint.Address.GetSocketAddress(); addr.Address != "10.0.0.2" || addr.GetPortValue() != 8080 {
+		t.Errorf("got address %v, want 10.0.0.2:8080", addr)
+	}
+	if uid := lb.Metadata.FilterMetadata["mixer"].Fields["uid"].GetStringValue(); uid != "pod3.ns3" {
+		t.Errorf("got uid %q, want %q", uid, "pod3.ns3")
+	}
+
+	world := out[1].(*v2.ClusterLoadAssignment)
+	if len(world.Endpoints) != 0 {
+		t.Errorf("got endpoints %v for a cluster without instances", world.Endpoints)
+	}
+}
+
+func TestLoadAssignmentLocalities(t *testing.T) {
+	out := buildLoadAssignment("hello.default.svc.cluster.local:http", []model.Endpoint{
+		{IP: "10.0.0.1", Port: 8080, Locality: "west"},
+		{IP: "10.0.0.2", Port: 8080},
+		{IP: "10.0.0.3", Port: 8080, Locality: "east"},
+		{IP: "10.0.0.4", Port: 8080, Locality: "west"},
+	})
+
+	// endpoints are grouped by locality in order of the names
+	want := []struct {
+		locality string
+		ips      []string
+	}{
+		{"", []string{"10.0.0.2"}},
+		{"east", []string{"10.0.0.3"}},
+		{"west", []string{"10.0.0.1", "10.0.0.4"}},
+	}
+	if len(out.Endpoints) != len(want) {
+		t.Fatalf("got %d localities, want %d", len(out.Endpoints), len(want))
+	}
+	for i, w := range want {
+		group := out.Endpoints[i]
+		if got := group.Locality.GetZone(); got != w.locality {
+			t.Errorf("locality %d => %q, want %q", i, got, w.locality)
+		}
+		if w.locality == "" && group.Locality != nil {
+			t.Errorf("got locality %v for endpoints without a locality", group.Locality)
+		}
+		ips := make([]string, 0, len(group.LbEndpoints))
+		for _, lb := range group.LbEndpoints {
+			ips = append(ips, lb.Endpoint.Address.GetSocketAddress().Address)
+		}
+		if !reflect.DeepEqual(ips, w.ips) {
+			t.Errorf("locality %q => %v, want %v", w.locality, ips, w.ips)
+		}
+	}
+}
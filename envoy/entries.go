@@ -0,0 +1,114 @@
+package envoy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// LoadServiceEntries reads a YAML or JSON list of service entries. Entries
+// without a namespace are in the default namespace.
+func LoadServiceEntries(path string) ([]*model.ServiceEntry, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseServiceEntries(content)
+}
+
+func parseServiceEntries(content []byte) ([]*model.ServiceEntry, error) {
+	out := make([]*model.ServiceEntry, 0)
+	if err := yaml.Unmarshal(content, &out); err != nil {
+		return nil, err
+	}
+	for i, entry := range out {
+		if entry == nil {
+			return nil, fmt.Errorf("entry %d: empty entry", i)
+		}
+		if entry.Namespace == "" {
+			entry.Namespace = "default"
+		}
+		if err := entry.Validate(); err != nil {
+			return nil, fmt.Errorf("entry %s/%s: %v", entry.Namespace, entry.Name, err)
+		}
+	}
+	return out, nil
+}
+
+// watchServiceEntries polls the service entries file for changes until a
+// signal is received. Invalid files are rejected and the last good entries
+// are kept.
+func (g *Generator) watchServiceEntries(last string, stop <-chan struct{}) {
+	ticker := time.NewTicker(g.options.EntriesPollPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			content, err := ioutil.ReadFile(g.options.ServiceEntries)
+			if err != nil {
+				glog.Warningf("failed to read service entries %q: %v", g.options.ServiceEntries, err)
+				continue
+			}
+			if string(content) == last {
+				continue
+			}
+			last = string(content)
+
+			entries, err := parseServiceEntries(content)
+			if err != nil {
+				glog.Errorf("rejected service entries %q, serving the last good version: %v", g.options.ServiceEntries, err)
+				continue
+			}
+			glog.Infof("service entries %q changed, reloading", g.options.ServiceEntries)
+			g.controller.QueueSchedule(func() {
+				g.fileEntries = entries
+				g.UpdateConfig()
+			})
+		}
+	}
+}
+
+// mergeEntries adds the services and instances of the service entries to
+// those of the platform registry. Platform services take precedence over
+// entries with the same hostname.
+func mergeEntries(services []*model.Service, instances map[string][]model.Endpoint,
+	entries model.ServiceEntries) ([]*model.Service, map[string][]model.Endpoint) {
+	hosts := make(map[string]bool, len(services))
+	outServices := make([]*model.Service, 0, len(services))
+	for _, service := range services {
+		hosts[service.Hostname] = true
+		outServices = append(outServices, service)
+	}
+	outInstances := make(map[string][]model.Endpoint, len(instances))
+	for key, endpoints := range instances {
+		outInstances[key] = endpoints
+	}
+	if len(entries) == 0 {
+		return outServices, outInstances
+	}
+
+	entryInstances := entries.Instances()
+	for _, service := range entries.Services() {
+		if hosts[service.Hostname] {
+			glog.V(2).Infof("service entry host %s shadowed by the registry", service.Hostname)
+			continue
+		}
+		outServices = append(outServices, service)
+		for _, port := range service.Ports {
+			key := clusterKey(service.Hostname, port.Name)
+			if endpoints, exists := entryInstances[key]; exists {
+				outInstances[key] = endpoints
+			}
+		}
+	}
+	sort.Slice(outServices, func(i, j int) bool { return outServices[i].Hostname < outServices[j].Hostname })
+	return outServices, outInstances
+}
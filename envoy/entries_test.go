@@ -0,0 +1,130 @@
+package envoy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kyessenov/envoymesh/memory"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func TestParseServiceEntries(t *testing.T) {
+	entries, err := parseServiceEntries([]byte(`
+- name: billing
+  hosts:
+  - billing.vm.internal
+  ports:
+  - name: http
+    port: 8080
+    protocol: HTTP
+  endpoints:
+  - address: 10.2.0.1
+    labels:
+      version: v1
+  - address: 10.2.0.2
+    ports:
+      http: 9080
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Namespace != "default" {
+		t.Fatalf("got entries %#v, want one entry in the default namespace", entries)
+	}
+
+	invalid := []string{
+		`[{"name": "a", "ports": [{"name": "http", "port": 80}]}]`,
+		`[{"name": "a", "hosts": ["a.com"]}]`,
+		`[{"name": "a", "hosts": ["a.com"], "ports": [{"name": "http", "port": 80}], "endpoints": [{"address": "a.com"}]}]`,
+		`[{"name": "a", "hosts": ["a.com"], "ports": [{"name": "http", "port": 80}],
+		  "endpoints": [{"address": "10.2.0.1", "ports": {"grpc": 90}}]}]`,
+	}
+	for _, content := range invalid {
+		if _, err := parseServiceEntries([]byte(content)); err == nil {
+			t.Errorf("parseServiceEntries(%s) => no error", content)
+		}
+	}
+}
+
+func TestMergeEntries(t *testing.T) {
+	services := []*model.Service{{
+		Hostname: "hello.default.svc.cluster.local",
+		Ports:    model.PortList{{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}},
+	}}
+	instances := map[string][]model.Endpoint{
+		"hello.default.svc.cluster.local:http": {{IP: "10.1.1.0", Port: 80}},
+	}
+	entries := model.ServiceEntries{{
+		Name:      "external",
+		Namespace: "default",
+		Hosts:     []string{"api.example.com", "hello.default.svc.cluster.local"},
+		Ports:     model.PortList{{Name: "https", Port: 443}},
+		Endpoints: []*model.ServiceEntryEndpoint{
+			{Address: "203.0.113.2"},
+			{Address: "203.0.113.1", Ports: map[string]int{"https": 8443}, Labels: model.Labels{"region": "us"}},
+		},
+	}}
+
+	gotServices, gotInstances := mergeEntries(services, instances, entries)
+	wantServices := []*model.Service{{
+		Hostname:  "api.example.com",
+		Namespace: "default",
+		Ports:     model.PortList{{Name: "https", Port: 443, Protocol: model.ProtocolTCP}},
+	}, services[0]}
+	if !reflect.DeepEqual(gotServices, wantServices) {
+		t.Errorf("got services %#v, want %#v", gotServices, wantServices)
+	}
+
+	// registry services shadow the entries
+	wantInstances := map[string][]model.Endpoint{
+		"hello.default.svc.cluster.local:http": {{IP: "10.1.1.0", Port: 80}},
+		"api.example.com:https": {
+			{IP: "203.0.113.1", Port: 8443, Labels: model.Labels{"region": "us"}},
+			{IP: "203.0.113.2", Port: 443},
+		},
+	}
+	if !reflect.DeepEqual(gotInstances, wantInstances) {
+		t.Errorf("got instances %#v, want %#v", gotInstances, wantInstances)
+	}
+	if len(entries[0].Ports) != 1 || entries[0].Ports[0].Protocol != "" {
+		t.Error("merging modified the ports of the entry")
+	}
+}
+
+func TestUpdateServicesShadowEntries(t *testing.T) {
+	registry := memory.NewRegistry()
+	config := memory.NewConfigStore(memory.Config{ServiceEntries: []*model.ServiceEntry{{
+		Name:      "hello",
+		Namespace: "default",
+		Hosts:     []string{"hello.default.svc.cluster.local"},
+		Ports:     model.PortList{{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}},
+		Endpoints: []*model.ServiceEntryEndpoint{{Address: "203.0.113.1"}},
+	}}})
+	g, err := NewGenerator(registry, config, GeneratorOptions{Native: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.UpdateConfig()
+	key := "hello.default.svc.cluster.local:http"
+	if endpoints := g.instances[key]; len(endpoints) != 1 || endpoints[0].IP != "203.0.113.1" {
+		t.Fatalf("got entry endpoints %v", endpoints)
+	}
+
+	// a registry service without instances shadows the entry
+	registry.SetServices([]*model.Service{{
+		Hostname:  "hello.default.svc.cluster.local",
+		Namespace: "default",
+		Ports:     model.PortList{{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}},
+	}})
+	g.UpdateServices()
+	if endpoints, exists := g.instances[key]; exists {
+		t.Errorf("got endpoints %v of the shadowed entry", endpoints)
+	}
+
+	// the entry endpoints return with the entry
+	registry.SetServices([]*model.Service{})
+	g.UpdateServices()
+	if endpoints := g.instances[key]; len(endpoints) != 1 || endpoints[0].IP != "203.0.113.1" {
+		t.Errorf("got endpoints %v of the unshadowed entry", endpoints)
+	}
+}
@@ -1,46 +1,277 @@
 package envoy
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"sort"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/envoyproxy/go-control-plane/pkg/cache"
 	"github.com/golang/glog"
+	"github.com/kyessenov/envoymesh/aggregate"
 	"github.com/kyessenov/envoymesh/kube"
 	"github.com/kyessenov/envoymesh/model"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 // Generator produces envoy configs
 type Generator struct {
 	count      int
 	controller model.Controller
+	config     model.ConfigStore
 	cache      cache.SnapshotCache
+	delta      *DeltaCache
 	services   []*model.Service
 	instances  map[string][]model.Endpoint
+	rules      []*model.RouteRule
+	policies   []*model.AuthorizationPolicy
+	authzs     []*model.ExternalAuthorization
+	sidecars   []*model.Sidecar
 
-	nodes map[string]*Compiler
+	// service entries of the config store and the entries file
+	entries     model.ServiceEntries
+	fileEntries []*model.ServiceEntry
+
+	// instances by cluster name, including subsets of the route rules
+	assignments map[string][]model.Endpoint
+
+	options         GeneratorOptions
+	configGenerator ConfigGenerator
+	nodes           map[string]*Compiler
+	security        Security
+	telemetry       Telemetry
+
+	// node keys by stream, open streams by node, and disconnection times of
+	// the nodes without streams
+	streams map[int64]string
+	refs    map[string]int
+	retired map[string]time.Time
+
+	// source of the applied script, last script reload error, per-node
+	// generation state, and identities of the nodes from their last requests
+	mu         sync.RWMutex
+	script     string
+	scriptErr  error
+	status     map[string]NodeStatus
+	identities map[string]NodeIdentity
+}
+
+// NodeStatus is the config generation state of a node
+type NodeStatus struct {
+	// Version of the last good snapshot pushed to the node
+	Version string `json:"version,omitempty"`
+	// Error of the last generation, empty if the snapshot is up to date
+	Error string `json:"error,omitempty"`
+	// Failures counts consecutive failed generations
+	Failures int `json:"failures,omitempty"`
+}
+
+// GeneratorOptions stores the configurable attributes of a Generator.
+type GeneratorOptions struct {
+	// Script is the path to the jsonnet config generation script
+	Script string
+	// ScriptPollPeriod is the interval between checks of the script for
+	// changes. Zero disables reloading.
+	ScriptPollPeriod time.Duration
+	// EntriesPollPeriod is the interval between checks of the service
+	// entries file for changes. Zero disables reloading.
+	EntriesPollPeriod time.Duration
+	// Native selects the built-in Go config generator instead of the script
+	Native bool
+	// MutualTLS is the mesh authentication policy for ports that inherit it
+	MutualTLS bool
+	// Certificates supplies the mesh root certificate. Mutual TLS is
+	// disabled if not set.
+	Certificates CertificateProvider
+	// AccessLog streams the access logs of the proxies to the controller
+	// instead of stdout
+	AccessLog bool
+	// NodeGracePeriod is the time to keep the config of a disconnected node
+	// before removing it, 5 minutes if zero
+	NodeGracePeriod time.Duration
+	// Incremental tracks per-resource versions for the incremental xDS
+	// protocol
+	Incremental bool
+	// ServiceEntries is the path to a YAML or JSON list of service entries
+	// merged with the entries of the config store, optional
+	ServiceEntries string
+	// ReviewToken authenticates the service account token of a proxy in a
+	// cluster, empty for nodes without a cluster, and returns the namespace
+	// and the name of the service account. The Kubernetes generators review
+	// the tokens with the API server of the cluster if not set. Certificates
+	// are not served to any proxy without it.
+	ReviewToken func(cluster, token string) (namespace, serviceAccount string, err error)
+	// RequireCluster rejects nodes without a cluster in their IDs, since the
+	// same pod may exist in several clusters of a multi-cluster mesh
+	RequireCluster bool
 }
 
 const (
 	suffix = "cluster.local"
+
+	// defaultNodeGracePeriod keeps the config of reconnecting nodes
+	defaultNodeGracePeriod = 5 * time.Minute
 )
 
-func NewKubeGenerator(kubeconfig string) (*Generator, error) {
-	g := &Generator{
-		nodes: make(map[string]*Compiler),
+// NewKubeGenerator creates a generator for a Kubernetes cluster
+func NewKubeGenerator(kubeconfig string, options GeneratorOptions) (*Generator, error) {
+	restConfig, client, err := kube.CreateInterface(kubeconfig)
+	if err != nil {
+		return nil, err
 	}
+	crd, err := kube.CreateCRDInterface(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	controller := kube.NewController(client, crd, kube.ControllerOptions{ResyncPeriod: 60 * time.Second, DomainSuffix: suffix})
+	return NewGenerator(controller, controller, withTokenReview(options, func(string) (kubernetes.Interface, error) {
+		return client, nil
+	}))
+}
 
-	_, client, err := kube.CreateInterface(kubeconfig)
+// NewMultiClusterGenerator creates a generator for a Kubernetes cluster and
+// remote clusters by name with their kubeconfigs. The config is read from
+// the local cluster only. The endpoints of identically named services are
+// merged across the clusters, with the cluster names as their localities.
+func NewMultiClusterGenerator(kubeconfig, clusterName string, remotes map[string]string, options GeneratorOptions) (*Generator, error) {
+	restConfig, client, err := kube.CreateInterface(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	crd, err := kube.CreateCRDInterface(restConfig)
 	if err != nil {
 		return nil, err
 	}
+	clients := map[string]kubernetes.Interface{clusterName: client}
+	for name, kubeconfig := range remotes {
+		if name == clusterName {
+			return nil, fmt.Errorf("remote cluster %q has the name of the local cluster", name)
+		}
+		_, remote, err := kube.CreateInterface(kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("remote cluster %q: %v", name, err)
+		}
+		clients[name] = remote
+	}
+	return newMultiClusterGenerator(clusterName, clients, crd, options)
+}
+
+// newMultiClusterGenerator creates a generator for the clients of the
+// clusters by name. The config is read with the CRD client of the local
+// cluster. The nodes must name their clusters, and their tokens are
+// reviewed with the API servers of their clusters.
+func newMultiClusterGenerator(clusterName string, clients map[string]kubernetes.Interface, crd rest.Interface,
+	options GeneratorOptions) (*Generator, error) {
+	local := kube.NewController(clients[clusterName], crd, kube.ControllerOptions{
+		ResyncPeriod: 60 * time.Second,
+		DomainSuffix: suffix,
+		ClusterName:  clusterName,
+	})
+
+	// the local cluster takes precedence, then the remote clusters by name
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		if name != clusterName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	registries := []model.Controller{local}
+	for _, name := range names {
+		glog.Infof("watching remote cluster %q", name)
+		registries = append(registries, kube.NewController(clients[name], nil, kube.ControllerOptions{
+			ResyncPeriod: 60 * time.Second,
+			DomainSuffix: suffix,
+			ClusterName:  name,
+		}))
+	}
+	options.RequireCluster = true
+	options = withTokenReview(options, func(cluster string) (kubernetes.Interface, error) {
+		client, exists := clients[cluster]
+		if !exists {
+			return nil, fmt.Errorf("unknown cluster %q", cluster)
+		}
+		return client, nil
+	})
+	return NewGenerator(aggregate.NewMergedController(registries...), local, options)
+}
+
+// withTokenReview reviews the service account tokens with the API server of
+// the cluster of the node unless the options have a reviewer
+func withTokenReview(options GeneratorOptions, clients func(cluster string) (kubernetes.Interface, error)) GeneratorOptions {
+	if options.ReviewToken == nil {
+		options.ReviewToken = func(cluster, token string) (string, string, error) {
+			client, err := clients(cluster)
+			if err != nil {
+				return "", "", err
+			}
+			return kube.ReviewToken(client, token)
+		}
+	}
+	return options
+}
+
+// NewGenerator creates a generator for a service registry and a config
+// store. The generator runs the registry, and the config store must be run
+// by the caller unless it is part of the registry. All handlers run on the
+// queue of the registry.
+func NewGenerator(controller model.Controller, config model.ConfigStore, options GeneratorOptions) (*Generator, error) {
+	if options.NodeGracePeriod <= 0 {
+		options.NodeGracePeriod = defaultNodeGracePeriod
+	}
+	g := &Generator{
+		options:    options,
+		nodes:      make(map[string]*Compiler),
+		streams:    make(map[int64]string),
+		refs:       make(map[string]int),
+		retired:    make(map[string]time.Time),
+		status:     make(map[string]NodeStatus),
+		identities: make(map[string]NodeIdentity),
+		security:   Security{TrustDomain: suffix},
+		controller: controller,
+		config:     config,
+	}
+
+	if options.Native {
+		g.configGenerator = &NativeGenerator{}
+	} else {
+		program, err := LoadProgram(options.Script)
+		if err != nil {
+			return nil, err
+		}
+		g.configGenerator = program
+		g.script = program.source
+	}
 
-	options := kube.ControllerOptions{ResyncPeriod: 60 * time.Second, DomainSuffix: suffix}
-	g.controller = kube.NewController(client, options)
+	if options.Certificates != nil {
+		root, err := options.Certificates.RootCert()
+		if err != nil {
+			return nil, err
+		}
+		g.security.MutualTLS = options.MutualTLS
+		g.security.RootCert = string(root)
+		g.security.SDSCluster = controllerCluster
+	}
+	if options.AccessLog {
+		g.telemetry.AccessLogCluster = controllerCluster
+	}
+	if options.ServiceEntries != "" {
+		entries, err := LoadServiceEntries(options.ServiceEntries)
+		if err != nil {
+			return nil, err
+		}
+		g.fileEntries = entries
+		g.entries = entries
+	}
 
 	// callback: service modification
 	g.controller.RegisterServiceHandler(g.UpdateServices)
@@ -48,21 +279,134 @@ func NewKubeGenerator(kubeconfig string) (*Generator, error) {
 	// callback: endpoint modification
 	g.controller.RegisterEndpointHandler(g.UpdateInstances)
 
+	// callback: routing configuration modification, moved to the queue of
+	// the registry if the config store has its own queue
+	g.config.RegisterConfigHandler(func() { g.controller.QueueSchedule(g.UpdateConfig) })
+
 	// callback: registering a new node group (on a different loop)
 	g.cache = cache.NewSnapshotCache(true, g, g)
+	if options.Incremental {
+		g.delta = NewDeltaCache()
+	}
 
 	return g, nil
 }
 
 // Run ...
 func (g *Generator) Run(stop <-chan struct{}) {
+	if _, ok := g.configGenerator.(*Program); ok && g.options.ScriptPollPeriod > 0 {
+		go g.watchScript(stop)
+	}
+	if g.options.ServiceEntries != "" && g.options.EntriesPollPeriod > 0 {
+		content, _ := ioutil.ReadFile(g.options.ServiceEntries)
+		go g.watchServiceEntries(string(content), stop)
+	}
+	go g.watchNodes(stop)
 	g.controller.Run(stop)
 	<-stop
 }
 
-// ID ...
+// Identity returns the SPIFFE identity of a node. The identity is taken
+// only from the registry, since the node metadata is set by the proxy and
+// must not be trusted for certificates. Nodes missing from the registry get
+// ErrUnknownWorkload until the registry knows the pod.
+func (g *Generator) Identity(node string) (string, error) {
+	identity, err := ParseNodeID(node)
+	if err != nil {
+		return "", err
+	}
+	instance, err := g.workload(identity)
+	if err != nil {
+		return "", err
+	}
+	if instance.ServiceAccount == "" {
+		return "", fmt.Errorf("unknown service account of node %q", node)
+	}
+	return instance.ServiceAccount, nil
+}
+
+// WorkloadUID returns the UID of the workload of a node in the registry, or
+// the workload key of nodes missing from the registry
+func (g *Generator) WorkloadUID(node string) string {
+	identity, err := ParseNodeID(node)
+	if err != nil {
+		return node
+	}
+	instance, err := g.workload(identity)
+	if err != nil || instance.UID == "" {
+		return identity.Key()
+	}
+	return instance.UID
+}
+
+// workload looks up the workload of a node in the registry of its cluster,
+// or in the first registry that knows it for nodes without a cluster
+func (g *Generator) workload(identity NodeIdentity) (model.Instance, error) {
+	if err := g.checkCluster(identity); err != nil {
+		return model.Instance{}, err
+	}
+	if clusters, ok := g.controller.(model.ClusterDiscovery); ok && identity.Cluster != "" {
+		return clusters.ClusterWorkload(identity.Cluster, identity.Workload())
+	}
+	return g.controller.Workload(identity.Workload())
+}
+
+// checkCluster rejects nodes without a cluster if the generator requires
+// one
+func (g *Generator) checkCluster(identity NodeIdentity) error {
+	if g.options.RequireCluster && identity.Cluster == "" {
+		return fmt.Errorf("node %s has no cluster in its ID", identity.Key())
+	}
+	return nil
+}
+
+// Authenticate verifies that the proxy holds the service account token of
+// the workload of its node ID. The token is sent in the node metadata and
+// reviewed with the API server, and its service account must be the
+// identity of the workload in the registry.
+func (g *Generator) Authenticate(node *core.Node) error {
+	token := node.GetMetadata().GetFields()[metadataToken].GetStringValue()
+	if token == "" {
+		return errors.New("missing service account token in the node metadata")
+	}
+	if g.options.ReviewToken == nil {
+		return errors.New("service account tokens cannot be reviewed without a Kubernetes registry")
+	}
+	identity, err := ParseNodeID(node.GetId())
+	if err != nil {
+		return err
+	}
+	if err = g.checkCluster(identity); err != nil {
+		return err
+	}
+	namespace, account, err := g.options.ReviewToken(identity.Cluster, token)
+	if err != nil {
+		return err
+	}
+	expected, err := g.Identity(node.GetId())
+	if err != nil {
+		return err
+	}
+	if caller := fmt.Sprintf("spiffe://%s/ns/%s/sa/%s", suffix, namespace, account); caller != expected {
+		return fmt.Errorf("node %q runs as %s, but the token is of %s", node.GetId(), expected, caller)
+	}
+	return nil
+}
+
+// ID is the workload key of the node, or the raw ID of a malformed node
 func (g *Generator) ID(node *core.Node) string {
-	return node.GetId()
+	return NodeKey(node.GetId())
+}
+
+// NodeKey is the workload key of a node ID, or the raw ID if malformed. The
+// workload key identifies the node in the caches, the node status, and the
+// certificates of the CA.
+func NodeKey(node string) string {
+	identity, err := ParseNodeID(node)
+	if err != nil {
+		return node
+	}
+	return identity.Key()
 }
 
 // Infof ...
@@ -74,91 +418,217 @@ func (g *Generator) Errorf(format string, args ...interface{}) { glog.Errorf(for
 // Cache ...
 func (g *Generator) Cache() cache.Cache { return g.cache }
 
+// DeltaCache returns the resources with per-resource versions, or nil if the
+// incremental protocol is disabled
+func (g *Generator) DeltaCache() *DeltaCache { return g.delta }
+
 // OnStreamRequest ...
 func (g *Generator) OnStreamRequest(id int64, req *v2.DiscoveryRequest) {
+	adsRequests.WithLabelValues(req.TypeUrl).Inc()
+	adsStreamCounts.request(id, req.GetNode().GetId(), req.TypeUrl)
 	// move the task to single threaded queue
 	g.controller.QueueSchedule(func() {
-		key := g.ID(req.GetNode())
+		identity, err := ParseNode(req.GetNode())
+		if err != nil {
+			// streams of malformed nodes are rejected by ValidateNodes
+			glog.Warningf("ignoring request of node %q: %v", req.GetNode().GetId(), err)
+			return
+		}
+		if err = g.checkCluster(identity); err != nil {
+			glog.Warningf("ignoring request of node %q: %v", req.GetNode().GetId(), err)
+			return
+		}
+		key := identity.Key()
+		g.mu.Lock()
+		g.identities[key] = identity
+		g.mu.Unlock()
 		if _, exists := g.nodes[key]; !exists {
-			parts := strings.Split(string(key), "/")
-			name, namespace := "", "default"
-			switch len(parts) {
-			case 1:
-				// name only, no namespace
-				name = parts[0]
-			case 2:
-				// namespace and name
-				name, namespace = parts[1], parts[0]
-			}
-			compiler, err := NewCompiler(name, namespace, suffix)
-			if err != nil {
-				glog.Fatal(err)
-			}
-			g.nodes[key] = compiler
+			g.nodes[key] = NewCompiler(g.configGenerator, identity.Name, identity.Namespace, suffix)
 			g.UpdateNode(key)
 		}
+		g.trackStream(id, key)
 	})
 }
 
 // OnStreamOpen ...
-func (g *Generator) OnStreamOpen(int64, string) {}
+func (g *Generator) OnStreamOpen(context.Context, int64, string) error {
+	adsStreams.Inc()
+	return nil
+}
 
 // OnStreamClosed ...
-func (g *Generator) OnStreamClosed(int64) {}
+func (g *Generator) OnStreamClosed(id int64) {
+	adsStreams.Dec()
+	adsStreamCounts.close(id)
+	g.controller.QueueSchedule(func() {
+		g.releaseStream(id, time.Now())
+	})
+}
 
 // OnStreamResponse ...
-func (g *Generator) OnStreamResponse(int64, *v2.DiscoveryRequest, *v2.DiscoveryResponse) {}
+func (g *Generator) OnStreamResponse(id int64, _ *v2.DiscoveryRequest, resp *v2.DiscoveryResponse) {
+	adsResponses.WithLabelValues(resp.TypeUrl).Inc()
+	adsStreamCounts.response(id, resp.TypeUrl)
+}
 
 // OnFetchRequest ...
-func (g *Generator) OnFetchRequest(req *v2.DiscoveryRequest) {}
+func (g *Generator) OnFetchRequest(_ context.Context, req *v2.DiscoveryRequest) error {
+	adsRequests.WithLabelValues(req.TypeUrl).Inc()
+	return nil
+}
 
 // OnFetchResponse ...
-func (g *Generator) OnFetchResponse(req *v2.DiscoveryRequest, resp *v2.DiscoveryResponse) {}
+func (g *Generator) OnFetchResponse(_ *v2.DiscoveryRequest, resp *v2.DiscoveryResponse) {
+	adsResponses.WithLabelValues(resp.TypeUrl).Inc()
+}
 
 // UpdateNode ...
 func (g *Generator) UpdateNode(key string) {
 	compiler := g.nodes[key]
-	instance, err := g.controller.Workload(string(key))
-	if err != nil {
+	g.mu.RLock()
+	identity := g.identities[key]
+	g.mu.RUnlock()
+	instance, err := g.workload(identity)
+	if err == model.ErrUnknownWorkload {
+		// fall back to the node metadata until the registry has the pod
+		glog.V(2).Infof("unknown workload of node %v, using node metadata", key)
+		instance = metadataInstance(key, identity, suffix, g.services, g.instances)
+	} else if err != nil {
 		glog.Warning(err)
 	}
+	instance.Endpoints = ipv4Endpoints(key, instance.Endpoints)
 	sort.Slice(instance.Endpoints, func(i, j int) bool {
 		return instance.Endpoints[i].IP < instance.Endpoints[j].IP ||
 			(instance.Endpoints[i].IP == instance.Endpoints[j].IP && instance.Endpoints[i].Port < instance.Endpoints[j].Port)
 	})
 
-	updated, err := compiler.Update(g.services, instance, g.instances)
+	// compile only the dependencies of the workload
+	sidecars := selectSidecars(g.sidecars, compiler.namespace, instance.Labels)
+	in := scopeInput(g.input(instance), sidecars, compiler.namespace)
+	updated, err := compiler.Update(in)
 	if err != nil {
-		glog.Warning(err)
+		glog.Warningf("failed to generate config for node %v, keeping the last good snapshot: %v", key, err)
+		g.mu.Lock()
+		status := g.status[key]
+		status.Error = err.Error()
+		status.Failures++
+		g.status[key] = status
+		g.mu.Unlock()
+		return
 	}
 
 	if updated {
-		g.count++
-		glog.Infof("update node %v (updated=%t, count=%d)", key, updated, g.count)
-		g.cache.SetSnapshot(key, compiler.Snapshot(g.count))
+		glog.Infof("update node %v (updated=%t, count=%d)", key, updated, g.count+1)
+		g.push(key, compiler)
+	}
+}
+
+// ipv4Endpoints drops the endpoints of a node without an IPv4 address,
+// since the generators only report IPv4 destination addresses to mixer
+func ipv4Endpoints(key string, endpoints []model.Endpoint) []model.Endpoint {
+	out := make([]model.Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		if net.ParseIP(ep.IP).To4() == nil {
+			glog.Warningf("dropping endpoint %s:%d of node %v, want an IPv4 address", ep.IP, ep.Port, key)
+			continue
+		}
+		out = append(out, ep)
+	}
+	return out
+}
+
+// push sets the node snapshot and records it as the last good version
+func (g *Generator) push(key string, compiler *Compiler) {
+	g.count++
+	g.cache.SetSnapshot(key, compiler.Snapshot(g.count))
+	if g.delta != nil {
+		g.delta.SetResources(key, fmt.Sprintf("%d", g.count), compiler.Resources())
+	}
+	snapshotPushes.Inc()
+	snapshotVersion.Set(float64(g.count))
+	g.mu.Lock()
+	g.status[key] = NodeStatus{Version: fmt.Sprintf("%d", g.count)}
+	g.mu.Unlock()
+}
+
+// NodeStatus returns the config generation state of all nodes
+func (g *Generator) NodeStatus() map[string]NodeStatus {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	out := make(map[string]NodeStatus, len(g.status))
+	for key, status := range g.status {
+		out[key] = status
+	}
+	return out
+}
+
+// input combines the mesh state with the workload of a node
+func (g *Generator) input(instance model.Instance) Input {
+	return Input{
+		Services:   g.services,
+		Instance:   instance,
+		Instances:  g.assignments,
+		RouteRules: g.rules,
+		Security:   g.security,
+		Telemetry:  g.telemetry,
+
+		AuthorizationPolicies:  g.policies,
+		ExternalAuthorizations: g.authzs,
 	}
 }
 
 // UpdateServices ...
 func (g *Generator) UpdateServices() {
-	// reload services
-	services := g.controller.Services()
-	if reflect.DeepEqual(services, g.services) {
+	// reload services, and the instances of the entries that registry
+	// services shadow or stop shadowing
+	services, instances := mergeEntries(g.controller.Services(), g.controller.Instances(), g.entries)
+	if reflect.DeepEqual(services, g.services) && reflect.DeepEqual(instances, g.instances) {
 		return
 	}
 	glog.Infof("update services (services=%d)", len(services))
 	g.services = services
+	g.instances = instances
+	g.assignments = subsetInstances(g.services, g.instances, g.rules)
 	g.Update()
 }
 
 // UpdateInstances ...
 func (g *Generator) UpdateInstances() {
-	instances := g.controller.Instances()
-	if reflect.DeepEqual(instances, g.instances) {
+	// service accounts of the services include the accounts of the pods
+	services, instances := mergeEntries(g.controller.Services(), g.controller.Instances(), g.entries)
+	if reflect.DeepEqual(instances, g.instances) && reflect.DeepEqual(services, g.services) {
 		return
 	}
 	glog.Infof("update instances (instances=%d)", len(instances))
+	g.services = services
 	g.instances = instances
+	g.assignments = subsetInstances(g.services, g.instances, g.rules)
+	g.Update()
+}
+
+// UpdateConfig ...
+func (g *Generator) UpdateConfig() {
+	rules := g.config.RouteRules()
+	policies := g.config.AuthorizationPolicies()
+	authzs := g.config.ExternalAuthorizations()
+	sidecars := g.config.Sidecars()
+	entries := append(model.ServiceEntries(g.config.ServiceEntries()), g.fileEntries...)
+	if reflect.DeepEqual(rules, g.rules) && reflect.DeepEqual(policies, g.policies) &&
+		reflect.DeepEqual(authzs, g.authzs) && reflect.DeepEqual(sidecars, g.sidecars) &&
+		reflect.DeepEqual(entries, g.entries) {
+		return
+	}
+	glog.Infof("update config (rules=%d, policies=%d, authz=%d, sidecars=%d, entries=%d)",
+		len(rules), len(policies), len(authzs), len(sidecars), len(entries))
+	g.rules = rules
+	g.policies = policies
+	g.authzs = authzs
+	g.sidecars = sidecars
+	if !reflect.DeepEqual(entries, g.entries) {
+		g.entries = entries
+		g.services, g.instances = mergeEntries(g.controller.Services(), g.controller.Instances(), g.entries)
+	}
+	g.assignments = subsetInstances(g.services, g.instances, g.rules)
 	g.Update()
 }
 
@@ -0,0 +1,217 @@
+package envoy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/types"
+	"github.com/kyessenov/envoymesh/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Node metadata keys set by the agent
+const (
+	metadataPodIP          = "pod_ip"
+	metadataLabels         = "labels"
+	metadataServiceAccount = "service_account"
+	// metadataToken is the service account token of the pod, which
+	// authenticates the proxy for certificates
+	metadataToken = "token"
+)
+
+// NodeIdentity identifies the workload of a proxy
+type NodeIdentity struct {
+	Namespace string
+	Name      string
+
+	// IP of the pod, optional
+	IP string
+
+	// Cluster of the workload in a multi-cluster mesh, optional
+	Cluster string
+
+	// Labels of the workload from the node metadata
+	Labels model.Labels
+
+	// Metadata are the string values of the node metadata
+	Metadata map[string]string
+}
+
+// Key is the workload key of the node, "namespace/name", prefixed by the
+// cluster of workloads in a multi-cluster mesh, "cluster/namespace/name",
+// since the same pod name may be taken in several clusters
+func (id NodeIdentity) Key() string {
+	if id.Cluster != "" {
+		return id.Cluster + "/" + id.Workload()
+	}
+	return id.Workload()
+}
+
+// Workload is the ID of the workload in the registry of its cluster,
+// "namespace/name"
+func (id NodeIdentity) Workload() string {
+	return id.Namespace + "/" + id.Name
+}
+
+// ParseNodeID parses node IDs of the form "namespace/name[/ip[/cluster]]".
+// IDs with only a name are in the default namespace.
+func ParseNodeID(id string) (NodeIdentity, error) {
+	if id == "" {
+		return NodeIdentity{}, errors.New("empty node ID")
+	}
+	parts := strings.Split(id, "/")
+	out := NodeIdentity{Namespace: "default"}
+	switch len(parts) {
+	case 1:
+		out.Name = parts[0]
+	case 2, 3, 4:
+		out.Namespace, out.Name = parts[0], parts[1]
+	default:
+		return NodeIdentity{}, fmt.Errorf("node ID %q has too many parts", id)
+	}
+	if len(parts) > 2 {
+		out.IP = parts[2]
+		if net.ParseIP(out.IP) == nil {
+			return NodeIdentity{}, fmt.Errorf("invalid IP %q in node ID %q", out.IP, id)
+		}
+	}
+	if len(parts) > 3 {
+		out.Cluster = parts[3]
+	}
+	for _, part := range parts {
+		if part == "" {
+			return NodeIdentity{}, fmt.Errorf("node ID %q has empty parts", id)
+		}
+	}
+	return out, nil
+}
+
+// ParseNode parses the ID and the metadata of a node. The pod IP in the ID
+// takes precedence over the metadata.
+func ParseNode(node *core.Node) (NodeIdentity, error) {
+	if node == nil {
+		return NodeIdentity{}, errors.New("missing node")
+	}
+	out, err := ParseNodeID(node.Id)
+	if err != nil {
+		return NodeIdentity{}, err
+	}
+	out.Metadata = make(map[string]string)
+	for key, value := range node.Metadata.GetFields() {
+		// credentials are not kept with the identities
+		if key == metadataToken {
+			continue
+		}
+		if s, ok := value.GetKind().(*types.Value_StringValue); ok {
+			out.Metadata[key] = s.StringValue
+		}
+	}
+	if labels := node.Metadata.GetFields()[metadataLabels].GetStructValue(); labels != nil {
+		out.Labels = make(model.Labels)
+		for key, value := range labels.Fields {
+			out.Labels[key] = value.GetStringValue()
+		}
+	}
+	if ip := out.Metadata[metadataPodIP]; out.IP == "" && ip != "" {
+		if net.ParseIP(ip) == nil {
+			return NodeIdentity{}, fmt.Errorf("invalid pod IP %q in node metadata", ip)
+		}
+		out.IP = ip
+	}
+	return out, nil
+}
+
+// ServiceAccount is the SPIFFE identity of the workload from the node
+// metadata, empty if not set. It is only used for the config of pods missing
+// from the registry and never for certificates.
+func (id NodeIdentity) ServiceAccount(trustDomain string) string {
+	account := id.Metadata[metadataServiceAccount]
+	if account == "" {
+		return ""
+	}
+	return fmt.Sprintf("spiffe://%s/ns/%s/sa/%s", trustDomain, id.Namespace, account)
+}
+
+// metadataInstance builds the workload of a node from its metadata for pods
+// missing from the registry, e.g. while the informers catch up with a pod
+// that has just started. The endpoints are the service instances at the pod
+// IP.
+func metadataInstance(key string, id NodeIdentity, trustDomain string,
+	services []*model.Service, instances map[string][]model.Endpoint) model.Instance {
+	out := model.Instance{
+		Endpoints:      make([]model.Endpoint, 0),
+		Labels:         id.Labels,
+		UID:            key,
+		ServiceAccount: id.ServiceAccount(trustDomain),
+	}
+	if id.IP == "" {
+		return out
+	}
+	for _, service := range services {
+		for _, port := range service.Ports {
+			for _, ep := range instances[clusterKey(service.Hostname, port.Name)] {
+				if ep.IP != id.IP {
+					continue
+				}
+				out.Endpoints = append(out.Endpoints, model.Endpoint{
+					IP:                   ep.IP,
+					Port:                 ep.Port,
+					Protocol:             port.Protocol,
+					AuthenticationPolicy: port.AuthenticationPolicy,
+					Service:              service.Hostname,
+				})
+			}
+		}
+	}
+	return out
+}
+
+// ValidateNodes is a stream interceptor that rejects discovery streams of
+// malformed nodes with an invalid argument error. Only the first request of
+// a stream must carry the node, and later requests without a node are
+// filled in with it, since the snapshot cache watches the node of every
+// request. Both the state of the world and the incremental requests are
+// validated.
+func ValidateNodes(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	return handler(srv, &nodeStream{ServerStream: stream})
+}
+
+type nodeStream struct {
+	grpc.ServerStream
+
+	// node of the first request
+	node *core.Node
+}
+
+func (s *nodeStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	var node **core.Node
+	switch req := m.(type) {
+	case *v2.DiscoveryRequest:
+		node = &req.Node
+	case *v2.IncrementalDiscoveryRequest:
+		node = &req.Node
+	default:
+		return nil
+	}
+	if s.node != nil && *node == nil {
+		*node = s.node
+		return nil
+	}
+	if _, err := ParseNode(*node); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid node: %v", err)
+	}
+	if s.node == nil {
+		s.node = *node
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+package envoy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/types"
+	"github.com/kyessenov/envoymesh/aggregate"
+	"github.com/kyessenov/envoymesh/ca"
+	"github.com/kyessenov/envoymesh/memory"
+	"github.com/kyessenov/envoymesh/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	authentication_v1 "k8s.io/api/authentication/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+)
+
+func TestParseNodeID(t *testing.T) {
+	cases := []struct {
+		id   string
+		want NodeIdentity
+	}{
+		{"pod1", NodeIdentity{Namespace: "default", Name: "pod1"}},
+		{"ns1/pod1", NodeIdentity{Namespace: "ns1", Name: "pod1"}},
+		{"ns1/pod1/10.1.1.0", NodeIdentity{Namespace: "ns1", Name: "pod1", IP: "10.1.1.0"}},
+		{"ns1/pod1/10.1.1.0/west", NodeIdentity{Namespace: "ns1", Name: "pod1", IP: "10.1.1.0", Cluster: "west"}},
+	}
+	for _, c := range cases {
+		got, err := ParseNodeID(c.id)
+		if err != nil {
+			t.Errorf("ParseNodeID(%q) => %v", c.id, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseNodeID(%q) => %#v, want %#v", c.id, got, c.want)
+		}
+	}
+
+	// workloads of the same name in several clusters have distinct keys
+	for id, want := range map[string]string{
+		"ns1/pod1/10.1.1.0":      "ns1/pod1",
+		"ns1/pod1/10.1.1.0/west": "west/ns1/pod1",
+		"ns1/pod1/10.2.1.0/east": "east/ns1/pod1",
+	} {
+		if got, _ := ParseNodeID(id); got.Key() != want || got.Workload() != "ns1/pod1" {
+			t.Errorf("ParseNodeID(%q) has key %q and workload %q, want %q and ns1/pod1", id, got.Key(), got.Workload(), want)
+		}
+	}
+
+	for _, id := range []string{"", "/pod1", "ns1/", "ns1/pod1/not-an-ip", "ns1/pod1/10.1.1.0/", "a/b/10.1.1.0/c/d"} {
+		if _, err := ParseNodeID(id); err == nil {
+			t.Errorf("ParseNodeID(%q) => no error", id)
+		}
+	}
+}
+
+func TestParseNode(t *testing.T) {
+	if _, err := ParseNode(nil); err == nil {
+		t.Error("ParseNode(nil) => no error")
+	}
+	node := &core.Node{
+		Id: "ns1/pod1",
+		Metadata: &types.Struct{Fields: map[string]*types.Value{
+			"POD_IP": {Kind: &types.Value_StringValue{StringValue: "10.1.1.0"}},
+			"PORTS":  {Kind: &types.Value_NumberValue{NumberValue: 80}},
+		}},
+	}
+	got, err := ParseNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key() != "ns1/pod1" {
+		t.Errorf("got key %q, want ns1/pod1", got.Key())
+	}
+	if want := map[string]string{"POD_IP": "10.1.1.0"}; !reflect.DeepEqual(got.Metadata, want) {
+		t.Errorf("got metadata %v, want %v", got.Metadata, want)
+	}
+}
+
+func TestParseNodeMetadata(t *testing.T) {
+	node := &core.Node{
+		Id: "ns1/pod1",
+		Metadata: &types.Struct{Fields: map[string]*types.Value{
+			"pod_ip":          {Kind: &types.Value_StringValue{StringValue: "10.1.1.0"}},
+			"service_account": {Kind: &types.Value_StringValue{StringValue: "reviews"}},
+			"labels": {Kind: &types.Value_StructValue{StructValue: &types.Struct{Fields: map[string]*types.Value{
+				"app": {Kind: &types.Value_StringValue{StringValue: "reviews"}},
+			}}}},
+		}},
+	}
+	got, err := ParseNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IP != "10.1.1.0" {
+		t.Errorf("got IP %q, want 10.1.1.0", got.IP)
+	}
+	if want := (model.Labels{"app": "reviews"}); !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("got labels %v, want %v", got.Labels, want)
+	}
+	if got, want := got.ServiceAccount("cluster.local"), "spiffe://cluster.local/ns/ns1/sa/reviews"; got != want {
+		t.Errorf("got service account %q, want %q", got, want)
+	}
+
+	// the IP in the ID takes precedence
+	node.Id = "ns1/pod1/10.1.1.1"
+	if got, _ := ParseNode(node); got.IP != "10.1.1.1" {
+		t.Errorf("got IP %q, want 10.1.1.1", got.IP)
+	}
+
+	node.Id = "ns1/pod1"
+	node.Metadata.Fields["pod_ip"] = &types.Value{Kind: &types.Value_StringValue{StringValue: "bad-ip"}}
+	if _, err := ParseNode(node); err == nil {
+		t.Error("ParseNode with an invalid pod IP => no error")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	registry := memory.NewRegistry()
+	g := &Generator{controller: registry, identities: make(map[string]NodeIdentity)}
+	authority, err := ca.NewSelfSignedCA("cluster.local", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority.Identity = g.Identity
+
+	// a node known only from its metadata gets no certificate
+	identity, err := ParseNode(&core.Node{
+		Id: "ns1/pod1",
+		Metadata: &types.Struct{Fields: map[string]*types.Value{
+			"service_account": {Kind: &types.Value_StringValue{StringValue: "admin"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.identities[identity.Key()] = identity
+	if _, err := g.Identity("ns1/pod1"); err != model.ErrUnknownWorkload {
+		t.Errorf("got error %v for a node missing from the registry, want %v", err, model.ErrUnknownWorkload)
+	}
+	if _, _, err := authority.Certificate("ns1/pod1"); err != model.ErrUnknownWorkload {
+		t.Errorf("got error %v issuing a certificate from node metadata, want %v", err, model.ErrUnknownWorkload)
+	}
+
+	// the registry is the source of the identity
+	registry.SetWorkloads(map[string]model.Instance{
+		"ns1/pod1": {ServiceAccount: "spiffe://cluster.local/ns/ns1/sa/reviews"},
+	})
+	if got, err := g.Identity("ns1/pod1"); err != nil || got != "spiffe://cluster.local/ns/ns1/sa/reviews" {
+		t.Errorf("got identity %q and error %v", got, err)
+	}
+	if _, _, err := authority.Certificate("ns1/pod1"); err != nil {
+		t.Error(err)
+	}
+}
+
+type clusterRegistry struct {
+	*memory.Registry
+	name string
+}
+
+func (r clusterRegistry) ClusterName() string {
+	return r.name
+}
+
+func TestIdentityInCluster(t *testing.T) {
+	east, west := memory.NewRegistry(), memory.NewRegistry()
+	east.SetWorkloads(map[string]model.Instance{"ns1/pod1": {ServiceAccount: "spiffe://cluster.local/ns/ns1/sa/reviews"}})
+	west.SetWorkloads(map[string]model.Instance{"ns1/pod1": {ServiceAccount: "spiffe://cluster.local/ns/ns1/sa/admin"}})
+	g := &Generator{
+		controller: aggregate.NewMergedController(clusterRegistry{east, "east"}, clusterRegistry{west, "west"}),
+		identities: make(map[string]NodeIdentity),
+	}
+
+	// the workload is taken from the registry of the cluster of the node
+	for id, want := range map[string]string{
+		"ns1/pod1":               "spiffe://cluster.local/ns/ns1/sa/reviews",
+		"ns1/pod1/10.1.1.0/east": "spiffe://cluster.local/ns/ns1/sa/reviews",
+		"ns1/pod1/10.2.1.0/west": "spiffe://cluster.local/ns/ns1/sa/admin",
+	} {
+		if got, err := g.Identity(id); err != nil || got != want {
+			t.Errorf("Identity(%q) => %q, %v, want %q", id, got, err, want)
+		}
+	}
+	if _, err := g.Identity("ns1/pod1/10.3.1.0/north"); err != model.ErrUnknownWorkload {
+		t.Errorf("got error %v for a node of an unknown cluster, want %v", err, model.ErrUnknownWorkload)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	registry := memory.NewRegistry()
+	registry.SetWorkloads(map[string]model.Instance{
+		"ns1/pod1": {ServiceAccount: "spiffe://cluster.local/ns/ns1/sa/reviews"},
+		"ns1/pod2": {ServiceAccount: "spiffe://cluster.local/ns/ns1/sa/ratings"},
+	})
+	g := &Generator{controller: registry, identities: make(map[string]NodeIdentity)}
+	node := func(id, token string) *core.Node {
+		return &core.Node{Id: id, Metadata: &types.Struct{Fields: map[string]*types.Value{
+			metadataToken: {Kind: &types.Value_StringValue{StringValue: token}},
+		}}}
+	}
+	if err := g.Authenticate(node("ns1/pod1", "reviews-token")); err == nil {
+		t.Error("authenticated a node without a token reviewer")
+	}
+
+	g.options.ReviewToken = func(_, token string) (string, string, error) {
+		if token != "reviews-token" {
+			return "", "", errors.New("invalid token")
+		}
+		return "ns1", "reviews", nil
+	}
+	if err := g.Authenticate(node("ns1/pod1", "reviews-token")); err != nil {
+		t.Error(err)
+	}
+	for _, n := range []*core.Node{
+		{Id: "ns1/pod1"},
+		node("ns1/pod1", "other-token"),
+		// the token of another service account
+		node("ns1/pod2", "reviews-token"),
+		// the token of a pod missing from the registry
+		node("ns1/pod3", "reviews-token"),
+	} {
+		if err := g.Authenticate(n); err == nil {
+			t.Errorf("authenticated node %v", n)
+		}
+	}
+
+	// the token is not kept with the identity
+	identity, err := ParseNode(node("ns1/pod1", "reviews-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := identity.Metadata[metadataToken]; exists {
+		t.Error("token kept in the node identity")
+	}
+}
+
+func TestMetadataInstance(t *testing.T) {
+	services := []*model.Service{{
+		Hostname: "reviews.ns1.svc.cluster.local",
+		Ports:    model.PortList{{Name: "http", Port: 9080, Protocol: model.ProtocolHTTP}},
+	}}
+	instances := map[string][]model.Endpoint{
+		"reviews.ns1.svc.cluster.local:http": {
+			{IP: "10.1.1.0", Port: 9080},
+			{IP: "10.1.1.1", Port: 9080},
+		},
+	}
+	id := NodeIdentity{
+		Namespace: "ns1",
+		Name:      "pod1",
+		IP:        "10.1.1.1",
+		Labels:    model.Labels{"app": "reviews"},
+		Metadata:  map[string]string{"service_account": "reviews"},
+	}
+	got := metadataInstance("ns1/pod1", id, "cluster.local", services, instances)
+	want := model.Instance{
+		Endpoints: []model.Endpoint{{
+			IP:       "10.1.1.1",
+			Port:     9080,
+			Protocol: model.ProtocolHTTP,
+			Service:  "reviews.ns1.svc.cluster.local",
+		}},
+		Labels:         model.Labels{"app": "reviews"},
+		UID:            "ns1/pod1",
+		ServiceAccount: "spiffe://cluster.local/ns/ns1/sa/reviews",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	// nodes without an IP have no endpoints
+	id.IP = ""
+	if got := metadataInstance("ns1/pod1", id, "cluster.local", services, instances); len(got.Endpoints) != 0 {
+		t.Errorf("got endpoints %v, want none", got.Endpoints)
+	}
+}
+
+type fakeDiscoveryStream struct {
+	grpc.ServerStream
+	requests []*v2.DiscoveryRequest
+}
+
+func (f *fakeDiscoveryStream) RecvMsg(m interface{}) error {
+	*m.(*v2.DiscoveryRequest) = *f.requests[0]
+	f.requests = f.requests[1:]
+	return nil
+}
+
+func TestValidateNodes(t *testing.T) {
+	recv := func(requests ...*v2.DiscoveryRequest) ([]*v2.DiscoveryRequest, []error) {
+		var received []*v2.DiscoveryRequest
+		var errs []error
+		handler := func(_ interface{}, stream grpc.ServerStream) error {
+			for range requests {
+				req := &v2.DiscoveryRequest{}
+				errs = append(errs, stream.RecvMsg(req))
+				received = append(received, req)
+			}
+			return nil
+		}
+		if err := ValidateNodes(nil, &fakeDiscoveryStream{requests: requests}, nil, handler); err != nil {
+			t.Fatal(err)
+		}
+		return received, errs
+	}
+
+	// only the first request must carry the node, and the later requests
+	// are filled in with it
+	node := &core.Node{Id: "ns1/pod1"}
+	received, errs := recv(&v2.DiscoveryRequest{Node: node}, &v2.DiscoveryRequest{})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if received[i].Node != node {
+			t.Errorf("got node %v of request %d, want %v", received[i].Node, i, node)
+		}
+	}
+
+	for _, req := range []*v2.DiscoveryRequest{{}, {Node: &core.Node{Id: "ns1/pod1/bad-ip"}}} {
+		_, errs := recv(req)
+		if s, _ := status.FromError(errs[0]); s.Code() != codes.InvalidArgument {
+			t.Errorf("got %v for node %v, want an invalid argument error", errs[0], req.Node)
+		}
+	}
+}
+
+func TestMultiClusterAuthenticate(t *testing.T) {
+	// the same pod runs as different service accounts in the clusters
+	pod := func(account string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "ns1"},
+			Spec:       v1.PodSpec{ServiceAccountName: account},
+			Status:     v1.PodStatus{PodIP: "10.1.1.0"},
+		}
+	}
+	reviewed := make(map[string][]string)
+	cluster := func(name, account string) *fake.Clientset {
+		client := fake.NewSimpleClientset(pod(account))
+		client.PrependReactor("create", "tokenreviews", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+			review := action.(k8s_testing.CreateAction).GetObject().(*authentication_v1.TokenReview)
+			reviewed[name] = append(reviewed[name], review.Spec.Token)
+			if review.Spec.Token == name+"-token" {
+				review.Status.Authenticated = true
+				review.Status.User.Username = "system:serviceaccount:ns1:" + account
+			}
+			return true, review, nil
+		})
+		return client
+	}
+	clients := map[string]kubernetes.Interface{
+		"west": cluster("west", "reviews"),
+		"east": cluster("east", "ratings"),
+	}
+	g, err := newMultiClusterGenerator("west", clients, nil, GeneratorOptions{Native: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go g.Run(stop)
+
+	node := func(id, token string) *core.Node {
+		return &core.Node{Id: id, Metadata: &types.Struct{Fields: map[string]*types.Value{
+			metadataToken: {Kind: &types.Value_StringValue{StringValue: token}},
+		}}}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = g.Identity("ns1/pod1/10.1.1.0/east")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the remote workload is unknown: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the token of a remote node is reviewed by its cluster
+	if err := g.Authenticate(node("ns1/pod1/10.1.1.0/east", "east-token")); err != nil {
+		t.Error(err)
+	}
+	if want := []string{"east-token"}; !reflect.DeepEqual(reviewed["east"], want) || len(reviewed["west"]) > 0 {
+		t.Errorf("got reviewed tokens %v, want %v in east", reviewed, want)
+	}
+	for _, n := range []*core.Node{
+		// the token of the local pod
+		node("ns1/pod1/10.1.1.0/east", "west-token"),
+		// nodes must name their clusters
+		node("ns1/pod1", "west-token"),
+		node("ns1/pod1/10.1.1.0/south", "east-token"),
+	} {
+		if err := g.Authenticate(n); err == nil {
+			t.Errorf("authenticated node %v", n)
+		}
+	}
+	if _, err := g.Identity("ns1/pod1"); err == nil {
+		t.Error("got the identity of a node without a cluster")
+	}
+}
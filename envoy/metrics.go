@@ -0,0 +1,164 @@
+package envoy
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	metrics "github.com/envoyproxy/go-control-plane/envoy/service/metrics/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/glog"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	prometheus "istio.io/gogo-genproto/prometheus"
+)
+
+// invalidMetricChars are replaced in the Envoy stat names, e.g.
+// "cluster.ads.upstream_cx_total"
+var invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_:]")
+
+// MetricsServer aggregates the stats flushed by the proxies and re-exposes
+// them in Prometheus text format labeled with the node ID and cluster
+type MetricsServer struct {
+	mu      sync.Mutex
+	streams int64
+	nodes   map[string]*nodeMetrics
+}
+
+// nodeMetrics are the last stats of a node
+type nodeMetrics struct {
+	// stream flushing the stats, replaced when the node reconnects
+	stream   int64
+	node     *core.Node
+	families []*dto.MetricFamily
+}
+
+// NewMetricsServer creates a metrics service
+func NewMetricsServer() *MetricsServer {
+	return &MetricsServer{nodes: make(map[string]*nodeMetrics)}
+}
+
+// StreamMetrics implements MetricsServiceServer
+func (s *MetricsServer) StreamMetrics(stream metrics.MetricsService_StreamMetricsServer) error {
+	s.mu.Lock()
+	s.streams++
+	id := s.streams
+	s.mu.Unlock()
+
+	// only the first message of a stream carries the identifier
+	var node *core.Node
+	defer func() {
+		if node != nil {
+			s.forget(node.GetId(), id)
+		}
+	}()
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&metrics.StreamMetricsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Identifier != nil {
+			node = msg.Identifier.Node
+		}
+		if node == nil {
+			glog.Warningf("metrics stream %d without node identifier", id)
+			continue
+		}
+		families, err := convertFamilies(msg.EnvoyMetrics)
+		if err != nil {
+			glog.Warningf("metrics stream %d of node %q: %v", id, node.GetId(), err)
+			continue
+		}
+		s.mu.Lock()
+		s.nodes[node.GetId()] = &nodeMetrics{stream: id, node: node, families: families}
+		s.mu.Unlock()
+	}
+}
+
+// convertFamilies converts the metric families of the Envoy API to the
+// Prometheus client types used by the text encoder. Both are generated from
+// the same Prometheus client proto, so they share the wire format.
+func convertFamilies(in []*prometheus.MetricFamily) ([]*dto.MetricFamily, error) {
+	out := make([]*dto.MetricFamily, 0, len(in))
+	for _, family := range in {
+		data, err := proto.Marshal(family)
+		if err != nil {
+			return nil, err
+		}
+		converted := &dto.MetricFamily{}
+		if err = proto.Unmarshal(data, converted); err != nil {
+			return nil, err
+		}
+		out = append(out, converted)
+	}
+	return out, nil
+}
+
+// forget drops the stats of a node if the stream is the last one of the node
+func (s *MetricsServer) forget(node string, stream int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stats, exists := s.nodes[node]; exists && stats.stream == stream {
+		delete(s.nodes, node)
+	}
+}
+
+// families merges the stats of all nodes into metric families sorted by name
+func (s *MetricsServer) families() []*dto.MetricFamily {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.nodes))
+	for id := range s.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	merged := make(map[string]*dto.MetricFamily)
+	for _, id := range ids {
+		stats := s.nodes[id]
+		labels := []*dto.LabelPair{
+			{Name: proto.String("node"), Value: proto.String(id)},
+			{Name: proto.String("cluster"), Value: proto.String(stats.node.GetCluster())},
+		}
+		for _, family := range stats.families {
+			name := "envoy_" + invalidMetricChars.ReplaceAllString(family.GetName(), "_")
+			out, exists := merged[name]
+			if !exists {
+				out = &dto.MetricFamily{Name: proto.String(name), Help: family.Help, Type: family.Type}
+				merged[name] = out
+			} else if out.GetType() != family.GetType() {
+				continue
+			}
+			for _, metric := range family.Metric {
+				labeled := *metric
+				labeled.Label = append(append([]*dto.LabelPair{}, labels...), metric.Label...)
+				out.Metric = append(out.Metric, &labeled)
+			}
+		}
+	}
+
+	out := make([]*dto.MetricFamily, 0, len(merged))
+	for _, family := range merged {
+		out = append(out, family)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+	return out
+}
+
+// ServeHTTP writes the stats of the proxies in Prometheus text format
+func (s *MetricsServer) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	for _, family := range s.families() {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			glog.Warningf("failed to write metric %s: %v", family.GetName(), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package envoy
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	metrics "github.com/envoyproxy/go-control-plane/envoy/service/metrics/v2"
+	"google.golang.org/grpc"
+	prometheus "istio.io/gogo-genproto/prometheus"
+)
+
+type fakeMetricsStream struct {
+	grpc.ServerStream
+	messages chan *metrics.StreamMetricsMessage
+}
+
+func (f *fakeMetricsStream) Recv() (*metrics.StreamMetricsMessage, error) {
+	msg, ok := <-f.messages
+	if !ok {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+func (f *fakeMetricsStream) SendAndClose(*metrics.StreamMetricsResponse) error { return nil }
+
+func counter(name string, value float64) *prometheus.MetricFamily {
+	return &prometheus.MetricFamily{
+		Name:   name,
+		Type:   prometheus.MetricType_COUNTER,
+		Metric: []*prometheus.Metric{{Counter: &prometheus.Counter{Value: value}}},
+	}
+}
+
+func scrape(server *MetricsServer) string {
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/stats/proxies", nil))
+	return w.Body.String()
+}
+
+func TestStreamMetrics(t *testing.T) {
+	server := NewMetricsServer()
+	streams := make([]*fakeMetricsStream, 0)
+	done := make(chan error)
+	for _, node := range []*core.Node{{Id: "default/a", Cluster: "productpage"}, {Id: "default/b", Cluster: "reviews"}} {
+		stream := &fakeMetricsStream{messages: make(chan *metrics.StreamMetricsMessage)}
+		streams = append(streams, stream)
+		go func() { done <- server.StreamMetrics(stream) }()
+		stream.messages <- &metrics.StreamMetricsMessage{
+			Identifier:   &metrics.StreamMetricsMessage_Identifier{Node: node},
+			EnvoyMetrics: []*prometheus.MetricFamily{counter("cluster.ads.upstream_cx_total", 1)},
+		}
+	}
+	// later flushes replace the stats of the node, and the stream receives
+	// the next flush only after processing the previous one
+	for i, value := range []float64{3, 1} {
+		for j := 0; j < 2; j++ {
+			streams[i].messages <- &metrics.StreamMetricsMessage{
+				EnvoyMetrics: []*prometheus.MetricFamily{counter("cluster.ads.upstream_cx_total", value)},
+			}
+		}
+	}
+
+	out := scrape(server)
+	for _, want := range []string{
+		"# TYPE envoy_cluster_ads_upstream_cx_total counter\n",
+		`envoy_cluster_ads_upstream_cx_total{node="default/a",cluster="productpage"} 3`,
+		`envoy_cluster_ads_upstream_cx_total{node="default/b",cluster="reviews"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "# TYPE") != 1 {
+		t.Errorf("expected a single metric family:\n%s", out)
+	}
+
+	// the stats of a disconnected node are dropped
+	close(streams[1].messages)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if out := scrape(server); strings.Contains(out, "default/b") {
+		t.Errorf("unexpected stats of a disconnected node:\n%s", out)
+	}
+	close(streams[0].messages)
+	<-done
+}
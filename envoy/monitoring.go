@@ -0,0 +1,149 @@
+package envoy
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	nodesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "envoymesh",
+		Name:      "nodes",
+		Help:      "Number of nodes with a config compiler by state, live or retired after disconnecting.",
+	}, []string{"state"})
+	nodesCollected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "envoymesh",
+		Name:      "nodes_collected_total",
+		Help:      "Number of retired nodes removed after the grace period.",
+	})
+	compileDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "envoymesh",
+		Name:      "compile_duration_seconds",
+		Help:      "Latency of the config generation for a node.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+	compileErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "envoymesh",
+		Name:      "compile_errors_total",
+		Help:      "Number of failed config generations.",
+	})
+	snapshotPushes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "envoymesh",
+		Name:      "snapshot_pushes_total",
+		Help:      "Number of snapshots pushed to the nodes.",
+	})
+	snapshotVersion = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "envoymesh",
+		Name:      "snapshot_version",
+		Help:      "Version of the last pushed snapshot.",
+	})
+	adsStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "envoymesh",
+		Subsystem: "ads",
+		Name:      "streams",
+		Help:      "Number of open ADS streams.",
+	})
+	adsRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "envoymesh",
+		Subsystem: "ads",
+		Name:      "requests_total",
+		Help:      "Number of discovery requests by resource type.",
+	}, []string{"type"})
+	adsResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "envoymesh",
+		Subsystem: "ads",
+		Name:      "responses_total",
+		Help:      "Number of discovery responses by resource type.",
+	}, []string{"type"})
+	adsStreamCounts = newStreamCollector()
+)
+
+func init() {
+	prometheus.MustRegister(nodesGauge, nodesCollected, compileDuration, compileErrors, snapshotPushes, snapshotVersion,
+		adsStreams, adsRequests, adsResponses, adsStreamCounts)
+}
+
+// streamCounts are the discovery requests and responses of a stream by
+// resource type
+type streamCounts struct {
+	node      string
+	requests  map[string]float64
+	responses map[string]float64
+}
+
+// streamCollector exports the request and response counts of the open ADS
+// streams. The counts of a stream are dropped when it closes, so that the
+// stream IDs do not accumulate.
+type streamCollector struct {
+	mu        sync.Mutex
+	streams   map[int64]*streamCounts
+	requests  *prometheus.Desc
+	responses *prometheus.Desc
+}
+
+func newStreamCollector() *streamCollector {
+	labels := []string{"stream", "node", "type"}
+	return &streamCollector{
+		streams: make(map[int64]*streamCounts),
+		requests: prometheus.NewDesc("envoymesh_ads_stream_requests_total",
+			"Number of discovery requests of an open stream by resource type.", labels, nil),
+		responses: prometheus.NewDesc("envoymesh_ads_stream_responses_total",
+			"Number of discovery responses of an open stream by resource type.", labels, nil),
+	}
+}
+
+func (c *streamCollector) get(stream int64) *streamCounts {
+	counts, exists := c.streams[stream]
+	if !exists {
+		counts = &streamCounts{requests: make(map[string]float64), responses: make(map[string]float64)}
+		c.streams[stream] = counts
+	}
+	return counts
+}
+
+// request counts a request. Only the first request of a stream is required
+// to carry the node.
+func (c *streamCollector) request(stream int64, node, typeURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.get(stream)
+	if counts.node == "" {
+		counts.node = node
+	}
+	counts.requests[typeURL]++
+}
+
+func (c *streamCollector) response(stream int64, typeURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(stream).responses[typeURL]++
+}
+
+func (c *streamCollector) close(stream int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streams, stream)
+}
+
+// Describe implements prometheus.Collector
+func (c *streamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requests
+	ch <- c.responses
+}
+
+// Collect implements prometheus.Collector
+func (c *streamCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for stream, counts := range c.streams {
+		id := strconv.FormatInt(stream, 10)
+		for typeURL, value := range counts.requests {
+			ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, value, id, counts.node, typeURL)
+		}
+		for typeURL, value := range counts.responses {
+			ch <- prometheus.MustNewConstMetric(c.responses, prometheus.CounterValue, value, id, counts.node, typeURL)
+		}
+	}
+}
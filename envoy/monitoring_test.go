@@ -0,0 +1,62 @@
+package envoy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gatherCounts returns the values of the collected metrics by name and
+// label values
+func gatherCounts(t *testing.T, collector prometheus.Collector) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			key := family.GetName()
+			for _, label := range metric.Label {
+				key += " " + label.GetValue()
+			}
+			out[key] = metric.GetCounter().GetValue()
+		}
+	}
+	return out
+}
+
+func TestStreamCollector(t *testing.T) {
+	c := newStreamCollector()
+	c.request(1, "ns1/pod1", cache.ClusterType)
+	c.response(1, cache.ClusterType)
+	c.request(1, "", cache.ClusterType)
+	c.request(1, "", cache.ListenerType)
+	c.request(-1, "ns1/pod2", cache.EndpointType)
+	c.response(-1, cache.EndpointType)
+	c.response(-1, cache.EndpointType)
+
+	want := map[string]float64{
+		"envoymesh_ads_stream_requests_total ns1/pod1 1 " + cache.ClusterType:    2,
+		"envoymesh_ads_stream_requests_total ns1/pod1 1 " + cache.ListenerType:   1,
+		"envoymesh_ads_stream_responses_total ns1/pod1 1 " + cache.ClusterType:   1,
+		"envoymesh_ads_stream_requests_total ns1/pod2 -1 " + cache.EndpointType:  1,
+		"envoymesh_ads_stream_responses_total ns1/pod2 -1 " + cache.EndpointType: 2,
+	}
+	if got := gatherCounts(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("got counts %v, want %v", got, want)
+	}
+
+	// closed streams are dropped
+	c.close(1)
+	delete(want, "envoymesh_ads_stream_requests_total ns1/pod1 1 "+cache.ClusterType)
+	delete(want, "envoymesh_ads_stream_requests_total ns1/pod1 1 "+cache.ListenerType)
+	delete(want, "envoymesh_ads_stream_responses_total ns1/pod1 1 "+cache.ClusterType)
+	if got := gatherCounts(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("got counts %v after closing a stream, want %v", got, want)
+	}
+}
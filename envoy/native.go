@@ -0,0 +1,729 @@
+package envoy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/gogo/protobuf/types"
+	"github.com/kyessenov/envoymesh/model"
+	proxyconfig "istio.io/api/proxy/v1/config"
+)
+
+const (
+	// virtualPort is the port for traffic captured by iptables
+	virtualPort = 15001
+
+	connectTimeout = 5 * time.Second
+
+	// workloadSecret is the SDS name of the workload certificate
+	workloadSecret = "default"
+)
+
+var (
+	checkCluster  = clusterKey("istio-policy.istio-system.svc.cluster.local", "grpc-mixer")
+	reportCluster = clusterKey("istio-telemetry.istio-system.svc.cluster.local", "grpc-mixer")
+)
+
+// NativeGenerator produces the same configuration as envoy.jsonnet directly
+// from the model
+type NativeGenerator struct{}
+
+// Generate implements ConfigGenerator
+func (*NativeGenerator) Generate(in *Input) (*Config, error) {
+	out := &Config{
+		Listeners: []cache.Resource{virtualListener(virtualPort)},
+		Routes:    make([]cache.Resource, 0),
+		Clusters:  make([]cache.Resource, 0),
+	}
+
+	for _, ep := range in.Instance.Endpoints {
+		authz := endpointAuthorization(in.ExternalAuthorizations, ep)
+		listener, cluster, err := inboundListener(in.Instance.UID, ep, in.AuthorizationPolicies, authz, in.Security, in.Telemetry)
+		if err != nil {
+			return nil, err
+		}
+		out.Listeners = append(out.Listeners, listener)
+		out.Clusters = append(out.Clusters, cluster)
+	}
+
+	for _, service := range in.Services {
+		if service.Address == "" {
+			continue
+		}
+		for _, port := range service.Ports {
+			if !isTCP(port.Protocol) {
+				continue
+			}
+			listener, cluster := outboundTCPListener(in.Instance.UID, service, port, in.Security)
+			out.Listeners = append(out.Listeners, listener)
+			out.Clusters = append(out.Clusters, cluster)
+		}
+	}
+
+	ports := outboundHTTPPorts(in.Services)
+	for _, port := range ports {
+		out.Listeners = append(out.Listeners, outboundHTTPListener(in.Instance.UID, port, in.Telemetry))
+	}
+	for _, port := range ports {
+		routes, clusters := outboundHTTPRoutes(in, port)
+		out.Routes = append(out.Routes, routes)
+		out.Clusters = append(out.Clusters, clusters...)
+	}
+
+	out.Endpoints = buildEndpoints(out.Clusters, in.Instances)
+	return out, nil
+}
+
+func clusterKey(hostname, port string) string {
+	return fmt.Sprintf("%s:%s", hostname, port)
+}
+
+func isHTTP2(protocol model.Protocol) bool {
+	return protocol == model.ProtocolHTTP2 || protocol == model.ProtocolGRPC
+}
+
+func isTCP(protocol model.Protocol) bool {
+	return protocol == model.ProtocolTCP || protocol == model.ProtocolHTTPS
+}
+
+func socketAddress(address string, port int) core.Address {
+	return core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Address:       address,
+				PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(port)},
+			},
+		},
+	}
+}
+
+func adsSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+	}
+}
+
+// mutualTLS is true if the policy resolves to mutual TLS
+func mutualTLS(policy proxyconfig.AuthenticationPolicy, security Security) bool {
+	return security.RootCert != "" &&
+		(policy == proxyconfig.AuthenticationPolicy_MUTUAL_TLS ||
+			policy == proxyconfig.AuthenticationPolicy_INHERIT && security.MutualTLS)
+}
+
+func commonTLSContext(security Security, subjectAltNames []string) *auth.CommonTlsContext {
+	return &auth.CommonTlsContext{
+		TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{{
+			Name: workloadSecret,
+			SdsConfig: &core.ConfigSource{
+				ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
+					ApiConfigSource: &core.ApiConfigSource{
+						ApiType: core.ApiConfigSource_GRPC,
+						GrpcServices: []*core.GrpcService{{
+							TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+								EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: security.SDSCluster},
+							},
+						}},
+					},
+				},
+			},
+		}},
+		ValidationContextType: &auth.CommonTlsContext_ValidationContext{
+			ValidationContext: &auth.CertificateValidationContext{
+				TrustedCa: &core.DataSource{
+					Specifier: &core.DataSource_InlineBytes{InlineBytes: []byte(security.RootCert)},
+				},
+				VerifySubjectAltName: subjectAltNames,
+			},
+		},
+	}
+}
+
+// ipBytes encodes an IPv4 address as mixer bytes attribute value. Other
+// addresses are rejected like by the script, and the generator drops their
+// endpoints before compiling the node.
+func ipBytes(ip string) (string, error) {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil {
+		return "", fmt.Errorf("unsupported endpoint address %q, want IPv4", ip)
+	}
+	return base64.StdEncoding.EncodeToString(parsed), nil
+}
+
+func inboundCluster(port int, protocol model.Protocol) *v2.Cluster {
+	address := socketAddress("127.0.0.1", port)
+	out := &v2.Cluster{
+		Name:           fmt.Sprintf("in.%d", port),
+		ConnectTimeout: connectTimeout,
+		Type:           v2.Cluster_STATIC,
+		LbPolicy:       v2.Cluster_ROUND_ROBIN,
+		Hosts:          []*core.Address{&address},
+	}
+	if isHTTP2(protocol) {
+		out.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+	}
+	return out
+}
+
+// upstreamTLS is true if the clients of a service port use mutual TLS.
+// External services are outside of the mesh and do not inherit the mesh
+// policy.
+func upstreamTLS(service *model.Service, port *model.Port, security Security) bool {
+	if service.External() && port.AuthenticationPolicy == proxyconfig.AuthenticationPolicy_INHERIT {
+		return false
+	}
+	return mutualTLS(port.AuthenticationPolicy, security)
+}
+
+func outboundCluster(service *model.Service, port *model.Port, security Security) *v2.Cluster {
+	key := clusterKey(service.Hostname, port.Name)
+	out := &v2.Cluster{
+		Name:           key,
+		ConnectTimeout: connectTimeout,
+		Type:           v2.Cluster_EDS,
+		EdsClusterConfig: &v2.Cluster_EdsClusterConfig{
+			ServiceName: key,
+			EdsConfig:   adsSource(),
+		},
+		LbPolicy: v2.Cluster_ROUND_ROBIN,
+	}
+	if isHTTP2(port.Protocol) {
+		out.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+	}
+	if upstreamTLS(service, port, security) {
+		var subjectAltNames []string
+		if len(service.ServiceAccounts) > 0 {
+			subjectAltNames = service.ServiceAccounts
+		}
+		out.TlsContext = &auth.UpstreamTlsContext{CommonTlsContext: commonTLSContext(security, subjectAltNames)}
+	}
+	return out
+}
+
+func virtualListener(port int) *v2.Listener {
+	return &v2.Listener{
+		Name:           "virtual",
+		Address:        socketAddress("0.0.0.0", port),
+		UseOriginalDst: &types.BoolValue{Value: true},
+		FilterChains:   []listener.FilterChain{{}},
+	}
+}
+
+// sidecarListener creates a listener that only receives traffic from the
+// virtual listener
+func sidecarListener(name string, address core.Address, filters []listener.Filter) *v2.Listener {
+	return &v2.Listener{
+		Name:         name,
+		Address:      address,
+		FilterChains: []listener.FilterChain{{Filters: filters}},
+		DeprecatedV1: &v2.Listener_DeprecatedV1{BindToPort: &types.BoolValue{Value: false}},
+	}
+}
+
+func mixerTransport(uid string) object {
+	return object{
+		"check_cluster":  checkCluster,
+		"report_cluster": reportCluster,
+		"attributes_for_mixer_proxy": object{
+			"attributes": object{"source.uid": stringAttribute(uid)},
+		},
+	}
+}
+
+// accessLog streams the access logs to the access log service, or writes
+// them to stdout
+func accessLog(prefix string, telemetry Telemetry) object {
+	if telemetry.AccessLogCluster == "" {
+		return object{
+			"name":   "envoy.file_access_log",
+			"config": object{"path": "/dev/stdout"},
+		}
+	}
+	return object{
+		"name": "envoy.http_grpc_access_log",
+		"config": object{"common_config": object{
+			"log_name": prefix,
+			"grpc_service": object{
+				"envoy_grpc": object{"cluster_name": telemetry.AccessLogCluster},
+			},
+		}},
+	}
+}
+
+func httpConnectionManager(prefix string, telemetry Telemetry, routes object, filters []interface{}) listener.Filter {
+	config := object{
+		"stat_prefix":         prefix,
+		"codec_type":          "AUTO",
+		"access_log":          []interface{}{accessLog(prefix, telemetry)},
+		"generate_request_id": true,
+		"http_filters":        filters,
+	}
+	for key, value := range routes {
+		config[key] = value
+	}
+	return listener.Filter{Name: "envoy.http_connection_manager", Config: config.toStruct()}
+}
+
+func tcpProxy(prefix, cluster string) listener.Filter {
+	return listener.Filter{
+		Name:   "envoy.tcp_proxy",
+		Config: object{"stat_prefix": prefix, "cluster": cluster}.toStruct(),
+	}
+}
+
+func inboundListener(uid string, ep model.Endpoint, policies []*model.AuthorizationPolicy,
+	authz *model.ExternalAuthorization, security Security, telemetry Telemetry) (*v2.Listener, *v2.Cluster, error) {
+	ip, err := ipBytes(ep.IP)
+	if err != nil {
+		return nil, nil, err
+	}
+	cluster := inboundCluster(ep.Port, ep.Protocol)
+	prefix := fmt.Sprintf("in_%s_%d", ep.Protocol, ep.Port)
+	mtls := mutualTLS(ep.AuthenticationPolicy, security)
+	attributes := func(service string) object {
+		return object{
+			"destination.ip":         bytesAttribute(ip),
+			"destination.port":       int64Attribute(ep.Port),
+			"destination.service":    stringAttribute(service),
+			"destination.uid":        stringAttribute(uid),
+			"context.reporter.local": boolAttribute(true),
+			"context.reporter.uid":   stringAttribute(uid),
+		}
+	}
+
+	var filters []listener.Filter
+	switch {
+	case ep.Protocol.IsHTTP():
+		httpFilters := make([]interface{}, 0)
+		for _, filter := range append(rbacFilters(policies, true, mtls, security, prefix), extAuthzFilters(authz, true, prefix)...) {
+			httpFilters = append(httpFilters, filter)
+		}
+		filters = []listener.Filter{httpConnectionManager(prefix, telemetry,
+			object{"route_config": object{
+				"name": prefix,
+				"virtual_hosts": []interface{}{object{
+					"name":    prefix,
+					"domains": []interface{}{"*"},
+					"routes": []interface{}{object{
+						"match":     object{"prefix": "/"},
+						"route":     object{"cluster": cluster.Name},
+						"decorator": object{"operation": "inbound_route"},
+					}},
+				}},
+				"validate_clusters": false,
+			}},
+			append(httpFilters,
+				object{
+					"name": "mixer",
+					"config": object{
+						"default_destination_service": "ingress",
+						"service_configs": object{
+							"ingress": object{
+								"disable_check_calls": true,
+								"mixer_attributes":    object{"attributes": attributes("ingress")},
+							},
+						},
+						"transport": mixerTransport(uid),
+					},
+				},
+				object{"name": "envoy.router"},
+			))}
+	case isTCP(ep.Protocol):
+		filters = append(networkFilters(append(rbacFilters(policies, false, mtls, security, prefix),
+			extAuthzFilters(authz, false, prefix)...)),
+			listener.Filter{
+				Name: "mixer",
+				Config: object{
+					"disable_check_calls": true,
+					"mixer_attributes":    object{"attributes": attributes("unknown")},
+					"transport":           mixerTransport(uid),
+				}.toStruct(),
+			},
+			tcpProxy(prefix, cluster.Name),
+		)
+	}
+
+	out := sidecarListener(fmt.Sprintf("in_%s_%d", ep.IP, ep.Port), socketAddress(ep.IP, ep.Port), filters)
+	if mtls {
+		out.FilterChains[0].TlsContext = &auth.DownstreamTlsContext{
+			CommonTlsContext:         commonTLSContext(security, nil),
+			RequireClientCertificate: &types.BoolValue{Value: true},
+		}
+	}
+	return out, cluster, nil
+}
+
+func outboundTCPListener(uid string, service *model.Service, port *model.Port, security Security) (*v2.Listener, *v2.Cluster) {
+	cluster := outboundCluster(service, port, security)
+	prefix := fmt.Sprintf("out_%s_%d", service.Address, port.Port)
+	filters := []listener.Filter{
+		{
+			Name: "mixer",
+			Config: object{
+				"disable_check_calls": true,
+				"mixer_attributes": object{"attributes": object{
+					"destination.service":    stringAttribute(service.Hostname),
+					"source.uid":             stringAttribute(uid),
+					"context.reporter.local": boolAttribute(false),
+					"context.reporter.uid":   stringAttribute(uid),
+				}},
+				"transport": mixerTransport(uid),
+			}.toStruct(),
+		},
+		tcpProxy(prefix, cluster.Name),
+	}
+	return sidecarListener(prefix, socketAddress(service.Address, port.Port), filters), cluster
+}
+
+func outboundHTTPListener(uid string, port int, telemetry Telemetry) *v2.Listener {
+	prefix := fmt.Sprintf("out_HTTP_%d", port)
+	filter := httpConnectionManager(prefix, telemetry,
+		object{"rds": object{
+			"config_source":     object{"ads": object{}},
+			"route_config_name": fmt.Sprintf("%d", port),
+		}},
+		[]interface{}{
+			object{
+				"name": "mixer",
+				"config": object{
+					"mixer_attributes": object{"attributes": object{
+						"source.uid":             stringAttribute(uid),
+						"context.reporter.local": boolAttribute(false),
+						"context.reporter.uid":   stringAttribute(uid),
+					}},
+					"forward_attributes": object{"attributes": object{
+						"source.uid": stringAttribute(uid),
+					}},
+					"transport": mixerTransport(uid),
+				},
+			},
+			object{"name": "envoy.fault"},
+			object{"name": "envoy.router"},
+		})
+	return sidecarListener(prefix, socketAddress("0.0.0.0", port), []listener.Filter{filter})
+}
+
+// outboundHTTPPorts returns the sorted set of HTTP service ports
+func outboundHTTPPorts(services []*model.Service) []int {
+	set := make(map[int]bool)
+	for _, service := range services {
+		for _, port := range service.Ports {
+			if port.Protocol.IsHTTP() {
+				set[port.Port] = true
+			}
+		}
+	}
+	out := make([]int, 0, len(set))
+	for port := range set {
+		out = append(out, port)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// domains lists the host names of a service relative to the node domain,
+// with and without the port
+func domains(service *model.Service, port int, domain string) []string {
+	names := strings.Split(service.Hostname, ".")
+	context := strings.Split(domain, ".")
+	j := 0
+	for j < len(names) && j < len(context) && names[len(names)-1-j] == context[len(context)-1-j] {
+		j++
+	}
+
+	expansions := make([]string, 0)
+	for i := 0; i <= j; i++ {
+		expansions = append(expansions, strings.Join(names[0:len(names)-i], "."))
+	}
+	if service.Address != "" {
+		expansions = append(expansions, service.Address)
+	}
+
+	out := make([]string, 0, 2*len(expansions))
+	out = append(out, expansions...)
+	for _, host := range expansions {
+		out = append(out, fmt.Sprintf("%s:%d", host, port))
+	}
+	return out
+}
+
+// routeRule returns the first rule for the host
+func routeRule(rules []*model.RouteRule, host string) *model.RouteRule {
+	for _, rule := range rules {
+		if rule.Host == host {
+			return rule
+		}
+	}
+	return nil
+}
+
+func routeMatch(match *model.HTTPMatch) route.RouteMatch {
+	out := route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"}}
+	if match == nil {
+		return out
+	}
+	if match.Path != "" {
+		out.PathSpecifier = &route.RouteMatch_Path{Path: match.Path}
+	} else if match.Prefix != "" {
+		out.PathSpecifier = &route.RouteMatch_Prefix{Prefix: match.Prefix}
+	}
+	if len(match.Headers) > 0 {
+		names := make([]string, 0, len(match.Headers))
+		for name := range match.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			out.Headers = append(out.Headers, &route.HeaderMatcher{
+				Name:                 name,
+				HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: match.Headers[name]},
+			})
+		}
+	}
+	return out
+}
+
+// intersectMatch returns the match of requests matching both routes, or
+// false if no request matches both
+func intersectMatch(a, b *model.HTTPMatch) (*model.HTTPMatch, bool) {
+	if a == nil {
+		a = &model.HTTPMatch{}
+	}
+	if b == nil {
+		b = &model.HTTPMatch{}
+	}
+	out := &model.HTTPMatch{}
+	switch {
+	case a.Path != "" && b.Path != "":
+		if a.Path != b.Path {
+			return nil, false
+		}
+		out.Path = a.Path
+	case a.Path != "":
+		if !strings.HasPrefix(a.Path, b.Prefix) {
+			return nil, false
+		}
+		out.Path = a.Path
+	case b.Path != "":
+		if !strings.HasPrefix(b.Path, a.Prefix) {
+			return nil, false
+		}
+		out.Path = b.Path
+	case strings.HasPrefix(a.Prefix, b.Prefix):
+		out.Prefix = a.Prefix
+	case strings.HasPrefix(b.Prefix, a.Prefix):
+		out.Prefix = b.Prefix
+	default:
+		return nil, false
+	}
+	for _, headers := range []map[string]string{a.Headers, b.Headers} {
+		for name, value := range headers {
+			if other, exists := out.Headers[name]; exists && other != value {
+				return nil, false
+			}
+			if out.Headers == nil {
+				out.Headers = make(map[string]string)
+			}
+			out.Headers[name] = value
+		}
+	}
+	return out, true
+}
+
+func routeAction(key string, splits []*model.Split) *route.RouteAction {
+	if len(splits) == 1 {
+		return &route.RouteAction{
+			ClusterSpecifier: &route.RouteAction_Cluster{Cluster: model.SubsetKey(key, splits[0].Labels)},
+		}
+	}
+	weighted := &route.WeightedCluster{}
+	for _, split := range splits {
+		weighted.Clusters = append(weighted.Clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   model.SubsetKey(key, split.Labels),
+			Weight: &types.UInt32Value{Value: uint32(split.Weight)},
+		})
+	}
+	return &route.RouteAction{
+		ClusterSpecifier: &route.RouteAction_WeightedClusters{WeightedClusters: weighted},
+	}
+}
+
+// outboundSubsetClusters creates the sorted set of subset clusters used by
+// the routes
+func outboundSubsetClusters(service *model.Service, port *model.Port, security Security, routes []*model.HTTPRoute) []cache.Resource {
+	key := clusterKey(service.Hostname, port.Name)
+	set := make(map[string]bool)
+	for _, route := range routes {
+		for _, split := range route.Splits {
+			if name := model.SubsetKey(key, split.Labels); name != key {
+				set[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]cache.Resource, 0, len(names))
+	for _, name := range names {
+		cluster := outboundCluster(service, port, security)
+		cluster.Name = name
+		cluster.EdsClusterConfig.ServiceName = name
+		out = append(out, cluster)
+	}
+	return out
+}
+
+// serviceFaults returns the faults applicable to requests from the instance
+func serviceFaults(service *model.Service, instance model.Instance) []*model.Fault {
+	out := make([]*model.Fault, 0)
+	for _, fault := range service.Faults {
+		if fault.SourceLabels.SubsetOf(instance.Labels) {
+			out = append(out, fault)
+		}
+	}
+	return out
+}
+
+// mergeFaults combines the faults applying to the same route, taking the
+// delay and the abort from the first fault with one, or returns nil
+func mergeFaults(faults []*model.Fault) *model.Fault {
+	if len(faults) == 0 {
+		return nil
+	}
+	out := &model.Fault{}
+	for _, fault := range faults {
+		if out.Delay == nil {
+			out.Delay = fault.Delay
+		}
+		if out.Abort == nil {
+			out.Abort = fault.Abort
+		}
+	}
+	return out
+}
+
+func faultConfig(fault *model.Fault) object {
+	out := object{}
+	if fault.Delay != nil {
+		out["delay"] = object{"percent": fault.Delay.Percent, "fixed_delay": fault.Delay.FixedDelay}
+	}
+	if fault.Abort != nil {
+		out["abort"] = object{"percent": fault.Abort.Percent, "http_status": fault.Abort.HTTPStatus}
+	}
+	return out
+}
+
+func outboundHTTPRoutes(in *Input, port int) (*v2.RouteConfiguration, []cache.Resource) {
+	out := &v2.RouteConfiguration{
+		Name:             fmt.Sprintf("%d", port),
+		VirtualHosts:     make([]route.VirtualHost, 0),
+		ValidateClusters: &types.BoolValue{Value: false},
+	}
+	clusters := make([]cache.Resource, 0)
+
+	for _, service := range in.Services {
+		for _, portDesc := range service.Ports {
+			if !portDesc.Protocol.IsHTTP() || portDesc.Port != port {
+				continue
+			}
+			cluster := outboundCluster(service, portDesc, in.Security)
+			perFilterConfig := func(fault *model.Fault) map[string]*types.Struct {
+				out := map[string]*types.Struct{
+					"mixer": object{
+						"disable_check_calls": true,
+						"mixer_attributes": object{"attributes": object{
+							"destination.service": stringAttribute(service.Hostname),
+						}},
+						"forward_attributes": object{"attributes": object{
+							"destination.service": stringAttribute(service.Hostname),
+						}},
+					}.toStruct(),
+				}
+				if fault != nil {
+					out["envoy.fault"] = faultConfig(fault).toStruct()
+				}
+				return out
+			}
+
+			var ruleRoutes []*model.HTTPRoute
+			if rule := routeRule(in.RouteRules, service.Hostname); rule != nil {
+				ruleRoutes = rule.Routes
+			}
+
+			// faults without a match apply to every route, and faults with a
+			// match to the part of every route that they match
+			faults := serviceFaults(service, in.Instance)
+			var defaultFaults []*model.Fault
+			for _, fault := range faults {
+				if fault.Match == nil {
+					defaultFaults = append(defaultFaults, fault)
+				}
+			}
+			defaultConfig := perFilterConfig(mergeFaults(defaultFaults))
+
+			routes := make([]route.Route, 0)
+			for _, fault := range faults {
+				if fault.Match == nil {
+					continue
+				}
+				config := perFilterConfig(mergeFaults(append([]*model.Fault{fault}, defaultFaults...)))
+				for _, ruleRoute := range ruleRoutes {
+					if match, ok := intersectMatch(fault.Match, ruleRoute.Match); ok {
+						routes = append(routes, route.Route{
+							Match:           routeMatch(match),
+							Action:          &route.Route_Route{Route: routeAction(cluster.Name, ruleRoute.Splits)},
+							Decorator:       &route.Decorator{Operation: "fault_route"},
+							PerFilterConfig: config,
+						})
+					}
+				}
+				routes = append(routes, route.Route{
+					Match: routeMatch(fault.Match),
+					Action: &route.Route_Route{Route: &route.RouteAction{
+						ClusterSpecifier: &route.RouteAction_Cluster{Cluster: cluster.Name},
+					}},
+					Decorator:       &route.Decorator{Operation: "fault_route"},
+					PerFilterConfig: config,
+				})
+			}
+
+			for _, ruleRoute := range ruleRoutes {
+				routes = append(routes, route.Route{
+					Match:           routeMatch(ruleRoute.Match),
+					Action:          &route.Route_Route{Route: routeAction(cluster.Name, ruleRoute.Splits)},
+					Decorator:       &route.Decorator{Operation: "rule_route"},
+					PerFilterConfig: defaultConfig,
+				})
+			}
+			routes = append(routes, route.Route{
+				Match: route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"}},
+				Action: &route.Route_Route{Route: &route.RouteAction{
+					ClusterSpecifier: &route.RouteAction_Cluster{Cluster: cluster.Name},
+				}},
+				Decorator:       &route.Decorator{Operation: "default_route"},
+				PerFilterConfig: defaultConfig,
+			})
+
+			out.VirtualHosts = append(out.VirtualHosts, route.VirtualHost{
+				Name:    fmt.Sprintf("%s:%d", service.Hostname, portDesc.Port),
+				Domains: domains(service, portDesc.Port, in.Domain),
+				Routes:  routes,
+			})
+			clusters = append(clusters, cluster)
+			clusters = append(clusters, outboundSubsetClusters(service, portDesc, in.Security, ruleRoutes)...)
+		}
+	}
+	return out, clusters
+}
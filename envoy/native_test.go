@@ -0,0 +1,331 @@
+package envoy
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/kyessenov/envoymesh/model"
+	proxyconfig "istio.io/api/proxy/v1/config"
+)
+
+func compareResources(t *testing.T, kind string, got, want []cache.Resource) {
+	if len(got) != len(want) {
+		t.Errorf("got %d %s, want %d", len(got), kind, len(want))
+		return
+	}
+	marshaler := jsonpb.Marshaler{OrigName: true}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			gotJSON, _ := marshaler.MarshalToString(got[i])
+			wantJSON, _ := marshaler.MarshalToString(want[i])
+			t.Errorf("%s[%d] mismatch:\ngot  %s\nwant %s", kind, i, gotJSON, wantJSON)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files of the native generator")
+
+// generatorCase is an input of both generators
+type generatorCase struct {
+	name string
+	in   Input
+}
+
+// generatorCases returns the fixtures and their variations covering every
+// feature of the generators
+func generatorCases(t *testing.T) []generatorCase {
+	services, instance, instances := loadFixtures(t)
+
+	// variations of the fixtures covering other protocols
+	mixed := instance
+	mixed.Endpoints = []model.Endpoint{
+		{IP: "10.1.1.0", Port: 80, Protocol: model.ProtocolHTTP},
+		{IP: "10.1.1.0", Port: 90, Protocol: model.ProtocolTCP},
+		{IP: "10.1.1.0", Port: 91, Protocol: model.ProtocolGRPC},
+		{IP: "10.1.1.0", Port: 100, Protocol: model.ProtocolMongo},
+	}
+	grpc := append(append([]*model.Service{}, services...), &model.Service{
+		Hostname: "ratings.default.svc.cluster.local",
+		Address:  "10.3.0.0",
+		Ports: model.PortList{
+			{Name: "grpc", Port: 80, Protocol: model.ProtocolGRPC},
+			{Name: "https", Port: 443, Protocol: model.ProtocolHTTPS},
+		},
+		Faults: []*model.Fault{
+			{Match: &model.HTTPMatch{Prefix: "/slow"}, Delay: &model.FaultDelay{Percent: 10, FixedDelay: "2s"}},
+			{SourceLabels: model.Labels{"version": "v1"}, Abort: &model.FaultAbort{Percent: 100, HTTPStatus: 503}},
+			{Abort: &model.FaultAbort{Percent: 50, HTTPStatus: 500}, Delay: &model.FaultDelay{Percent: 5, FixedDelay: "0.5s"}},
+		},
+	}, &model.Service{
+		Hostname: "headless.other.svc.cluster.local",
+		Ports:    model.PortList{{Name: "http2", Port: 8080, Protocol: model.ProtocolHTTP2}},
+	})
+
+	rules := []*model.RouteRule{{
+		Name:      "world",
+		Namespace: "default",
+		Host:      "world.default.svc.cluster.local",
+		Routes: []*model.HTTPRoute{
+			{
+				Match:  &model.HTTPMatch{Path: "/test", Headers: map[string]string{"user": "jason", "cookie": "a"}},
+				Splits: []*model.Split{{Labels: model.Labels{"version": "v2"}}},
+			},
+			{
+				Match: &model.HTTPMatch{Prefix: "/api"},
+				Splits: []*model.Split{
+					{Labels: model.Labels{"version": "v1"}, Weight: 75},
+					{Labels: model.Labels{"version": "v2"}, Weight: 25},
+				},
+			},
+			{Splits: []*model.Split{{Weight: 100}}},
+		},
+	}}
+	subsets := subsetInstances(services, instances, rules)
+
+	// faults on the routes of the rule, overlapping and disjoint with them
+	faults := make([]*model.Service, 0, len(services))
+	for _, service := range services {
+		if service.Hostname == "world.default.svc.cluster.local" {
+			world := *service
+			world.Faults = []*model.Fault{
+				{Match: &model.HTTPMatch{Prefix: "/api/slow"}, Delay: &model.FaultDelay{Percent: 10, FixedDelay: "2s"}},
+				{Match: &model.HTTPMatch{Prefix: "/", Headers: map[string]string{"user": "jason"}}, Abort: &model.FaultAbort{Percent: 100, HTTPStatus: 500}},
+				{Abort: &model.FaultAbort{Percent: 5, HTTPStatus: 503}},
+				{Delay: &model.FaultDelay{Percent: 1, FixedDelay: "0.5s"}},
+			}
+			service = &world
+		}
+		faults = append(faults, service)
+	}
+
+	// ports with every authentication policy and a mesh default of mutual TLS
+	secure := []*model.Service{{
+		Hostname:        "secure.default.svc.cluster.local",
+		Address:         "10.4.0.0",
+		ServiceAccounts: []string{"spiffe://cluster.local/ns/default/sa/secure"},
+		Ports: model.PortList{
+			{Name: "http", Port: 80, Protocol: model.ProtocolHTTP, AuthenticationPolicy: proxyconfig.AuthenticationPolicy_MUTUAL_TLS},
+			{Name: "http-plain", Port: 81, Protocol: model.ProtocolHTTP, AuthenticationPolicy: proxyconfig.AuthenticationPolicy_NONE},
+			{Name: "tcp", Port: 90, Protocol: model.ProtocolTCP, AuthenticationPolicy: proxyconfig.AuthenticationPolicy_INHERIT},
+		},
+	}, {
+		Hostname:     "external.default.svc.cluster.local",
+		ExternalName: "api.example.com",
+		Ports: model.PortList{
+			{Name: "http", Port: 80, Protocol: model.ProtocolHTTP, AuthenticationPolicy: proxyconfig.AuthenticationPolicy_INHERIT},
+			{Name: "http-mtls", Port: 81, Protocol: model.ProtocolHTTP, AuthenticationPolicy: proxyconfig.AuthenticationPolicy_MUTUAL_TLS},
+		},
+	}}
+	secureInstance := instance
+	secureInstance.Endpoints = []model.Endpoint{
+		{IP: "10.1.1.0", Port: 80, Protocol: model.ProtocolHTTP, AuthenticationPolicy: proxyconfig.AuthenticationPolicy_MUTUAL_TLS},
+		{IP: "10.1.1.0", Port: 81, Protocol: model.ProtocolHTTP},
+		{IP: "10.1.1.0", Port: 90, Protocol: model.ProtocolTCP, AuthenticationPolicy: proxyconfig.AuthenticationPolicy_INHERIT},
+	}
+	security := Security{MutualTLS: true, RootCert: "root", SDSCluster: controllerCluster}
+
+	// allow and deny policies over HTTP and TCP endpoints
+	policies := []*model.AuthorizationPolicy{
+		{
+			Name:      "deny-other",
+			Namespace: "default",
+			Action:    model.AuthorizationDeny,
+			Rules:     []*model.AuthorizationRule{{Namespaces: []string{"other"}, Paths: []string{"/admin*"}}},
+		},
+		{
+			Name:      "allow",
+			Namespace: "default",
+			Action:    model.AuthorizationAllow,
+			Rules: []*model.AuthorizationRule{
+				{Principals: []string{"spiffe://cluster.local/ns/default/sa/bookinfo"}, Paths: []string{"/api", "*"}, Methods: []string{"GET"}},
+				{Namespaces: []string{"default"}},
+			},
+		},
+		{
+			Name:      "allow-get",
+			Namespace: "default",
+			Action:    model.AuthorizationAllow,
+			Rules:     []*model.AuthorizationRule{{Methods: []string{"GET"}}},
+		},
+	}
+	authz := Security{TrustDomain: "cluster.local"}
+	authzTLS := Security{MutualTLS: true, RootCert: "root", SDSCluster: controllerCluster, TrustDomain: "cluster.local"}
+
+	// external authorization of a service and of the rest of the namespace
+	authzInstance := instance
+	authzInstance.Endpoints = []model.Endpoint{
+		{IP: "10.1.1.0", Port: 80, Protocol: model.ProtocolHTTP, Service: "hello.default.svc.cluster.local"},
+		{IP: "10.1.1.0", Port: 90, Protocol: model.ProtocolTCP, Service: "world.default.svc.cluster.local"},
+	}
+	authzs := []*model.ExternalAuthorization{
+		{Name: "default", Namespace: "default", Host: "authz.default.svc.cluster.local", Port: "grpc"},
+		{
+			Name:             "hello",
+			Namespace:        "default",
+			Services:         []string{"hello.default.svc.cluster.local"},
+			Host:             "authz.default.svc.cluster.local",
+			Port:             "grpc",
+			Timeout:          "0.5s",
+			FailureModeAllow: true,
+		},
+	}
+
+	// endpoints of several clusters of a multi-cluster registry
+	localities := make(map[string][]model.Endpoint, len(instances))
+	for key, endpoints := range instances {
+		for i, ep := range endpoints {
+			ep.Locality = []string{"west", "", "east"}[i%3]
+			localities[key] = append(localities[key], ep)
+		}
+	}
+
+	return []generatorCase{
+		{"fixtures", Input{Domain: "default.svc.cluster.local", Services: services, Instance: instance, Instances: instances}},
+		{"protocols", Input{Domain: "other.svc.cluster.local", Services: grpc, Instance: mixed, Instances: instances}},
+		{"rules", Input{Domain: "default.svc.cluster.local", Services: services, Instance: instance, Instances: subsets, RouteRules: rules}},
+		{"faults", Input{Domain: "default.svc.cluster.local", Services: faults, Instance: instance, Instances: subsets, RouteRules: rules}},
+		{"mtls", Input{Domain: "default.svc.cluster.local", Services: secure, Instance: secureInstance, Instances: instances, Security: security}},
+		{"rbac", Input{Domain: "default.svc.cluster.local", Services: services, Instance: mixed, Instances: instances,
+			AuthorizationPolicies: policies, Security: authz}},
+		{"rbac-mtls", Input{Domain: "default.svc.cluster.local", Services: services, Instance: secureInstance, Instances: instances,
+			AuthorizationPolicies: policies, Security: authzTLS}},
+		{"authz", Input{Domain: "default.svc.cluster.local", Services: services, Instance: authzInstance, Instances: instances,
+			ExternalAuthorizations: authzs}},
+		{"localities", Input{Domain: "default.svc.cluster.local", Services: services, Instance: instance, Instances: localities}},
+		{"telemetry", Input{Domain: "default.svc.cluster.local", Services: services, Instance: instance, Instances: instances,
+			Telemetry: Telemetry{AccessLogCluster: controllerCluster}}},
+		{"empty", Input{
+			Domain:    "default.svc.cluster.local",
+			Services:  make([]*model.Service, 0),
+			Instance:  model.Instance{Endpoints: make([]model.Endpoint, 0)},
+			Instances: make(map[string][]model.Endpoint),
+		}},
+	}
+}
+
+func TestNativeGeneratorParity(t *testing.T) {
+	program, err := LoadProgram(testScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range generatorCases(t) {
+		t.Run(c.name, func(t *testing.T) {
+			want, err := program.Generate(&c.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := (&NativeGenerator{}).Generate(&c.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareResources(t, "listeners", got.Listeners, want.Listeners)
+			compareResources(t, "routes", got.Routes, want.Routes)
+			compareResources(t, "clusters", got.Clusters, want.Clusters)
+			compareResources(t, "endpoints", got.Endpoints, want.Endpoints)
+		})
+	}
+}
+
+// marshalConfig formats the resources of a config as indented JSON
+func marshalConfig(t *testing.T, out *Config) []byte {
+	marshaler := jsonpb.Marshaler{OrigName: true}
+	marshal := func(resources []cache.Resource) []json.RawMessage {
+		messages := make([]json.RawMessage, 0, len(resources))
+		for _, resource := range resources {
+			message, err := marshaler.MarshalToString(resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, json.RawMessage(message))
+		}
+		return messages
+	}
+	data, err := json.MarshalIndent(map[string][]json.RawMessage{
+		"listeners": marshal(out.Listeners),
+		"routes":    marshal(out.Routes),
+		"clusters":  marshal(out.Clusters),
+		"endpoints": marshal(out.Endpoints),
+	}, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(data, '\n')
+}
+
+// TestNativeGeneratorGolden compares the native generator outputs with the
+// golden files in testdata. Run with -update to regenerate them.
+func TestNativeGeneratorGolden(t *testing.T) {
+	for _, c := range generatorCases(t) {
+		t.Run(c.name, func(t *testing.T) {
+			out, err := (&NativeGenerator{}).Generate(&c.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := marshalConfig(t, out)
+			golden := filepath.Join("testdata", c.name+".golden.json")
+			if *update {
+				if err = ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s, run with -update to regenerate:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestUnsupportedAddress(t *testing.T) {
+	program, err := LoadProgram(testScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, instance, instances := loadFixtures(t)
+	instance.Endpoints = []model.Endpoint{{IP: "fd00::1", Port: 80, Protocol: model.ProtocolHTTP}}
+	in := Input{Domain: "default.svc.cluster.local", Services: services, Instance: instance, Instances: instances}
+	for _, generator := range []ConfigGenerator{program, &NativeGenerator{}} {
+		if _, err := generator.Generate(&in); err == nil || !strings.Contains(err.Error(), "fd00::1") {
+			t.Errorf("%T: got error %v for an IPv6 endpoint", generator, err)
+		}
+	}
+}
+
+func TestDomains(t *testing.T) {
+	service := &model.Service{Hostname: "hello.default.svc.cluster.local", Address: "10.1.0.0"}
+	got := domains(service, 80, "default.svc.cluster.local")
+	want := []string{
+		"hello.default.svc.cluster.local",
+		"hello.default.svc.cluster",
+		"hello.default.svc",
+		"hello.default",
+		"hello",
+		"10.1.0.0",
+		"hello.default.svc.cluster.local:80",
+		"hello.default.svc.cluster:80",
+		"hello.default.svc:80",
+		"hello.default:80",
+		"hello:80",
+		"10.1.0.0:80",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("domains => %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("domains => %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package envoy
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// trackStream associates a stream with the node of its first request
+func (g *Generator) trackStream(stream int64, key string) {
+	if _, exists := g.streams[stream]; exists {
+		return
+	}
+	g.streams[stream] = key
+	g.refs[key]++
+	if _, retired := g.retired[key]; retired {
+		glog.Infof("node %v reconnected", key)
+		delete(g.retired, key)
+	}
+	g.updateNodeMetrics()
+}
+
+// releaseStream retires the node of a closed stream once the node has no
+// streams left
+func (g *Generator) releaseStream(stream int64, now time.Time) {
+	key, exists := g.streams[stream]
+	if !exists {
+		return
+	}
+	delete(g.streams, stream)
+	g.refs[key]--
+	if g.refs[key] <= 0 {
+		glog.Infof("node %v disconnected", key)
+		delete(g.refs, key)
+		g.retired[key] = now
+	}
+	g.updateNodeMetrics()
+}
+
+// collectNodes removes the nodes retired for longer than the grace period
+func (g *Generator) collectNodes(now time.Time) {
+	for key, since := range g.retired {
+		if now.Sub(since) < g.options.NodeGracePeriod {
+			continue
+		}
+		glog.Infof("removing node %v disconnected since %v", key, since)
+		delete(g.retired, key)
+		delete(g.nodes, key)
+		g.cache.ClearSnapshot(key)
+		if g.delta != nil {
+			g.delta.ClearNode(key)
+		}
+		g.mu.Lock()
+		delete(g.status, key)
+		delete(g.identities, key)
+		g.mu.Unlock()
+		if certs, ok := g.options.Certificates.(interface{ Forget(string) }); ok {
+			certs.Forget(key)
+		}
+		nodesCollected.Inc()
+	}
+	g.updateNodeMetrics()
+}
+
+// watchNodes periodically collects the retired nodes until a signal is
+// received
+func (g *Generator) watchNodes(stop <-chan struct{}) {
+	period := g.options.NodeGracePeriod / 2
+	if period < time.Second {
+		period = time.Second
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			g.controller.QueueSchedule(func() {
+				g.collectNodes(now)
+			})
+		}
+	}
+}
+
+func (g *Generator) updateNodeMetrics() {
+	nodesGauge.WithLabelValues("live").Set(float64(len(g.nodes) - len(g.retired)))
+	nodesGauge.WithLabelValues("retired").Set(float64(len(g.retired)))
+}
@@ -0,0 +1,129 @@
+package envoy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/kyessenov/envoymesh/ca"
+	"github.com/kyessenov/envoymesh/memory"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func TestCollectNodes(t *testing.T) {
+	program, err := LoadProgram(testScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, instance, instances := loadFixtures(t)
+
+	g := &Generator{
+		services:        services,
+		instances:       instances,
+		configGenerator: program,
+		options:         GeneratorOptions{NodeGracePeriod: time.Minute},
+		nodes:           make(map[string]*Compiler),
+		streams:         make(map[int64]string),
+		refs:            make(map[string]int),
+		retired:         make(map[string]time.Time),
+		status:          make(map[string]NodeStatus),
+	}
+	g.cache = cache.NewSnapshotCache(true, g, g)
+	authority, err := ca.NewSelfSignedCA("cluster.local", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority.Identity = func(string) (string, error) { return "spiffe://cluster.local/ns/ns2/sa/default", nil }
+	authority.Key = NodeKey
+	g.options.Certificates = authority
+	chain, _, err := authority.Certificate("ns2/pod1/10.1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "ns2/pod1"
+	compiler := NewCompiler(program, "pod1", "ns2", suffix)
+	if _, err = compiler.Update(Input{Services: services, Instance: instance, Instances: instances}); err != nil {
+		t.Fatal(err)
+	}
+	g.nodes[key] = compiler
+	g.push(key, compiler)
+
+	// the node is retired when its last stream closes
+	start := time.Now()
+	g.trackStream(1, key)
+	g.trackStream(2, key)
+	g.trackStream(2, key)
+	g.releaseStream(1, start)
+	if _, retired := g.retired[key]; retired {
+		t.Fatal("node with an open stream must not be retired")
+	}
+	g.releaseStream(2, start)
+	if _, retired := g.retired[key]; !retired {
+		t.Fatal("node without streams must be retired")
+	}
+
+	// a reconnection within the grace period keeps the node
+	g.collectNodes(start.Add(30 * time.Second))
+	if _, exists := g.nodes[key]; !exists {
+		t.Fatal("node removed before the grace period")
+	}
+	g.trackStream(3, key)
+	g.collectNodes(start.Add(2 * time.Minute))
+	if _, exists := g.nodes[key]; !exists {
+		t.Fatal("reconnected node removed")
+	}
+
+	g.releaseStream(3, start.Add(2*time.Minute))
+	g.collectNodes(start.Add(3 * time.Minute))
+	if _, exists := g.nodes[key]; exists {
+		t.Error("node not removed after the grace period")
+	}
+	if _, exists := g.NodeStatus()[key]; exists {
+		t.Error("status of the removed node not cleared")
+	}
+	if again, _, _ := authority.Certificate("ns2/pod1/10.1.1.0"); string(again) == string(chain) {
+		t.Error("certificate of the removed node not forgotten")
+	}
+	if len(g.streams) != 0 || len(g.refs) != 0 || len(g.retired) != 0 {
+		t.Errorf("leaked node state: streams %v, refs %v, retired %v", g.streams, g.refs, g.retired)
+	}
+}
+
+func TestNodeGracePeriodDefault(t *testing.T) {
+	registry := memory.NewRegistry()
+	g, err := NewGenerator(registry, memory.NewConfigStore(memory.Config{}), GeneratorOptions{Native: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.options.NodeGracePeriod != defaultNodeGracePeriod {
+		t.Errorf("got grace period %v, want the default %v", g.options.NodeGracePeriod, defaultNodeGracePeriod)
+	}
+
+	// a node disconnected for a moment is kept
+	start := time.Now()
+	g.nodes["ns2/pod1"] = NewCompiler(g.configGenerator, "pod1", "ns2", suffix)
+	g.trackStream(1, "ns2/pod1")
+	g.releaseStream(1, start)
+	g.collectNodes(start.Add(time.Second))
+	if _, exists := g.nodes["ns2/pod1"]; !exists {
+		t.Error("node removed right after disconnecting")
+	}
+}
+
+func TestIPv4Endpoints(t *testing.T) {
+	endpoints := []model.Endpoint{
+		{IP: "10.1.1.0", Port: 80},
+		{IP: "fd00::1", Port: 80},
+		{IP: "db.example.com", Port: 5432},
+		{IP: "10.1.1.0", Port: 8080},
+	}
+	got := ipv4Endpoints("ns1/pod1", endpoints)
+	want := []model.Endpoint{endpoints[0], endpoints[3]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got endpoints %v, want %v", got, want)
+	}
+	if endpoints[1].IP != "fd00::1" {
+		t.Error("registry endpoints modified")
+	}
+}
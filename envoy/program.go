@@ -0,0 +1,168 @@
+package envoy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/gogo/protobuf/jsonpb"
+	jsonnet "github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+type output struct {
+	Listeners []interface{} `json:"listeners"`
+	Routes    []interface{} `json:"routes"`
+	Clusters  []interface{} `json:"clusters"`
+	Endpoints []interface{} `json:"endpoints"`
+}
+
+// Program is a parsed jsonnet script shared by all compilers
+type Program struct {
+	name   string
+	source string
+	node   ast.Node
+
+	// VM evaluation binds top-level arguments in place
+	mu sync.Mutex
+	vm *jsonnet.VM
+}
+
+// NewProgram parses the script once for repeated evaluation
+func NewProgram(name, script string) (*Program, error) {
+	node, err := jsonnet.SnippetToAST(name, script)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{
+		name:   name,
+		source: script,
+		node:   node,
+		vm:     jsonnet.MakeVM(),
+	}, nil
+}
+
+// LoadProgram reads and parses the script from a file
+func LoadProgram(path string) (*Program, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewProgram(path, string(content))
+}
+
+// Evaluate binds the top-level arguments (code and string variables) and
+// evaluates the program
+func (p *Program) Evaluate(code, vars map[string]string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, value := range code {
+		p.vm.TLACode(key, value)
+	}
+	for key, value := range vars {
+		p.vm.TLAVar(key, value)
+	}
+	return p.vm.Evaluate(p.node)
+}
+
+// Generate evaluates the program with the input bound to the top-level
+// arguments and parses the resources from the output
+func (p *Program) Generate(in *Input) (*Config, error) {
+	servicesJSON, err := json.Marshal(in.Services)
+	if err != nil {
+		return nil, err
+	}
+	instanceJSON, err := json.Marshal(in.Instance)
+	if err != nil {
+		return nil, err
+	}
+	instancesJSON, err := json.Marshal(in.Instances)
+	if err != nil {
+		return nil, err
+	}
+	rules := in.RouteRules
+	if rules == nil {
+		rules = make([]*model.RouteRule, 0)
+	}
+	rulesJSON, err := json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+	securityJSON, err := json.Marshal(in.Security)
+	if err != nil {
+		return nil, err
+	}
+	telemetryJSON, err := json.Marshal(in.Telemetry)
+	if err != nil {
+		return nil, err
+	}
+	policies := in.AuthorizationPolicies
+	if policies == nil {
+		policies = make([]*model.AuthorizationPolicy, 0)
+	}
+	policiesJSON, err := json.Marshal(policies)
+	if err != nil {
+		return nil, err
+	}
+	authzs := in.ExternalAuthorizations
+	if authzs == nil {
+		authzs = make([]*model.ExternalAuthorization, 0)
+	}
+	authzsJSON, err := json.Marshal(authzs)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := p.Evaluate(map[string]string{
+		"services":  string(servicesJSON),
+		"instance":  string(instanceJSON),
+		"instances": string(instancesJSON),
+		"rules":     string(rulesJSON),
+		"security":  string(securityJSON),
+		"policies":  string(policiesJSON),
+		"authz":     string(authzsJSON),
+		"telemetry": string(telemetryJSON),
+	}, map[string]string{
+		"domain": in.Domain,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := output{}
+	if err := json.Unmarshal([]byte(result), &out); err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if config.Clusters, err = convertResources(out.Clusters, func() cache.Resource { return &v2.Cluster{} }); err != nil {
+		return nil, err
+	}
+	if config.Routes, err = convertResources(out.Routes, func() cache.Resource { return &v2.RouteConfiguration{} }); err != nil {
+		return nil, err
+	}
+	if config.Listeners, err = convertResources(out.Listeners, func() cache.Resource { return &v2.Listener{} }); err != nil {
+		return nil, err
+	}
+	if config.Endpoints, err = convertResources(out.Endpoints, func() cache.Resource { return &v2.ClusterLoadAssignment{} }); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// convertResources parses JSON values into protos
+func convertResources(values []interface{}, create func() cache.Resource) ([]cache.Resource, error) {
+	out := make([]cache.Resource, 0, len(values))
+	for _, value := range values {
+		resource := create()
+		s, _ := json.Marshal(value)
+		if err := jsonpb.UnmarshalString(string(s), resource); err != nil {
+			return nil, err
+		}
+		out = append(out, resource)
+	}
+	return out, nil
+}
@@ -0,0 +1,170 @@
+package envoy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/golang/glog"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// pathMatcher matches the path header exactly or by prefix for paths ending
+// with "*"
+func pathMatcher(path string) object {
+	switch {
+	case path == "*":
+		return object{"name": ":path", "prefix_match": "/"}
+	case strings.HasSuffix(path, "*"):
+		return object{"name": ":path", "prefix_match": strings.TrimSuffix(path, "*")}
+	default:
+		return object{"name": ":path", "exact_match": path}
+	}
+}
+
+func rbacPermission(rule *model.AuthorizationRule, http bool) object {
+	conditions := make([]interface{}, 0)
+	if http && len(rule.Paths) > 0 {
+		paths := make([]interface{}, 0, len(rule.Paths))
+		for _, path := range rule.Paths {
+			paths = append(paths, object{"header": pathMatcher(path)})
+		}
+		conditions = append(conditions, object{"or_rules": object{"rules": paths}})
+	}
+	if http && len(rule.Methods) > 0 {
+		methods := make([]interface{}, 0, len(rule.Methods))
+		for _, method := range rule.Methods {
+			methods = append(methods, object{"header": object{"name": ":method", "exact_match": method}})
+		}
+		conditions = append(conditions, object{"or_rules": object{"rules": methods}})
+	}
+	if len(conditions) == 0 {
+		return object{"any": true}
+	}
+	return object{"and_rules": object{"rules": conditions}}
+}
+
+// rbacPrincipal matches the identities of the peer. Identities are only
+// known on ports with mutual TLS, so deny rules match every peer on other
+// ports rather than none.
+func rbacPrincipal(rule *model.AuthorizationRule, action model.AuthorizationAction, mtls bool, security Security) object {
+	if !mtls && action == model.AuthorizationDeny {
+		return object{"any": true}
+	}
+	conditions := make([]interface{}, 0)
+	if len(rule.Principals) > 0 {
+		ids := make([]interface{}, 0, len(rule.Principals))
+		for _, principal := range rule.Principals {
+			ids = append(ids, object{"authenticated": object{"principal_name": object{"exact": principal}}})
+		}
+		conditions = append(conditions, object{"or_ids": object{"ids": ids}})
+	}
+	if len(rule.Namespaces) > 0 {
+		ids := make([]interface{}, 0, len(rule.Namespaces))
+		for _, namespace := range rule.Namespaces {
+			prefix := fmt.Sprintf("spiffe://%s/ns/%s/sa/", security.TrustDomain, namespace)
+			ids = append(ids, object{"authenticated": object{"principal_name": object{"prefix": prefix}}})
+		}
+		conditions = append(conditions, object{"or_ids": object{"ids": ids}})
+	}
+	if len(conditions) == 0 {
+		return object{"any": true}
+	}
+	return object{"and_ids": object{"ids": conditions}}
+}
+
+// httpOnly is true if the policy has rules and all of them only apply to
+// HTTP, so it does not restrict TCP connections
+func httpOnly(policy *model.AuthorizationPolicy) bool {
+	for _, rule := range policy.Rules {
+		if !rule.HTTPOnly() {
+			return false
+		}
+	}
+	return len(policy.Rules) > 0
+}
+
+// rbacFilters compiles the authorization policies of a workload into RBAC
+// filters. Deny policies are enforced before allow policies. Rules with HTTP
+// conditions are dropped from TCP allow policies, allow policies with only
+// such rules do not apply to TCP, and the HTTP conditions are ignored in TCP
+// deny policies. Without mutual TLS, the identities in deny rules match
+// every peer.
+func rbacFilters(policies []*model.AuthorizationPolicy, http, mtls bool, security Security, prefix string) []object {
+	out := make([]object, 0)
+	for _, action := range []model.AuthorizationAction{model.AuthorizationDeny, model.AuthorizationAllow} {
+		found := false
+		rules := object{}
+		for _, policy := range policies {
+			if policy.Action != action || !http && action == model.AuthorizationAllow && httpOnly(policy) {
+				continue
+			}
+			found = true
+			for i, rule := range policy.Rules {
+				if !http && action == model.AuthorizationAllow && rule.HTTPOnly() {
+					continue
+				}
+				rules[fmt.Sprintf("%s/%s/%d", policy.Namespace, policy.Name, i)] = object{
+					"permissions": []interface{}{rbacPermission(rule, http)},
+					"principals":  []interface{}{rbacPrincipal(rule, action, mtls, security)},
+				}
+			}
+		}
+		if !found {
+			continue
+		}
+
+		name := "envoy.filters.http.rbac"
+		config := object{"rules": object{"action": string(action), "policies": rules}}
+		if !http {
+			name = "envoy.filters.network.rbac"
+			config["stat_prefix"] = prefix
+		}
+		out = append(out, object{"name": name, "config": config})
+	}
+	return out
+}
+
+// warnPolicies logs the authorization policies that cannot be enforced as
+// written on the endpoints of a workload
+func warnPolicies(uid string, policies []*model.AuthorizationPolicy, endpoints []model.Endpoint, security Security) {
+	for _, ep := range endpoints {
+		for _, policy := range policies {
+			if !mutualTLS(ep.AuthenticationPolicy, security) && identityBased(policy) {
+				if policy.Action == model.AuthorizationDeny {
+					glog.Warningf("%s port %d: deny policy %s/%s matches peer identities without mutual TLS, denying every peer",
+						uid, ep.Port, policy.Namespace, policy.Name)
+				} else {
+					glog.Warningf("%s port %d: allow policy %s/%s matches peer identities without mutual TLS, which never match",
+						uid, ep.Port, policy.Namespace, policy.Name)
+				}
+			}
+			if !ep.Protocol.IsHTTP() && policy.Action == model.AuthorizationAllow && httpOnly(policy) {
+				glog.Warningf("%s port %d: allow policy %s/%s only has HTTP rules and does not apply to TCP",
+					uid, ep.Port, policy.Namespace, policy.Name)
+			}
+		}
+	}
+}
+
+// identityBased is true if a rule of the policy matches peer identities
+func identityBased(policy *model.AuthorizationPolicy) bool {
+	for _, rule := range policy.Rules {
+		if len(rule.Principals) > 0 || len(rule.Namespaces) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// networkFilters converts filter descriptions to listener filters
+func networkFilters(filters []object) []listener.Filter {
+	out := make([]listener.Filter, 0, len(filters))
+	for _, filter := range filters {
+		out = append(out, listener.Filter{
+			Name:   filter["name"].(string),
+			Config: filter["config"].(object).toStruct(),
+		})
+	}
+	return out
+}
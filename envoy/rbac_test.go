@@ -0,0 +1,127 @@
+package envoy
+
+import (
+	"testing"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func TestRBACFilters(t *testing.T) {
+	policies := []*model.AuthorizationPolicy{
+		{
+			Name:      "allow",
+			Namespace: "default",
+			Action:    model.AuthorizationAllow,
+			Rules: []*model.AuthorizationRule{
+				{Paths: []string{"/api*"}},
+				{Principals: []string{"spiffe://cluster.local/ns/default/sa/bookinfo"}},
+			},
+		},
+		{
+			Name:      "deny",
+			Namespace: "default",
+			Action:    model.AuthorizationDeny,
+			Rules:     []*model.AuthorizationRule{{Namespaces: []string{"other"}}},
+		},
+	}
+	security := Security{TrustDomain: "cluster.local"}
+
+	http := rbacFilters(policies, true, true, security, "in_HTTP_80")
+	if len(http) != 2 {
+		t.Fatalf("got %d HTTP filters, want 2", len(http))
+	}
+	for i, action := range []string{"DENY", "ALLOW"} {
+		if http[i]["name"] != "envoy.filters.http.rbac" {
+			t.Errorf("filter %d is %v", i, http[i]["name"])
+		}
+		rules := http[i]["config"].(object)["rules"].(object)
+		if rules["action"] != action {
+			t.Errorf("filter %d action %v, want %s", i, rules["action"], action)
+		}
+	}
+	allow := http[1]["config"].(object)["rules"].(object)["policies"].(object)
+	if len(allow) != 2 {
+		t.Errorf("got %d HTTP allow policies, want 2", len(allow))
+	}
+	permission := allow["default/allow/0"].(object)["permissions"].([]interface{})[0].(object)
+	header := permission["and_rules"].(object)["rules"].([]interface{})[0].(object)["or_rules"].(object)["rules"].([]interface{})[0].(object)["header"].(object)
+	if header["prefix_match"] != "/api" {
+		t.Errorf("got path matcher %v, want prefix /api", header)
+	}
+
+	// TCP allow policies drop the rules with HTTP conditions
+	tcp := rbacFilters(policies, false, true, security, "in_TCP_90")
+	if len(tcp) != 2 {
+		t.Fatalf("got %d TCP filters, want 2", len(tcp))
+	}
+	config := tcp[1]["config"].(object)
+	if tcp[1]["name"] != "envoy.filters.network.rbac" || config["stat_prefix"] != "in_TCP_90" {
+		t.Errorf("unexpected TCP filter %v", tcp[1])
+	}
+	allow = config["rules"].(object)["policies"].(object)
+	if _, exists := allow["default/allow/0"]; exists || len(allow) != 1 {
+		t.Errorf("unexpected TCP allow policies %v", allow)
+	}
+	deny := tcp[0]["config"].(object)["rules"].(object)["policies"].(object)
+	principal := deny["default/deny/0"].(object)["principals"].([]interface{})[0].(object)
+	id := principal["and_ids"].(object)["ids"].([]interface{})[0].(object)["or_ids"].(object)["ids"].([]interface{})[0].(object)
+	if name := id["authenticated"].(object)["principal_name"].(object)["prefix"]; name != "spiffe://cluster.local/ns/other/sa/" {
+		t.Errorf("got namespace principal %v", name)
+	}
+
+	if filters := rbacFilters(nil, true, true, security, "in_HTTP_80"); len(filters) != 0 {
+		t.Errorf("got %d filters without policies", len(filters))
+	}
+}
+
+func TestRBACFiltersWithoutMutualTLS(t *testing.T) {
+	policies := []*model.AuthorizationPolicy{
+		{
+			Name:      "deny",
+			Namespace: "default",
+			Action:    model.AuthorizationDeny,
+			Rules:     []*model.AuthorizationRule{{Namespaces: []string{"other"}, Methods: []string{"DELETE"}}},
+		},
+	}
+	security := Security{TrustDomain: "cluster.local"}
+
+	// identities are unknown, so the deny rule matches every peer
+	http := rbacFilters(policies, true, false, security, "in_HTTP_80")
+	if len(http) != 1 {
+		t.Fatalf("got %d HTTP filters, want 1", len(http))
+	}
+	deny := http[0]["config"].(object)["rules"].(object)["policies"].(object)["default/deny/0"].(object)
+	if principal := deny["principals"].([]interface{})[0].(object); principal["any"] != true {
+		t.Errorf("got deny principal %v without mutual TLS, want any", principal)
+	}
+	if permission := deny["permissions"].([]interface{})[0].(object); permission["any"] == true {
+		t.Errorf("got deny permission %v, want the method condition", permission)
+	}
+}
+
+func TestRBACFiltersHTTPOnlyAllow(t *testing.T) {
+	policies := []*model.AuthorizationPolicy{
+		{
+			Name:      "allow",
+			Namespace: "default",
+			Action:    model.AuthorizationAllow,
+			Rules:     []*model.AuthorizationRule{{Paths: []string{"/api*"}}, {Methods: []string{"GET"}}},
+		},
+	}
+	security := Security{TrustDomain: "cluster.local"}
+
+	// the policy does not apply to TCP rather than denying all connections
+	if tcp := rbacFilters(policies, false, true, security, "in_TCP_90"); len(tcp) != 0 {
+		t.Errorf("got TCP filters %v for an allow policy with only HTTP rules", tcp)
+	}
+	if http := rbacFilters(policies, true, true, security, "in_HTTP_80"); len(http) != 1 {
+		t.Errorf("got %d HTTP filters, want 1", len(http))
+	}
+
+	// an allow policy without rules still denies all connections
+	empty := []*model.AuthorizationPolicy{{Name: "none", Namespace: "default", Action: model.AuthorizationAllow}}
+	tcp := rbacFilters(empty, false, true, security, "in_TCP_90")
+	if len(tcp) != 1 || len(tcp[0]["config"].(object)["rules"].(object)["policies"].(object)) != 0 {
+		t.Errorf("got TCP filters %v for an allow policy without rules", tcp)
+	}
+}
@@ -0,0 +1,56 @@
+package envoy
+
+import (
+	"strings"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// selectSidecars returns the sidecars of a workload
+func selectSidecars(sidecars []*model.Sidecar, namespace string, labels model.Labels) []*model.Sidecar {
+	out := make([]*model.Sidecar, 0)
+	for _, sidecar := range sidecars {
+		if sidecar.AppliesTo(namespace, labels) {
+			out = append(out, sidecar)
+		}
+	}
+	return out
+}
+
+// scopeInput restricts the services and instances of a workload to the
+// dependencies declared by its sidecars and the external authorization
+// services of its namespace. The input of workloads without sidecars is
+// unchanged.
+func scopeInput(in Input, sidecars []*model.Sidecar, namespace string) Input {
+	if len(sidecars) == 0 {
+		return in
+	}
+
+	hosts := make(map[string]bool)
+	for _, authz := range selectAuthorizations(in.ExternalAuthorizations, namespace) {
+		hosts[authz.Host] = true
+	}
+	services := make([]*model.Service, 0)
+	for _, service := range in.Services {
+		imported := hosts[service.Hostname]
+		for _, sidecar := range sidecars {
+			imported = imported || sidecar.Imports(service)
+		}
+		if imported {
+			hosts[service.Hostname] = true
+			services = append(services, service)
+		}
+	}
+
+	// instances are keyed by "hostname:port", followed by the subset labels
+	instances := make(map[string][]model.Endpoint)
+	for key, endpoints := range in.Instances {
+		if hosts[strings.SplitN(key, ":", 2)[0]] {
+			instances[key] = endpoints
+		}
+	}
+
+	in.Services = services
+	in.Instances = instances
+	return in
+}
@@ -0,0 +1,103 @@
+package envoy
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func TestScopeInput(t *testing.T) {
+	service := func(name, namespace string) *model.Service {
+		return &model.Service{
+			Hostname:  name + "." + namespace + ".svc.cluster.local",
+			Namespace: namespace,
+			Ports:     model.PortList{{Name: "http", Port: 80, Protocol: model.ProtocolHTTP}},
+		}
+	}
+	in := Input{
+		Services: []*model.Service{
+			service("reviews", "default"),
+			service("ratings", "default"),
+			service("authz", "auth"),
+			service("db", "other"),
+		},
+		Instances: map[string][]model.Endpoint{
+			"reviews.default.svc.cluster.local:http":            {{IP: "10.1.1.0", Port: 80}},
+			"reviews.default.svc.cluster.local:http|version=v1": {{IP: "10.1.1.0", Port: 80}},
+			"ratings.default.svc.cluster.local:http":            {{IP: "10.1.1.1", Port: 80}},
+			"authz.auth.svc.cluster.local:http":                 {{IP: "10.1.1.2", Port: 80}},
+			"db.other.svc.cluster.local:http":                   {{IP: "10.1.1.3", Port: 80}},
+		},
+		ExternalAuthorizations: []*model.ExternalAuthorization{
+			{Name: "authz", Namespace: "default", Host: "authz.auth.svc.cluster.local", Port: "http"},
+		},
+	}
+	sidecars := []*model.Sidecar{
+		{Name: "productpage", Namespace: "default", Selector: model.Labels{"app": "productpage"},
+			Hosts: []string{"default/reviews.default.svc.cluster.local"}},
+		{Name: "all", Namespace: "default", Hosts: []string{"*/ratings.default.svc.cluster.local"}},
+		{Name: "other", Namespace: "other", Hosts: []string{"other/*"}},
+		{Name: "suffix", Namespace: "suffix", Hosts: []string{"*/*.default.svc.cluster.local"}},
+	}
+
+	cases := []struct {
+		namespace string
+		labels    model.Labels
+		want      []string
+	}{
+		// sidecars of a workload are combined, and external authorization
+		// services are always included
+		{"default", model.Labels{"app": "productpage"}, []string{
+			"authz.auth.svc.cluster.local:http",
+			"ratings.default.svc.cluster.local:http",
+			"reviews.default.svc.cluster.local:http",
+			"reviews.default.svc.cluster.local:http|version=v1",
+		}},
+		{"default", model.Labels{"app": "reviews"}, []string{
+			"authz.auth.svc.cluster.local:http",
+			"ratings.default.svc.cluster.local:http",
+		}},
+		{"other", nil, []string{"db.other.svc.cluster.local:http"}},
+		// wildcard hostnames match a domain suffix
+		{"suffix", nil, []string{
+			"ratings.default.svc.cluster.local:http",
+			"reviews.default.svc.cluster.local:http",
+			"reviews.default.svc.cluster.local:http|version=v1",
+		}},
+		// workloads without sidecars depend on all services
+		{"auth", nil, []string{
+			"authz.auth.svc.cluster.local:http",
+			"db.other.svc.cluster.local:http",
+			"ratings.default.svc.cluster.local:http",
+			"reviews.default.svc.cluster.local:http",
+			"reviews.default.svc.cluster.local:http|version=v1",
+		}},
+	}
+	for _, c := range cases {
+		out := scopeInput(in, selectSidecars(sidecars, c.namespace, c.labels), c.namespace)
+		keys := make([]string, 0, len(out.Instances))
+		for key := range out.Instances {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, c.want) {
+			t.Errorf("instances of %s/%v => %v, want %v", c.namespace, c.labels, keys, c.want)
+		}
+		hosts := make(map[string]bool)
+		for _, key := range c.want {
+			hosts[strings.SplitN(key, ":", 2)[0]] = true
+		}
+		for _, service := range out.Services {
+			if !hosts[service.Hostname] {
+				t.Errorf("services of %s/%v include %q", c.namespace, c.labels, service.Hostname)
+			}
+			delete(hosts, service.Hostname)
+		}
+		if len(hosts) > 0 {
+			t.Errorf("services of %s/%v miss %v", c.namespace, c.labels, hosts)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package envoy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// watchScript polls the script file for changes until a signal is received.
+// ConfigMap volumes are updated by an atomic symlink swap, so a full read
+// always observes a consistent version of the script. A script rejected
+// because some nodes fail to compile with their inputs is retried on every
+// tick until it is applied or replaced, since the inputs may change.
+func (g *Generator) watchScript(stop <-chan struct{}) {
+	ticker := time.NewTicker(g.options.ScriptPollPeriod)
+	defer ticker.Stop()
+
+	// content that failed to parse, which is not retried
+	var invalid string
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			content, err := ioutil.ReadFile(g.options.Script)
+			if err != nil {
+				glog.Warningf("failed to read script %q: %v", g.options.Script, err)
+				continue
+			}
+			g.mu.RLock()
+			applied := g.script
+			g.mu.RUnlock()
+			if string(content) == applied || string(content) == invalid {
+				continue
+			}
+
+			glog.Infof("script %q differs from the applied version, reloading", g.options.Script)
+			program, err := NewProgram(g.options.Script, string(content))
+			if err != nil {
+				invalid = string(content)
+				g.setScriptError(err)
+				continue
+			}
+			invalid = ""
+			g.controller.QueueSchedule(func() {
+				g.setScriptError(g.UpdateProgram(program))
+			})
+		}
+	}
+}
+
+// UpdateProgram validates the program by compiling all nodes with their
+// current inputs and switches to it only if every node succeeds
+func (g *Generator) UpdateProgram(program *Program) error {
+	compilers := make(map[string]*Compiler, len(g.nodes))
+	for key, compiler := range g.nodes {
+		next, err := compiler.recompile(program)
+		if err != nil {
+			return fmt.Errorf("node %s: %v", key, err)
+		}
+		compilers[key] = next
+	}
+
+	// validate against the mesh state even without any connected nodes
+	if len(g.nodes) == 0 {
+		if _, err := NewCompiler(program, "", "default", suffix).Update(
+			g.input(model.Instance{Endpoints: make([]model.Endpoint, 0)})); err != nil {
+			return err
+		}
+	}
+
+	// nodes that failed with the previous script are compiled from their
+	// last inputs and receive their first good snapshot
+	g.configGenerator = program
+	g.mu.Lock()
+	g.script = program.source
+	g.mu.Unlock()
+	for key, compiler := range compilers {
+		g.nodes[key] = compiler
+		glog.Infof("update node %v with new script (count=%d)", key, g.count+1)
+		g.push(key, compiler)
+	}
+	return nil
+}
+
+// ScriptError returns the error from the last script reload, if the
+// generator keeps serving a previous version of the script
+func (g *Generator) ScriptError() error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.scriptErr
+}
+
+func (g *Generator) setScriptError(err error) {
+	if err != nil {
+		glog.Errorf("rejected script %q, serving the last good version: %v", g.options.Script, err)
+	}
+	g.mu.Lock()
+	g.scriptErr = err
+	g.mu.Unlock()
+}
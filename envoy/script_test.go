@@ -0,0 +1,142 @@
+package envoy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/kyessenov/envoymesh/memory"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func TestUpdateProgram(t *testing.T) {
+	program, err := LoadProgram(testScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, instance, instances := loadFixtures(t)
+
+	g := &Generator{
+		services:        services,
+		instances:       instances,
+		configGenerator: program,
+		nodes:           make(map[string]*Compiler),
+		status:          make(map[string]NodeStatus),
+	}
+	g.cache = cache.NewSnapshotCache(true, g, g)
+	compiler := NewCompiler(program, "pod1", "ns2", suffix)
+	if _, err = compiler.Update(Input{Services: services, Instance: instance, Instances: instances}); err != nil {
+		t.Fatal(err)
+	}
+	g.nodes["ns2/pod1"] = compiler
+	g.push("ns2/pod1", compiler)
+
+	// listener with an unknown field fails to convert
+	broken, err := NewProgram("broken.jsonnet", `
+function(services, instance, instances, rules, policies, authz, security, telemetry, domain)
+    { listeners: [{ name: 'x', unknown_field: true }], routes: [], clusters: [], endpoints: [] }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.UpdateProgram(broken); err == nil {
+		t.Error("expected an error for the broken script")
+	}
+	if g.configGenerator != program || g.nodes["ns2/pod1"] != compiler {
+		t.Error("broken script must not replace the last good version")
+	}
+
+	empty, err := NewProgram("empty.jsonnet", `
+function(services, instance, instances, rules, policies, authz, security, telemetry, domain)
+    { listeners: [], routes: [], clusters: [], endpoints: [] }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.UpdateProgram(empty); err != nil {
+		t.Fatal(err)
+	}
+	if g.configGenerator != empty {
+		t.Error("valid script must replace the program")
+	}
+	if next := g.nodes["ns2/pod1"]; len(next.listeners) != 0 || next.uid != compiler.uid {
+		t.Errorf("got node compiler %v after reload", next)
+	}
+	if g.count != 2 {
+		t.Errorf("got %d snapshots pushed after reload, want 2", g.count)
+	}
+	if status := g.NodeStatus()["ns2/pod1"]; status.Version != "2" || status.Error != "" {
+		t.Errorf("got node status %v after reload", status)
+	}
+
+	// a node that failed with the previous script gets its first snapshot
+	// compiled from its last inputs
+	failed := NewCompiler(broken, "pod2", "ns2", suffix)
+	if _, err = failed.Update(Input{Services: services, Instance: instance, Instances: instances}); err == nil {
+		t.Fatal("expected an error for the broken script")
+	}
+	g.nodes["ns2/pod2"] = failed
+	g.status["ns2/pod2"] = NodeStatus{Error: "failed", Failures: 1}
+	if err = g.UpdateProgram(program); err != nil {
+		t.Fatal(err)
+	}
+	if next := g.nodes["ns2/pod2"]; len(next.listeners) == 0 || len(next.clusters) == 0 {
+		t.Errorf("got empty outputs for the failed node after reload")
+	}
+	if status := g.NodeStatus()["ns2/pod2"]; status.Version == "" || status.Error != "" {
+		t.Errorf("got node status %v of the failed node after reload", status)
+	}
+}
+
+func TestWatchScriptRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "envoy.jsonnet")
+	header := "function(services, instance, instances, rules, policies, authz, security, telemetry, domain)\n"
+	empty := "{ listeners: [], routes: [], clusters: [], endpoints: [] }"
+	if err = ioutil.WriteFile(path, []byte(header+empty), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := memory.NewRegistry()
+	registry.SetServices([]*model.Service{{Hostname: "a.com", Namespace: "default"}})
+	g, err := NewGenerator(registry, memory.NewConfigStore(memory.Config{}), GeneratorOptions{
+		Script:           path,
+		ScriptPollPeriod: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go g.Run(stop)
+
+	wait := func(done func() bool, what string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the script fails with the services of the mesh
+	strict := header + "if std.length(services) > 0 then error 'unexpected services' else " + empty
+	if err = ioutil.WriteFile(path, []byte(strict), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wait(func() bool { return g.ScriptError() != nil }, "the script to be rejected")
+
+	// the rejected script is applied once the inputs change
+	registry.SetServices([]*model.Service{})
+	wait(func() bool {
+		g.mu.RLock()
+		defer g.mu.RUnlock()
+		return g.script == strict && g.scriptErr == nil
+	}, "the script to be applied")
+}
@@ -0,0 +1,287 @@
+package envoy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// secretType is the type URL of SDS resources
+	secretType = "type.googleapis.com/envoy.api.v2.auth.Secret"
+
+	// controllerCluster is the bootstrap cluster of the controller serving
+	// ADS, SDS, and the access log service
+	controllerCluster = "ads"
+)
+
+// CertificateProvider supplies the mesh root and the workload certificates
+type CertificateProvider interface {
+	// RootCert returns the PEM-encoded root certificate of the mesh
+	RootCert() ([]byte, error)
+
+	// Certificate returns the PEM-encoded certificate chain and private key
+	// of a node
+	Certificate(node string) (chain, key []byte, err error)
+}
+
+// FileCertificates reads certificates from a directory, e.g. a mounted
+// Kubernetes secret. All nodes share the same certificate.
+type FileCertificates struct {
+	Dir string
+}
+
+// RootCert implements CertificateProvider
+func (f *FileCertificates) RootCert() ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(f.Dir, "root-cert.pem"))
+}
+
+// Certificate implements CertificateProvider
+func (f *FileCertificates) Certificate(string) ([]byte, []byte, error) {
+	chain, err := ioutil.ReadFile(filepath.Join(f.Dir, "cert-chain.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ioutil.ReadFile(filepath.Join(f.Dir, "key.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, key, nil
+}
+
+// Authenticator verifies that the proxy requesting secrets is the workload
+// of its node ID
+type Authenticator interface {
+	Authenticate(node *core.Node) error
+}
+
+// SecretServer delivers workload certificates to Envoy over SDS. The node
+// of every stream and fetch is authenticated before issuing certificates,
+// and a stream keeps the node it was authenticated for.
+type SecretServer struct {
+	provider      CertificateProvider
+	authenticator Authenticator
+
+	mu      sync.Mutex
+	watches map[chan struct{}]bool
+}
+
+// NewSecretServer creates an SDS server for the certificates of the
+// authenticated nodes
+func NewSecretServer(provider CertificateProvider, authenticator Authenticator) *SecretServer {
+	return &SecretServer{
+		provider:      provider,
+		authenticator: authenticator,
+		watches:       make(map[chan struct{}]bool),
+	}
+}
+
+// authenticate rejects unauthenticated nodes with a gRPC error
+func (s *SecretServer) authenticate(node *core.Node) error {
+	if node == nil {
+		return status.Error(codes.InvalidArgument, "missing node")
+	}
+	if err := s.authenticator.Authenticate(node); err != nil {
+		glog.Warningf("rejected secrets request of node %q: %v", node.GetId(), err)
+		return status.Errorf(codes.Unauthenticated, "node %q: %v", node.GetId(), err)
+	}
+	return nil
+}
+
+// Run refreshes the streams periodically to pick up rotated certificates
+func (s *SecretServer) Run(stop <-chan struct{}, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Refresh()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Refresh notifies the streams to re-send changed certificates
+func (s *SecretServer) Refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for watch := range s.watches {
+		select {
+		case watch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *SecretServer) watch() chan struct{} {
+	watch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.watches[watch] = true
+	s.mu.Unlock()
+	return watch
+}
+
+func (s *SecretServer) cancel(watch chan struct{}) {
+	s.mu.Lock()
+	delete(s.watches, watch)
+	s.mu.Unlock()
+}
+
+// response produces the requested secrets of a node
+func (s *SecretServer) response(node *core.Node, names []string) (*v2.DiscoveryResponse, error) {
+	if len(names) == 0 {
+		names = []string{workloadSecret}
+	}
+	hash := sha256.New()
+	out := &v2.DiscoveryResponse{TypeUrl: secretType}
+	for _, name := range names {
+		if name != workloadSecret {
+			glog.Warningf("unknown secret %q requested by node %v", name, node.GetId())
+			continue
+		}
+		chain, key, err := s.provider.Certificate(node.GetId())
+		if err != nil {
+			return nil, err
+		}
+		// a re-issued key changes the version even with the same chain
+		hash.Write(chain)
+		hash.Write(key)
+		secret := &auth.Secret{
+			Name: name,
+			Type: &auth.Secret_TlsCertificate{
+				TlsCertificate: &auth.TlsCertificate{
+					CertificateChain: &core.DataSource{Specifier: &core.DataSource_InlineBytes{InlineBytes: chain}},
+					PrivateKey:       &core.DataSource{Specifier: &core.DataSource_InlineBytes{InlineBytes: key}},
+				},
+			},
+		}
+		data, err := types.MarshalAny(secret)
+		if err != nil {
+			return nil, err
+		}
+		out.Resources = append(out.Resources, *data)
+	}
+	out.VersionInfo = hex.EncodeToString(hash.Sum(nil)[:8])
+	return out, nil
+}
+
+// StreamSecrets implements SecretDiscoveryServiceServer
+func (s *SecretServer) StreamSecrets(stream discovery.SecretDiscoveryService_StreamSecretsServer) error {
+	ctx := stream.Context()
+	requests := make(chan *v2.DiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	watch := s.watch()
+	defer s.cancel(watch)
+
+	var last *v2.DiscoveryRequest
+	var sent *v2.DiscoveryResponse
+	nonce := 0
+	send := func(force bool) error {
+		resp, err := s.response(last.Node, last.ResourceNames)
+		if err != nil {
+			return err
+		}
+		if !force && sent != nil && sent.VersionInfo == resp.VersionInfo {
+			return nil
+		}
+		nonce++
+		resp.Nonce = fmt.Sprintf("%d", nonce)
+		sent = resp
+		return stream.Send(resp)
+	}
+
+	for {
+		select {
+		case req := <-requests:
+			if req.ErrorDetail != nil {
+				glog.Warningf("node %v rejected secrets version %q: %s",
+					req.Node.GetId(), req.VersionInfo, req.ErrorDetail.Message)
+			}
+			// the node of the first request is authenticated, and later
+			// requests may only repeat it
+			if last == nil {
+				if err := s.authenticate(req.Node); err != nil {
+					return err
+				}
+			} else if req.Node == nil {
+				req.Node = last.Node
+			} else if req.Node.GetId() != last.Node.GetId() {
+				return status.Errorf(codes.PermissionDenied, "node %q changed to %q on the stream",
+					last.Node.GetId(), req.Node.GetId())
+			}
+			changed := last == nil || !equalNames(last.ResourceNames, req.ResourceNames)
+			last = req
+			// acknowledgements of the last response need no reply
+			if sent != nil && req.ResponseNonce == sent.Nonce && !changed {
+				continue
+			}
+			if err := send(true); err != nil {
+				return err
+			}
+		case <-watch:
+			if last == nil {
+				continue
+			}
+			if err := send(false); err != nil {
+				return err
+			}
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// FetchSecrets implements SecretDiscoveryServiceServer
+func (s *SecretServer) FetchSecrets(ctx context.Context, req *v2.DiscoveryRequest) (*v2.DiscoveryResponse, error) {
+	if err := s.authenticate(req.Node); err != nil {
+		return nil, err
+	}
+	return s.response(req.Node, req.ResourceNames)
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeSecretStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	requests  chan *v2.DiscoveryRequest
+	responses chan *v2.DiscoveryResponse
+}
+
+func (f *fakeSecretStream) Context() context.Context { return f.ctx }
+
+func (f *fakeSecretStream) Send(resp *v2.DiscoveryResponse) error {
+	f.responses <- resp
+	return nil
+}
+
+func (f *fakeSecretStream) Recv() (*v2.DiscoveryRequest, error) {
+	select {
+	case req := <-f.requests:
+		return req, nil
+	case <-f.ctx.Done():
+		return nil, f.ctx.Err()
+	}
+}
+
+// fakeAuthenticator accepts the nodes with a known token
+type fakeAuthenticator map[string]string
+
+func (f fakeAuthenticator) Authenticate(node *core.Node) error {
+	if token := node.GetMetadata().GetFields()[metadataToken].GetStringValue(); token == "" || f[node.Id] != token {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+func tokenNode(id, token string) *core.Node {
+	return &core.Node{Id: id, Metadata: &types.Struct{Fields: map[string]*types.Value{
+		metadataToken: {Kind: &types.Value_StringValue{StringValue: token}},
+	}}}
+}
+
+func writeCerts(t *testing.T, dir, chain string) {
+	files := map[string]string{"root-cert.pem": "root", "cert-chain.pem": chain, "key.pem": "key"}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func secretChain(t *testing.T, resp *v2.DiscoveryResponse) string {
+	if len(resp.Resources) != 1 {
+		t.Fatalf("got %d secrets, want 1", len(resp.Resources))
+	}
+	secret := &auth.Secret{}
+	if err := types.UnmarshalAny(&resp.Resources[0], secret); err != nil {
+		t.Fatal(err)
+	}
+	if secret.Name != workloadSecret {
+		t.Errorf("secret name %q, want %q", secret.Name, workloadSecret)
+	}
+	return string(secret.GetTlsCertificate().CertificateChain.GetInlineBytes())
+}
+
+func TestStreamSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeCerts(t, dir, "chain-1")
+
+	server := NewSecretServer(&FileCertificates{Dir: dir}, fakeAuthenticator{"default/pod1": "token1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeSecretStream{
+		ctx:       ctx,
+		requests:  make(chan *v2.DiscoveryRequest),
+		responses: make(chan *v2.DiscoveryResponse, 1),
+	}
+	done := make(chan error)
+	go func() { done <- server.StreamSecrets(stream) }()
+
+	node := tokenNode("default/pod1", "token1")
+	stream.requests <- &v2.DiscoveryRequest{Node: node, ResourceNames: []string{workloadSecret}, TypeUrl: secretType}
+	first := <-stream.responses
+	if chain := secretChain(t, first); chain != "chain-1" {
+		t.Errorf("got chain %q, want chain-1", chain)
+	}
+
+	// the acknowledgement and unchanged certificates produce no response
+	stream.requests <- &v2.DiscoveryRequest{
+		Node:          node,
+		ResourceNames: []string{workloadSecret},
+		VersionInfo:   first.VersionInfo,
+		ResponseNonce: first.Nonce,
+		TypeUrl:       secretType,
+	}
+	server.Refresh()
+	select {
+	case resp := <-stream.responses:
+		t.Fatalf("unexpected response %v", resp)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// rotated certificates are pushed on refresh
+	writeCerts(t, dir, "chain-2")
+	server.Refresh()
+	second := <-stream.responses
+	if chain := secretChain(t, second); chain != "chain-2" {
+		t.Errorf("got chain %q, want chain-2", chain)
+	}
+	if second.VersionInfo == first.VersionInfo || second.Nonce == first.Nonce {
+		t.Errorf("expected a new version and nonce, got %q/%q", second.VersionInfo, second.Nonce)
+	}
+
+	// a re-issued key with the same chain is a new version
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("key-2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server.Refresh()
+	third := <-stream.responses
+	if third.VersionInfo == second.VersionInfo {
+		t.Errorf("expected a new version for a new key, got %q", third.VersionInfo)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamSecretsAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeCerts(t, dir, "chain-1")
+	server := NewSecretServer(&FileCertificates{Dir: dir}, fakeAuthenticator{"default/pod1": "token1"})
+
+	stream := func(requests ...*v2.DiscoveryRequest) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream := &fakeSecretStream{
+			ctx:       ctx,
+			requests:  make(chan *v2.DiscoveryRequest, len(requests)),
+			responses: make(chan *v2.DiscoveryResponse, len(requests)),
+		}
+		for _, req := range requests {
+			stream.requests <- req
+		}
+		done := make(chan error)
+		go func() { done <- server.StreamSecrets(stream) }()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+	request := func(node *core.Node) *v2.DiscoveryRequest {
+		return &v2.DiscoveryRequest{Node: node, ResourceNames: []string{workloadSecret}, TypeUrl: secretType}
+	}
+
+	for _, node := range []*core.Node{nil, {Id: "default/pod1"}, tokenNode("default/pod1", "token2"), tokenNode("default/pod2", "token1")} {
+		if err := stream(request(node)); status.Code(err) != codes.Unauthenticated && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got error %v for node %v, want an authentication error", err, node)
+		}
+		if _, err := server.FetchSecrets(context.Background(), request(node)); err == nil {
+			t.Errorf("fetched secrets for node %v", node)
+		}
+	}
+
+	// the stream is bound to the authenticated node
+	if err := stream(request(tokenNode("default/pod1", "token1")), request(&core.Node{Id: "default/pod2"})); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got error %v for a node change, want permission denied", err)
+	}
+	if _, err := server.FetchSecrets(context.Background(), request(tokenNode("default/pod1", "token1"))); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,60 @@
+package envoy
+
+import (
+	"github.com/gogo/protobuf/types"
+)
+
+// object is an opaque filter config value, converted to a proto struct
+type object map[string]interface{}
+
+func (o object) toStruct() *types.Struct {
+	out := &types.Struct{Fields: make(map[string]*types.Value, len(o))}
+	for key, value := range o {
+		out.Fields[key] = toValue(value)
+	}
+	return out
+}
+
+// toValue converts strings, booleans, integers, lists, and objects
+func toValue(value interface{}) *types.Value {
+	switch v := value.(type) {
+	case string:
+		return &types.Value{Kind: &types.Value_StringValue{StringValue: v}}
+	case bool:
+		return &types.Value{Kind: &types.Value_BoolValue{BoolValue: v}}
+	case int:
+		return &types.Value{Kind: &types.Value_NumberValue{NumberValue: float64(v)}}
+	case uint32:
+		return &types.Value{Kind: &types.Value_NumberValue{NumberValue: float64(v)}}
+	case float64:
+		return &types.Value{Kind: &types.Value_NumberValue{NumberValue: v}}
+	case object:
+		return &types.Value{Kind: &types.Value_StructValue{StructValue: v.toStruct()}}
+	case []interface{}:
+		list := &types.ListValue{Values: make([]*types.Value, 0, len(v))}
+		for _, elt := range v {
+			list.Values = append(list.Values, toValue(elt))
+		}
+		return &types.Value{Kind: &types.Value_ListValue{ListValue: list}}
+	default:
+		return &types.Value{Kind: &types.Value_NullValue{NullValue: types.NULL_VALUE}}
+	}
+}
+
+// mixer attribute values
+
+func stringAttribute(value string) object {
+	return object{"string_value": value}
+}
+
+func bytesAttribute(value string) object {
+	return object{"bytes_value": value}
+}
+
+func int64Attribute(value int) object {
+	return object{"int64_value": value}
+}
+
+func boolAttribute(value bool) object {
+	return object{"bool_value": value}
+}
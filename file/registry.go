@@ -0,0 +1,275 @@
+// Package file implements a service registry backed by YAML or JSON files
+// for local development without Kubernetes
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/kyessenov/envoymesh/memory"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// Options are the paths of the registry files, in the shapes of the files
+// in testdata. All files are optional.
+type Options struct {
+	// Services is a list of services, e.g. testdata/services.json. Services
+	// without a namespace are in the namespace of their hostname
+	// "name.namespace.svc...", or the default namespace.
+	Services string
+
+	// Instances maps "hostname:port" to endpoints, e.g.
+	// testdata/instances.json
+	Instances string
+
+	// Workloads maps the workload keys "namespace/name" to instances like
+	// testdata/instance.json
+	Workloads string
+
+	// Config holds the traffic configuration as lists of route_rules,
+	// authorization_policies, external_authorizations, sidecars, and
+	// service_entries, e.g. testdata/config.yaml. Resources without a
+	// namespace are in the default namespace, and hostnames are not
+	// qualified with the namespaces.
+	Config string
+
+	// PollPeriod is the interval between checks of the files for changes.
+	// Zero disables reloading.
+	PollPeriod time.Duration
+}
+
+// Registry serves the contents of the files as a service registry and a
+// config store, and notifies the handlers when the files change. Invalid
+// files are rejected and the last good contents are kept.
+type Registry struct {
+	*memory.Registry
+	*memory.ConfigStore
+	options Options
+
+	// last good contents of the files
+	services  string
+	instances string
+	workloads string
+	config    string
+}
+
+// NewRegistry loads the files of a registry
+func NewRegistry(options Options) (*Registry, error) {
+	r := &Registry{
+		Registry:    memory.NewRegistry(),
+		ConfigStore: memory.NewConfigStore(memory.Config{}),
+		options:     options,
+	}
+	if err := r.reload(true); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// file is a registry file applied to the registry when it changes
+type file struct {
+	path  string
+	last  *string
+	apply func([]byte) error
+}
+
+// reload updates the registry with the files that changed, or all files if
+// forced. Each file is applied independently of the others.
+func (r *Registry) reload(force bool) error {
+	files := []file{
+		{r.options.Services, &r.services, r.applyServices},
+		{r.options.Instances, &r.instances, r.applyInstances},
+		{r.options.Workloads, &r.workloads, r.applyWorkloads},
+		{r.options.Config, &r.config, r.applyConfig},
+	}
+	errs := make([]string, 0)
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if !force && string(content) == *f.last {
+			continue
+		}
+		if err := f.apply(content); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid file %q: %v", f.path, err))
+			continue
+		}
+		*f.last = string(content)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *Registry) applyServices(content []byte) error {
+	services := make([]*model.Service, 0)
+	if err := yaml.Unmarshal(content, &services); err != nil {
+		return err
+	}
+	for i, service := range services {
+		if service == nil || service.Hostname == "" {
+			return fmt.Errorf("service %d has no hostname", i)
+		}
+		if service.Namespace == "" {
+			service.Namespace = hostNamespace(service.Hostname)
+		}
+	}
+	r.SetServices(services)
+	return nil
+}
+
+func (r *Registry) applyInstances(content []byte) error {
+	instances := make(map[string][]model.Endpoint)
+	if err := yaml.Unmarshal(content, &instances); err != nil {
+		return err
+	}
+	r.SetInstances(instances)
+	return nil
+}
+
+func (r *Registry) applyWorkloads(content []byte) error {
+	workloads := make(map[string]model.Instance)
+	if err := yaml.Unmarshal(content, &workloads); err != nil {
+		return err
+	}
+	for key, instance := range workloads {
+		if instance.UID == "" {
+			instance.UID = key
+		}
+		if instance.Endpoints == nil {
+			instance.Endpoints = make([]model.Endpoint, 0)
+		}
+		workloads[key] = instance
+	}
+	r.SetWorkloads(workloads)
+	return nil
+}
+
+// config is the shape of the config file
+type config struct {
+	RouteRules             []*model.RouteRule             `json:"route_rules"`
+	AuthorizationPolicies  []*model.AuthorizationPolicy   `json:"authorization_policies"`
+	ExternalAuthorizations []*model.ExternalAuthorization `json:"external_authorizations"`
+	Sidecars               []*model.Sidecar               `json:"sidecars"`
+	ServiceEntries         []*model.ServiceEntry          `json:"service_entries"`
+}
+
+func (r *Registry) applyConfig(content []byte) error {
+	var in config
+	if err := yaml.Unmarshal(content, &in); err != nil {
+		return err
+	}
+	// resources without a namespace are in the default namespace
+	for i, rule := range in.RouteRules {
+		if rule == nil {
+			return fmt.Errorf("route rule %d: empty rule", i)
+		}
+		rule.Namespace = defaultNamespace(rule.Namespace)
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("route rule %s/%s: %v", rule.Namespace, rule.Name, err)
+		}
+	}
+	for i, policy := range in.AuthorizationPolicies {
+		if policy == nil {
+			return fmt.Errorf("authorization policy %d: empty policy", i)
+		}
+		policy.Namespace = defaultNamespace(policy.Namespace)
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("authorization policy %s/%s: %v", policy.Namespace, policy.Name, err)
+		}
+	}
+	for i, authz := range in.ExternalAuthorizations {
+		if authz == nil {
+			return fmt.Errorf("external authorization %d: empty authorization", i)
+		}
+		authz.Namespace = defaultNamespace(authz.Namespace)
+		if err := authz.Validate(); err != nil {
+			return fmt.Errorf("external authorization %s/%s: %v", authz.Namespace, authz.Name, err)
+		}
+	}
+	for i, sidecar := range in.Sidecars {
+		if sidecar == nil {
+			return fmt.Errorf("sidecar %d: empty sidecar", i)
+		}
+		sidecar.Namespace = defaultNamespace(sidecar.Namespace)
+		if err := sidecar.Validate(); err != nil {
+			return fmt.Errorf("sidecar %s/%s: %v", sidecar.Namespace, sidecar.Name, err)
+		}
+	}
+	for i, entry := range in.ServiceEntries {
+		if entry == nil {
+			return fmt.Errorf("service entry %d: empty entry", i)
+		}
+		entry.Namespace = defaultNamespace(entry.Namespace)
+		if err := entry.Validate(); err != nil {
+			return fmt.Errorf("service entry %s/%s: %v", entry.Namespace, entry.Name, err)
+		}
+	}
+	r.ConfigStore.Set(memory.Config{
+		RouteRules:             in.RouteRules,
+		AuthorizationPolicies:  in.AuthorizationPolicies,
+		ExternalAuthorizations: in.ExternalAuthorizations,
+		Sidecars:               in.Sidecars,
+		ServiceEntries:         in.ServiceEntries,
+	})
+	return nil
+}
+
+// hostNamespace returns the namespace of a hostname "name.namespace.svc...",
+// or the default namespace for other hostnames
+func hostNamespace(hostname string) string {
+	parts := strings.Split(hostname, ".")
+	if len(parts) > 2 && parts[2] == "svc" {
+		return defaultNamespace(parts[1])
+	}
+	return defaultNamespace("")
+}
+
+func defaultNamespace(namespace string) string {
+	if namespace == "" {
+		return "default"
+	}
+	return namespace
+}
+
+// Run notifies the handlers of the initial contents and polls the files for
+// changes until a signal is received
+func (r *Registry) Run(stop <-chan struct{}) {
+	go r.Registry.Run(stop)
+	r.QueueSchedule(func() {
+		// the handlers are registered after the files are loaded
+		if err := r.reload(true); err != nil {
+			glog.Warning(err)
+		}
+	})
+	if r.options.PollPeriod <= 0 {
+		<-stop
+		return
+	}
+
+	ticker := time.NewTicker(r.options.PollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.QueueSchedule(func() {
+				if err := r.reload(false); err != nil {
+					glog.Warningf("serving the last good registry files: %v", err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func TestTestdata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	instance, err := ioutil.ReadFile("../testdata/instance.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workloads := filepath.Join(dir, "workloads.json")
+	content := `{"ns2/pod1": ` + string(instance) + `, "ns2/pod2": {"labels": {"version": "v1"}}}`
+	if err := ioutil.WriteFile(workloads, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRegistry(Options{
+		Services:  "../testdata/services.json",
+		Instances: "../testdata/instances.json",
+		Workloads: workloads,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if services := r.Services(); len(services) == 0 || services[0].Hostname != "hello.default.svc.cluster.local" {
+		t.Errorf("got services %v", services)
+	}
+	if endpoints := r.Instances()["hello.default.svc.cluster.local:http"]; len(endpoints) != 1 || endpoints[0].IP != "10.0.0.1" {
+		t.Errorf("got endpoints %v", endpoints)
+	}
+	if got, err := r.Workload("ns2/pod1"); err != nil || got.UID != "kubernetes://pod1.ns2" || len(got.Endpoints) != 1 {
+		t.Errorf("Workload(ns2/pod1) => %v, %v", got, err)
+	}
+	// workloads without a UID are identified by their key
+	if got, err := r.Workload("ns2/pod2"); err != nil || got.UID != "ns2/pod2" || got.Endpoints == nil {
+		t.Errorf("Workload(ns2/pod2) => %#v, %v", got, err)
+	}
+	if _, err := r.Workload("ns2/pod3"); err != model.ErrUnknownWorkload {
+		t.Errorf("Workload(ns2/pod3) => %v, want %v", err, model.ErrUnknownWorkload)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("- hostname: a.com\n")
+
+	r, err := NewRegistry(Options{Services: path, PollPeriod: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan []*model.Service, 10)
+	r.RegisterServiceHandler(func() { notified <- r.Services() })
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Run(stop)
+
+	expect := func(hostname string) {
+		select {
+		case services := <-notified:
+			if len(services) != 1 || services[0].Hostname != hostname {
+				t.Errorf("got services %v, want %s", services, hostname)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler was not notified of %s", hostname)
+		}
+	}
+
+	// the handlers are notified of the initial contents and of changes
+	expect("a.com")
+	write("- hostname: b.com\n")
+	expect("b.com")
+
+	// invalid files keep the last good contents
+	write("- ports: []\n")
+	select {
+	case services := <-notified:
+		t.Errorf("unexpected notification %v", services)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if services := r.Services(); len(services) != 1 || services[0].Hostname != "b.com" {
+		t.Errorf("got services %v, want b.com", services)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	r, err := NewRegistry(Options{Config: "../testdata/config.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := r.RouteRules()
+	if len(rules) != 1 || rules[0].Namespace != "default" || len(rules[0].Routes) != 2 {
+		t.Errorf("got route rules %v", rules)
+	}
+	sidecars := r.Sidecars()
+	if len(sidecars) != 1 || sidecars[0].Namespace != "ns2" {
+		t.Errorf("got sidecars %v", sidecars)
+	}
+
+	// invalid resources reject the file
+	notified := false
+	r.RegisterConfigHandler(func() { notified = true })
+	if err := r.applyConfig([]byte("sidecars:\n- name: empty\n")); err == nil {
+		t.Error("expected an error for a sidecar without hosts")
+	}
+	if err := r.applyConfig([]byte("route_rules:\n- null\n")); err == nil {
+		t.Error("expected an error for an empty route rule")
+	}
+	if notified || len(r.Sidecars()) != 1 {
+		t.Errorf("invalid config replaced the last good version")
+	}
+}
+
+func TestSidecarScope(t *testing.T) {
+	r, err := NewRegistry(Options{Services: "../testdata/services.json", Config: "../testdata/config.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := make([]string, 0)
+	for _, service := range r.Services() {
+		for _, sidecar := range r.Sidecars() {
+			if sidecar.AppliesTo("ns2", nil) && sidecar.Imports(service) {
+				imported = append(imported, service.Hostname)
+			}
+		}
+	}
+	if want := []string{"hello.default.svc.cluster.local"}; !reflect.DeepEqual(imported, want) {
+		t.Errorf("sidecar of ns2 imports %v, want %v", imported, want)
+	}
+
+	for hostname, want := range map[string]string{
+		"hello.default.svc.cluster.local": "default",
+		"db.ns2.svc":                      "ns2",
+		"api.example.com":                 "default",
+		"a.com":                           "default",
+	} {
+		if got := hostNamespace(hostname); got != want {
+			t.Errorf("hostNamespace(%q) => %q, want %q", hostname, got, want)
+		}
+	}
+}
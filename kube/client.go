@@ -17,10 +17,15 @@ package kube
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/golang/glog"
 	multierror "github.com/hashicorp/go-multierror"
+	authentication_v1 "k8s.io/api/authentication/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -52,6 +57,52 @@ func ResolveConfig(kubeconfig string) (string, error) {
 	return kubeconfig, nil
 }
 
+// LoadKubeconfigs maps cluster names to the kubeconfig files of the paths.
+// A path is a kubeconfig file of the cluster named after the file, or a
+// directory of such files, e.g. a mounted secret with a key per cluster.
+// Hidden files are skipped.
+func LoadKubeconfigs(paths []string) (map[string]string, error) {
+	out := make(map[string]string)
+	add := func(path string) error {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if existing, exists := out[name]; exists {
+			return fmt.Errorf("cluster %q has kubeconfigs %q and %q", name, existing, path)
+		}
+		out[name] = path
+		return nil
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if err := add(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			// mounted secrets are symlinks to the files
+			kubeconfig := filepath.Join(path, file.Name())
+			if info, err := os.Stat(kubeconfig); err != nil || info.IsDir() {
+				continue
+			}
+			if err := add(kubeconfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
 // CreateInterface is a helper function to create Kubernetes interface
 func CreateInterface(kubeconfig string) (*rest.Config, kubernetes.Interface, error) {
 	kube, err := ResolveConfig(kubeconfig)
@@ -67,3 +118,47 @@ func CreateInterface(kubeconfig string) (*rest.Config, kubernetes.Interface, err
 	client, err := kubernetes.NewForConfig(config)
 	return config, client, err
 }
+
+const (
+	// CACertKey is the secret key of the PEM-encoded CA certificate
+	CACertKey = "ca-cert.pem"
+	// CAKeyKey is the secret key of the PEM-encoded CA private key
+	CAKeyKey = "ca-key.pem"
+)
+
+// GetCASecret reads the CA certificate and key from a secret
+func GetCASecret(client kubernetes.Interface, namespace, name string) ([]byte, []byte, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(name, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, key := secret.Data[CACertKey], secret.Data[CAKeyKey]
+	if len(cert) == 0 || len(key) == 0 {
+		return nil, nil, fmt.Errorf("secret %s/%s is missing %s or %s", namespace, name, CACertKey, CAKeyKey)
+	}
+	return cert, key, nil
+}
+
+// serviceAccountPrefix is the prefix of the user names of service account
+// tokens, followed by "<namespace>:<name>"
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// ReviewToken authenticates a service account token with the API server and
+// returns the namespace and the name of the service account
+func ReviewToken(client kubernetes.Interface, token string) (string, string, error) {
+	review, err := client.AuthenticationV1().TokenReviews().Create(&authentication_v1.TokenReview{
+		Spec: authentication_v1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if !review.Status.Authenticated {
+		return "", "", fmt.Errorf("token not authenticated: %s", review.Status.Error)
+	}
+	user := review.Status.User.Username
+	parts := strings.Split(strings.TrimPrefix(user, serviceAccountPrefix), ":")
+	if !strings.HasPrefix(user, serviceAccountPrefix) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("token of user %q is not a service account token", user)
+	}
+	return parts[0], parts[1], nil
+}
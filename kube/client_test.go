@@ -0,0 +1,98 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	authentication_v1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+)
+
+func TestLoadKubeconfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfigs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	for _, path := range []string{
+		filepath.Join(dir, "east.yaml"),
+		filepath.Join(secret, "..data", "west"),
+		filepath.Join(secret, "central"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("apiVersion: v1\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// mounted secrets link the keys to the hidden data directory
+	if err := os.Symlink(filepath.Join("..data", "west"), filepath.Join(secret, "west")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := LoadKubeconfigs([]string{filepath.Join(dir, "east.yaml"), secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"east":    filepath.Join(dir, "east.yaml"),
+		"west":    filepath.Join(secret, "west"),
+		"central": filepath.Join(secret, "central"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadKubeconfigs => %v, want %v", got, want)
+	}
+
+	if _, err := LoadKubeconfigs([]string{secret, filepath.Join(secret, "west")}); err == nil {
+		t.Error("LoadKubeconfigs of a duplicate cluster => no error")
+	}
+	if _, err := LoadKubeconfigs([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("LoadKubeconfigs of a missing file => no error")
+	}
+}
+
+func TestReviewToken(t *testing.T) {
+	users := map[string]string{
+		"reviews-token": "system:serviceaccount:default:reviews",
+		"admin-token":   "admin",
+	}
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		review := action.(k8s_testing.CreateAction).GetObject().(*authentication_v1.TokenReview)
+		user, exists := users[review.Spec.Token]
+		review.Status.Authenticated = exists
+		review.Status.User.Username = user
+		return true, review, nil
+	})
+
+	namespace, account, err := ReviewToken(client, "reviews-token")
+	if err != nil || namespace != "default" || account != "reviews" {
+		t.Errorf("ReviewToken => %q, %q, %v, want default, reviews", namespace, account, err)
+	}
+	for _, token := range []string{"admin-token", "unknown-token"} {
+		if _, _, err := ReviewToken(client, token); err == nil {
+			t.Errorf("ReviewToken(%q) => no error", token)
+		}
+	}
+}
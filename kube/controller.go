@@ -27,6 +27,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 
 	"github.com/kyessenov/envoymesh/model"
@@ -47,12 +48,17 @@ type ControllerOptions struct {
 	WatchedNamespace string
 	ResyncPeriod     time.Duration
 	DomainSuffix     string
+
+	// ClusterName is the locality of the endpoints in a multi-cluster
+	// registry, empty for a single cluster
+	ClusterName string
 }
 
 // Controller is a collection of synchronized resource watchers
 // Caches are thread-safe
 type Controller struct {
 	domainSuffix string
+	clusterName  string
 
 	client    kubernetes.Interface
 	queue     Queue
@@ -60,6 +66,9 @@ type Controller struct {
 	endpoints cacheHandler
 
 	pods *PodCache
+
+	// custom resources by kind
+	crds map[string]cacheHandler
 }
 
 type cacheHandler struct {
@@ -67,16 +76,20 @@ type cacheHandler struct {
 	handler  *ChainHandler
 }
 
-// NewController creates a new Kubernetes controller
-func NewController(client kubernetes.Interface, options ControllerOptions) *Controller {
+// NewController creates a new Kubernetes controller.
+// Custom resources are not watched if the CRD client is nil.
+func NewController(client kubernetes.Interface, crd rest.Interface, options ControllerOptions) *Controller {
 	glog.V(2).Infof("Service controller watching namespace %q", options.WatchedNamespace)
 
 	// Queue requires a time duration for a retry delay after a handler error
 	out := &Controller{
 		domainSuffix: options.DomainSuffix,
+		clusterName:  options.ClusterName,
 		client:       client,
-		queue:        NewQueue(1 * time.Second),
+		queue:        NewClusterQueue(1*time.Second, options.ClusterName),
+		crds:         make(map[string]cacheHandler),
 	}
+	informersSynced.WithLabelValues(options.ClusterName).Set(0)
 
 	out.services = out.createInformer(&v1.Service{}, options.ResyncPeriod,
 		func(opts meta_v1.ListOptions) (runtime.Object, error) {
@@ -102,6 +115,29 @@ func NewController(client kubernetes.Interface, options ControllerOptions) *Cont
 			return client.CoreV1().Pods(options.WatchedNamespace).Watch(opts)
 		}))
 
+	if crd != nil {
+		for kind, resource := range crdResources {
+			resource := resource
+			out.crds[kind] = out.createInformer(&Resource{}, options.ResyncPeriod,
+				func(opts meta_v1.ListOptions) (runtime.Object, error) {
+					return crd.Get().
+						Namespace(options.WatchedNamespace).
+						Resource(resource).
+						VersionedParams(&opts, meta_v1.ParameterCodec).
+						Do().
+						Get()
+				},
+				func(opts meta_v1.ListOptions) (watch.Interface, error) {
+					opts.Watch = true
+					return crd.Get().
+						Namespace(options.WatchedNamespace).
+						Resource(resource).
+						VersionedParams(&opts, meta_v1.ParameterCodec).
+						Watch()
+				})
+		}
+	}
+
 	return out
 }
 
@@ -151,6 +187,11 @@ func (c *Controller) createInformer(
 	return cacheHandler{informer: informer, handler: handler}
 }
 
+// ClusterName is the name of the cluster in a multi-cluster registry
+func (c *Controller) ClusterName() string {
+	return c.clusterName
+}
+
 // HasSynced returns true after the initial state synchronization
 func (c *Controller) HasSynced() bool {
 	if !c.services.informer.HasSynced() ||
@@ -158,6 +199,11 @@ func (c *Controller) HasSynced() bool {
 		!c.pods.informer.HasSynced() {
 		return false
 	}
+	for _, crd := range c.crds {
+		if !crd.informer.HasSynced() {
+			return false
+		}
+	}
 
 	return true
 }
@@ -168,6 +214,14 @@ func (c *Controller) Run(stop <-chan struct{}) {
 	go c.services.informer.Run(stop)
 	go c.endpoints.informer.Run(stop)
 	go c.pods.informer.Run(stop)
+	for _, crd := range c.crds {
+		go crd.informer.Run(stop)
+	}
+	go func() {
+		if cache.WaitForCacheSync(stop, c.HasSynced) {
+			informersSynced.WithLabelValues(c.clusterName).Set(1)
+		}
+	}()
 
 	<-stop
 	glog.V(2).Info("Controller terminated")
@@ -184,7 +238,9 @@ func (c *Controller) Services() []*model.Service {
 	out := make([]*model.Service, 0, len(list))
 
 	for _, item := range list {
-		if svc := convertService(*item.(*v1.Service), c.domainSuffix); svc != nil {
+		item := item.(*v1.Service)
+		if svc := convertService(*item, c.domainSuffix); svc != nil {
+			svc.ServiceAccounts = c.serviceAccounts(svc.ServiceAccounts, item.Name, item.Namespace, nil)
 			out = append(out, svc)
 		}
 	}
@@ -193,6 +249,74 @@ func (c *Controller) Services() []*model.Service {
 	return out
 }
 
+// GetIstioServiceAccounts implements model.ServiceAccounts operation. It
+// returns the identities declared by the service annotations and the
+// identities of the pods backing the service ports.
+func (c *Controller) GetIstioServiceAccounts(hostname string, ports []string) []string {
+	name, namespace, err := parseHostname(hostname)
+	if err != nil {
+		glog.V(2).Infof("GetIstioServiceAccounts(%s) => error %v", hostname, err)
+		return nil
+	}
+	item, exists := c.serviceByKey(name, namespace)
+	if !exists {
+		return nil
+	}
+	svc := convertService(*item, c.domainSuffix)
+	if svc == nil {
+		return nil
+	}
+	return c.serviceAccounts(svc.ServiceAccounts, name, namespace, ports)
+}
+
+// serviceAccounts adds the identities of the pods backing the named service
+// ports (all ports if empty) to the sorted set of accounts
+func (c *Controller) serviceAccounts(accounts []string, name, namespace string, ports []string) []string {
+	set := make(map[string]bool)
+	for _, account := range accounts {
+		set[account] = true
+	}
+
+	item, exists, err := c.endpoints.informer.GetStore().GetByKey(KeyFunc(name, namespace))
+	if err != nil {
+		glog.V(2).Infof("serviceAccounts(%s, %s) => error %v", name, namespace, err)
+	}
+	if exists {
+		for _, ss := range item.(*v1.Endpoints).Subsets {
+			if !hasPort(ss.Ports, ports) {
+				continue
+			}
+			for _, ea := range ss.Addresses {
+				if pod, exists := c.pods.getPodByIP(ea.IP); exists {
+					set[podServiceAccount(pod, c.domainSuffix)] = true
+				}
+			}
+		}
+	}
+
+	out := make([]string, 0, len(set))
+	for account := range set {
+		out = append(out, account)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// hasPort is true if any of the endpoint ports is named, or no names are given
+func hasPort(ports []v1.EndpointPort, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, port := range ports {
+		for _, name := range names {
+			if port.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Instances ...
 func (c *Controller) Instances() map[string][]model.Endpoint {
 	out := make(map[string][]model.Endpoint)
@@ -203,12 +327,14 @@ func (c *Controller) Instances() map[string][]model.Endpoint {
 			for _, ea := range ss.Addresses {
 				for _, port := range ss.Ports {
 					endpoint := model.Endpoint{
-						IP:   ea.IP,
-						Port: int(port.Port),
+						IP:       ea.IP,
+						Port:     int(port.Port),
+						Locality: c.clusterName,
 					}
 					pod, exists := c.pods.getPodByIP(ea.IP)
 					if exists {
 						endpoint.UID = pod.Namespace + "/" + pod.Name
+						endpoint.Labels = convertLabels(pod.ObjectMeta)
 					}
 					key := svc + ":" + port.Name
 					out[key] = append(out[key], endpoint)
@@ -249,10 +375,11 @@ func (c *Controller) Workload(id string) (model.Instance, error) {
 		return out, err
 	}
 	if !exists {
-		return out, nil
+		return out, model.ErrUnknownWorkload
 	}
 	pod := elt.(*v1.Pod)
 	out.Labels = convertLabels(pod.ObjectMeta)
+	out.ServiceAccount = podServiceAccount(pod, c.domainSuffix)
 
 	for _, item := range c.endpoints.informer.GetStore().List() {
 		ep := *item.(*v1.Endpoints)
@@ -274,9 +401,11 @@ func (c *Controller) Workload(id string) (model.Instance, error) {
 							continue
 						}
 						out.Endpoints = append(out.Endpoints, model.Endpoint{
-							IP:       ea.IP,
-							Port:     int(port.Port),
-							Protocol: svcPort.Protocol,
+							IP:                   ea.IP,
+							Port:                 int(port.Port),
+							Protocol:             svcPort.Protocol,
+							AuthenticationPolicy: svcPort.AuthenticationPolicy,
+							Service:              svc.Hostname,
 						})
 					}
 				}
@@ -286,7 +415,18 @@ func (c *Controller) Workload(id string) (model.Instance, error) {
 	return out, nil
 }
 
-// RegisterServiceHandler ...
+// podAccount is the part of a pod that determines the service accounts of
+// the services
+type podAccount struct {
+	ip             string
+	serviceAccount string
+	labels         map[string]string
+}
+
+// RegisterServiceHandler notifies about changes to the services and to the
+// pods that change the service accounts of the services: pods that receive
+// an IP, change their service account or labels, or are deleted. Other pod
+// updates, e.g. of the pod status, are ignored.
 func (c *Controller) RegisterServiceHandler(f func()) {
 	c.services.handler.Append(func(obj interface{}, event model.Event) error {
 		svc := *obj.(*v1.Service)
@@ -298,6 +438,32 @@ func (c *Controller) RegisterServiceHandler(f func()) {
 		f()
 		return nil
 	})
+
+	// the handlers run on the queue, so the last accounts by pod key need no
+	// lock
+	accounts := make(map[string]podAccount)
+	c.pods.handler.Append(func(obj interface{}, event model.Event) error {
+		pod := obj.(*v1.Pod)
+		if pod.Namespace == meta_v1.NamespaceSystem {
+			return nil
+		}
+		key := pod.Namespace + "/" + pod.Name
+		last, exists := accounts[key]
+		if event == model.EventDelete || pod.Status.PodIP == "" {
+			if exists {
+				delete(accounts, key)
+				f()
+			}
+			return nil
+		}
+		account := podAccount{ip: pod.Status.PodIP, serviceAccount: pod.Spec.ServiceAccountName, labels: pod.Labels}
+		if exists && reflect.DeepEqual(last, account) {
+			return nil
+		}
+		accounts[key] = account
+		f()
+		return nil
+	})
 }
 
 // RegisterEndpointHandler ...
@@ -307,3 +473,118 @@ func (c *Controller) RegisterEndpointHandler(f func()) {
 		return nil
 	})
 }
+
+// RouteRules lists valid routing rules sorted by namespace and name
+func (c *Controller) RouteRules() []*model.RouteRule {
+	out := make([]*model.RouteRule, 0)
+	for _, item := range c.listResources(RouteRuleKind) {
+		rule, err := convertRouteRule(*item, c.domainSuffix)
+		if err != nil {
+			glog.Warningf("Invalid route rule %s/%s: %v", item.Namespace, item.Name, err)
+			continue
+		}
+		out = append(out, rule)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Namespace < out[j].Namespace ||
+			out[i].Namespace == out[j].Namespace && out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// AuthorizationPolicies lists valid authorization policies sorted by namespace and name
+func (c *Controller) AuthorizationPolicies() []*model.AuthorizationPolicy {
+	out := make([]*model.AuthorizationPolicy, 0)
+	for _, item := range c.listResources(AuthorizationPolicyKind) {
+		policy, err := convertAuthorizationPolicy(*item)
+		if err != nil {
+			glog.Warningf("Invalid authorization policy %s/%s: %v", item.Namespace, item.Name, err)
+			continue
+		}
+		out = append(out, policy)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Namespace < out[j].Namespace ||
+			out[i].Namespace == out[j].Namespace && out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// ExternalAuthorizations lists valid external authorization services sorted
+// by namespace and name
+func (c *Controller) ExternalAuthorizations() []*model.ExternalAuthorization {
+	out := make([]*model.ExternalAuthorization, 0)
+	for _, item := range c.listResources(ExternalAuthorizationKind) {
+		authz, err := convertExternalAuthorization(*item, c.domainSuffix)
+		if err != nil {
+			glog.Warningf("Invalid external authorization %s/%s: %v", item.Namespace, item.Name, err)
+			continue
+		}
+		out = append(out, authz)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Namespace < out[j].Namespace ||
+			out[i].Namespace == out[j].Namespace && out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Sidecars lists valid sidecars sorted by namespace and name
+func (c *Controller) Sidecars() []*model.Sidecar {
+	out := make([]*model.Sidecar, 0)
+	for _, item := range c.listResources(SidecarKind) {
+		sidecar, err := convertSidecar(*item, c.domainSuffix)
+		if err != nil {
+			glog.Warningf("Invalid sidecar %s/%s: %v", item.Namespace, item.Name, err)
+			continue
+		}
+		out = append(out, sidecar)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Namespace < out[j].Namespace ||
+			out[i].Namespace == out[j].Namespace && out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// ServiceEntries lists valid service entries sorted by namespace and name
+func (c *Controller) ServiceEntries() []*model.ServiceEntry {
+	out := make([]*model.ServiceEntry, 0)
+	for _, item := range c.listResources(ServiceEntryKind) {
+		entry, err := convertServiceEntry(*item, c.domainSuffix)
+		if err != nil {
+			glog.Warningf("Invalid service entry %s/%s: %v", item.Namespace, item.Name, err)
+			continue
+		}
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Namespace < out[j].Namespace ||
+			out[i].Namespace == out[j].Namespace && out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// listResources returns custom resources of a kind
+func (c *Controller) listResources(kind string) []*Resource {
+	crd, exists := c.crds[kind]
+	if !exists {
+		return nil
+	}
+	list := crd.informer.GetStore().List()
+	out := make([]*Resource, 0, len(list))
+	for _, item := range list {
+		out = append(out, item.(*Resource))
+	}
+	return out
+}
+
+// RegisterConfigHandler ...
+func (c *Controller) RegisterConfigHandler(f func()) {
+	for _, crd := range c.crds {
+		crd.handler.Append(func(obj interface{}, event model.Event) error {
+			f()
+			return nil
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package kube
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+)
+
+func pod(name, ip, account string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       v1.PodSpec{ServiceAccountName: account},
+		Status:     v1.PodStatus{PodIP: ip},
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "reviews",
+				Namespace:   "default",
+				Annotations: map[string]string{CanonicalServiceAccountsOnVMAnnotation: "vm@company.com"},
+			},
+			Spec: v1.ServiceSpec{
+				ClusterIP: "10.0.0.1",
+				Ports: []v1.ServicePort{
+					{Name: "http", Port: 9080, Protocol: v1.ProtocolTCP},
+					{Name: "https", Port: 443, Protocol: v1.ProtocolTCP},
+				},
+			},
+		},
+		&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "reviews", Namespace: "default"},
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.1.0.1"}, {IP: "10.1.0.3"}},
+					Ports:     []v1.EndpointPort{{Name: "http", Port: 9080}},
+				},
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.1.0.2"}},
+					Ports:     []v1.EndpointPort{{Name: "https", Port: 443}},
+				},
+			},
+		},
+		pod("reviews-1", "10.1.0.1", "reviews"),
+		pod("admin-1", "10.1.0.2", "admin"),
+	)
+	// pod events are sent on a fake watch, which blocks until the informer
+	// receives them
+	pods := watch.NewFake()
+	client.PrependWatchReactor("pods", k8s_testing.DefaultWatchReactor(pods, nil))
+	c := NewController(client, nil, ControllerOptions{DomainSuffix: domainSuffix})
+	notified := make(chan struct{}, 100)
+	c.RegisterServiceHandler(func() { notified <- struct{}{} })
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Run(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.HasSynced() {
+		if time.Now().After(deadline) {
+			t.Fatal("informers did not synchronize")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hostname := serviceHostname("reviews", "default", domainSuffix)
+	vm := "spiffe://vm@company.com"
+	reviews := "spiffe://company.com/ns/default/sa/reviews"
+	admin := "spiffe://company.com/ns/default/sa/admin"
+	ratings := "spiffe://company.com/ns/default/sa/ratings"
+
+	// wait for the handlers until the pod cache has the pods
+	expect := func(want []string) {
+		deadline := time.After(5 * time.Second)
+		for {
+			services := c.Services()
+			if len(services) == 1 && reflect.DeepEqual(services[0].ServiceAccounts, want) {
+				return
+			}
+			select {
+			case <-notified:
+			case <-deadline:
+				t.Fatalf("got services %v, want service accounts %v", services, want)
+			}
+		}
+	}
+	expect([]string{admin, reviews, vm})
+
+	// the accounts of the pods backing the ports, with the annotations
+	for _, test := range []struct {
+		hostname string
+		ports    []string
+		want     []string
+	}{
+		{hostname, []string{"http"}, []string{reviews, vm}},
+		{hostname, []string{"https"}, []string{admin, vm}},
+		{hostname, []string{"http", "https"}, []string{admin, reviews, vm}},
+		{hostname, nil, []string{admin, reviews, vm}},
+		{hostname, []string{"grpc"}, []string{vm}},
+		{serviceHostname("ratings", "default", domainSuffix), nil, nil},
+		{"reviews", nil, nil},
+	} {
+		if got := c.GetIstioServiceAccounts(test.hostname, test.ports); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GetIstioServiceAccounts(%s, %v) => %v, want %v", test.hostname, test.ports, got, test.want)
+		}
+	}
+
+	// a new pod backing the service notifies the service handlers
+	for len(notified) > 0 {
+		<-notified
+	}
+	pods.Add(pod("ratings-1", "10.1.0.3", "ratings"))
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("service handler not notified of the pod")
+	}
+	expect([]string{admin, ratings, reviews, vm})
+
+	// status updates of the pods do not notify the handlers
+	for len(notified) > 0 {
+		<-notified
+	}
+	ready := pod("ratings-1", "10.1.0.3", "ratings")
+	ready.Status.Phase = v1.PodRunning
+	pods.Modify(ready)
+	relabeled := pod("admin-1", "10.1.0.2", "admin")
+	relabeled.Labels = map[string]string{"version": "v2"}
+	pods.Modify(relabeled)
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("service handler not notified of the new labels")
+	}
+	select {
+	case <-notified:
+		t.Error("service handler notified of a status update")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// deleted pods notify the handlers
+	pods.Delete(ready)
+	expect([]string{admin, reviews, vm})
+}
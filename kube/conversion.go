@@ -15,11 +15,13 @@
 package kube
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/golang/glog"
 	multierror "github.com/hashicorp/go-multierror"
 	"k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -48,6 +50,10 @@ const (
 	// PortAuthenticationAnnotationKeyPrefix is the annotation key prefix that used to define
 	// authentication policy.
 	PortAuthenticationAnnotationKeyPrefix = "auth.istio.io"
+
+	// FaultsAnnotation is the annotation on services with a JSON list of
+	// faults injected into requests to the service
+	FaultsAnnotation = "envoymesh.io/faults"
 )
 
 func convertLabels(obj meta_v1.ObjectMeta) model.Labels {
@@ -71,6 +77,32 @@ func extractAuthenticationPolicy(port v1.ServicePort, obj meta_v1.ObjectMeta) pr
 	return proxyconfig.AuthenticationPolicy_INHERIT
 }
 
+// Extracts fault injection policy from annotation. Faults that fail to parse
+// or validate are skipped.
+func extractFaults(obj meta_v1.ObjectMeta) []*model.Fault {
+	value := obj.Annotations[FaultsAnnotation]
+	if value == "" {
+		return nil
+	}
+	var faults []*model.Fault
+	if err := json.Unmarshal([]byte(value), &faults); err != nil {
+		glog.Warningf("Invalid faults annotation on %s/%s: %v", obj.Namespace, obj.Name, err)
+		return nil
+	}
+	out := make([]*model.Fault, 0, len(faults))
+	for i, fault := range faults {
+		if fault == nil {
+			continue
+		}
+		if err := fault.Validate(); err != nil {
+			glog.Warningf("Invalid fault %d on %s/%s: %v", i, obj.Namespace, obj.Name, err)
+			continue
+		}
+		out = append(out, fault)
+	}
+	return out
+}
+
 func convertPort(port v1.ServicePort, obj meta_v1.ObjectMeta) *model.Port {
 	return &model.Port{
 		Name:                 port.Name,
@@ -114,10 +146,12 @@ func convertService(svc v1.Service, domainSuffix string) *model.Service {
 
 	return &model.Service{
 		Hostname:              serviceHostname(svc.Name, svc.Namespace, domainSuffix),
+		Namespace:             svc.Namespace,
 		Ports:                 ports,
 		Address:               addr,
 		ExternalName:          external,
 		ServiceAccounts:       serviceaccounts,
+		Faults:                extractFaults(svc.ObjectMeta),
 		LoadBalancingDisabled: loadBalancingDisabled,
 	}
 }
@@ -141,6 +175,15 @@ func kubeToIstioServiceAccount(saname string, ns string, domain string) string {
 	return fmt.Sprintf("%v://%v/ns/%v/sa/%v", IstioURIPrefix, domain, ns, saname)
 }
 
+// podServiceAccount returns the Istio service account of a pod
+func podServiceAccount(pod *v1.Pod, domain string) string {
+	account := pod.Spec.ServiceAccountName
+	if account == "" {
+		account = "default"
+	}
+	return kubeToIstioServiceAccount(account, pod.Namespace, domain)
+}
+
 // KeyFunc is the internal API key function that returns "namespace"/"name" or
 // "name" if "namespace" is empty
 func KeyFunc(name, namespace string) string {
@@ -266,3 +309,107 @@ func convertProbesToPorts(t *v1.PodSpec) (model.PortList, error) {
 
 	return mgmtPorts, errs
 }
+
+// convertRouteRule parses the spec of a route rule resource. Short host names
+// are qualified with the namespace of the rule.
+func convertRouteRule(obj Resource, domainSuffix string) (*model.RouteRule, error) {
+	out := &model.RouteRule{}
+	if err := json.Unmarshal(obj.Spec, out); err != nil {
+		return nil, err
+	}
+	out.Name = obj.Name
+	out.Namespace = obj.Namespace
+	if out.Host != "" && !strings.Contains(out.Host, ".") {
+		out.Host = serviceHostname(out.Host, obj.Namespace, domainSuffix)
+	}
+	if err := out.Validate(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func convertAuthorizationPolicy(obj Resource) (*model.AuthorizationPolicy, error) {
+	out := &model.AuthorizationPolicy{}
+	if err := json.Unmarshal(obj.Spec, out); err != nil {
+		return nil, err
+	}
+	out.Name = obj.Name
+	out.Namespace = obj.Namespace
+	if out.Action == "" {
+		out.Action = model.AuthorizationAllow
+	}
+	if out.Rules == nil {
+		out.Rules = make([]*model.AuthorizationRule, 0)
+	}
+	if err := out.Validate(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func convertExternalAuthorization(obj Resource, domainSuffix string) (*model.ExternalAuthorization, error) {
+	out := &model.ExternalAuthorization{}
+	if err := json.Unmarshal(obj.Spec, out); err != nil {
+		return nil, err
+	}
+	out.Name = obj.Name
+	out.Namespace = obj.Namespace
+	if out.Host != "" && !strings.Contains(out.Host, ".") {
+		out.Host = serviceHostname(out.Host, obj.Namespace, domainSuffix)
+	}
+	for i, service := range out.Services {
+		if !strings.Contains(service, ".") {
+			out.Services[i] = serviceHostname(service, obj.Namespace, domainSuffix)
+		}
+	}
+	if err := out.Validate(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// convertSidecar parses the spec of a sidecar resource. Short host names are
+// qualified with the namespace of the host, or the namespace of the sidecar
+// for hosts without a namespace.
+func convertSidecar(obj Resource, domainSuffix string) (*model.Sidecar, error) {
+	out := &model.Sidecar{}
+	if err := json.Unmarshal(obj.Spec, out); err != nil {
+		return nil, err
+	}
+	out.Name = obj.Name
+	out.Namespace = obj.Namespace
+	for i, host := range out.Hosts {
+		namespace, hostname := obj.Namespace, host
+		if parts := strings.SplitN(host, "/", 2); len(parts) == 2 {
+			namespace, hostname = parts[0], parts[1]
+		}
+		if hostname != "*" && !strings.Contains(hostname, ".") && namespace != "*" {
+			hostname = serviceHostname(hostname, namespace, domainSuffix)
+		}
+		out.Hosts[i] = namespace + "/" + hostname
+	}
+	if err := out.Validate(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// convertServiceEntry parses the spec of a service entry resource. Short host
+// names are qualified with the namespace of the entry.
+func convertServiceEntry(obj Resource, domainSuffix string) (*model.ServiceEntry, error) {
+	out := &model.ServiceEntry{}
+	if err := json.Unmarshal(obj.Spec, out); err != nil {
+		return nil, err
+	}
+	out.Name = obj.Name
+	out.Namespace = obj.Namespace
+	for i, host := range out.Hosts {
+		if !strings.Contains(host, ".") {
+			out.Hosts[i] = serviceHostname(host, obj.Namespace, domainSuffix)
+		}
+	}
+	if err := out.Validate(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -369,3 +369,277 @@ func TestProbesToPortsConversion(t *testing.T) {
 		}
 	}
 }
+
+func TestRouteRuleConversion(t *testing.T) {
+	obj := Resource{
+		ObjectMeta: metav1.ObjectMeta{Name: "reviews", Namespace: "default"},
+		Spec: []byte(`{
+			"host": "reviews",
+			"routes": [{
+				"match": {"prefix": "/api", "headers": {"end-user": "jason"}},
+				"splits": [{"labels": {"version": "v2"}}]
+			}, {
+				"splits": [{"labels": {"version": "v1"}, "weight": 75}, {"labels": {"version": "v3"}, "weight": 25}]
+			}]
+		}`),
+	}
+
+	rule, err := convertRouteRule(obj, domainSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &model.RouteRule{
+		Name:      "reviews",
+		Namespace: "default",
+		Host:      serviceHostname("reviews", "default", domainSuffix),
+		Routes: []*model.HTTPRoute{{
+			Match:  &model.HTTPMatch{Prefix: "/api", Headers: map[string]string{"end-user": "jason"}},
+			Splits: []*model.Split{{Labels: model.Labels{"version": "v2"}}},
+		}, {
+			Splits: []*model.Split{
+				{Labels: model.Labels{"version": "v1"}, Weight: 75},
+				{Labels: model.Labels{"version": "v3"}, Weight: 25},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(rule, expected) {
+		t.Errorf("convertRouteRule => %#v, want %#v", rule, expected)
+	}
+
+	invalid := []string{
+		`{"routes": [{"splits": [{"weight": 100}]}]}`,
+		`{"host": "reviews", "routes": [{"splits": []}]}`,
+		`{"host": "reviews", "routes": [{"splits": [{"weight": 50}, {"weight": 40}]}]}`,
+		`{"host": 1}`,
+	}
+	for _, spec := range invalid {
+		obj.Spec = []byte(spec)
+		if _, err := convertRouteRule(obj, domainSuffix); err == nil {
+			t.Errorf("convertRouteRule(%s) => no error", spec)
+		}
+	}
+}
+
+func TestServiceFaultAnnotation(t *testing.T) {
+	testCases := []struct {
+		annotation string
+		want       []*model.Fault
+	}{
+		{"", nil},
+		{"not json", nil},
+		{
+			`[{"abort": {"percent": 50, "http_status": 500}}]`,
+			[]*model.Fault{{Abort: &model.FaultAbort{Percent: 50, HTTPStatus: 500}}},
+		},
+		{
+			`[{"match": {"prefix": "/slow"}, "source_labels": {"app": "reviews"}, "delay": {"percent": 10, "fixed_delay": "0.5s"}},
+			  {"delay": {"percent": 10, "fixed_delay": "500ms"}},
+			  {"abort": {"percent": 200, "http_status": 500}},
+			  {"delay": {"percent": 10, "fixed_delay": "-1s"}},
+			  {}]`,
+			[]*model.Fault{{
+				Match:        &model.HTTPMatch{Prefix: "/slow"},
+				SourceLabels: model.Labels{"app": "reviews"},
+				Delay:        &model.FaultDelay{Percent: 10, FixedDelay: "0.5s"},
+			}, {
+				Delay: &model.FaultDelay{Percent: 10, FixedDelay: "0.5s"},
+			}},
+		},
+	}
+	for _, test := range testCases {
+		svc := v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "ratings",
+				Namespace:   "default",
+				Annotations: map[string]string{FaultsAnnotation: test.annotation},
+			},
+			Spec: v1.ServiceSpec{
+				ClusterIP: "10.0.0.1",
+				Ports:     []v1.ServicePort{{Name: "http", Port: 9080, Protocol: v1.ProtocolTCP}},
+			},
+		}
+		service := convertService(svc, domainSuffix)
+		if len(service.Faults) != len(test.want) || (len(test.want) > 0 && !reflect.DeepEqual(service.Faults, test.want)) {
+			t.Errorf("faults for %q => %#v, want %#v", test.annotation, service.Faults, test.want)
+		}
+	}
+}
+
+func TestPodServiceAccount(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "bookinfo"},
+		Spec:       v1.PodSpec{ServiceAccountName: "reviews"},
+	}
+	if got, want := podServiceAccount(pod, domainSuffix), "spiffe://"+domainSuffix+"/ns/bookinfo/sa/reviews"; got != want {
+		t.Errorf("podServiceAccount => %q, want %q", got, want)
+	}
+	pod.Spec.ServiceAccountName = ""
+	if got, want := podServiceAccount(pod, domainSuffix), "spiffe://"+domainSuffix+"/ns/bookinfo/sa/default"; got != want {
+		t.Errorf("podServiceAccount => %q, want %q", got, want)
+	}
+}
+
+func TestAuthorizationPolicyConversion(t *testing.T) {
+	obj := Resource{
+		ObjectMeta: metav1.ObjectMeta{Name: "reviews", Namespace: "default"},
+		Spec: []byte(`{
+			"selector": {"app": "reviews"},
+			"rules": [{
+				"principals": ["spiffe://cluster.local/ns/default/sa/productpage"],
+				"paths": ["/reviews/*"],
+				"methods": ["GET"]
+			}]
+		}`),
+	}
+	policy, err := convertAuthorizationPolicy(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &model.AuthorizationPolicy{
+		Name:      "reviews",
+		Namespace: "default",
+		Selector:  model.Labels{"app": "reviews"},
+		Action:    model.AuthorizationAllow,
+		Rules: []*model.AuthorizationRule{{
+			Principals: []string{"spiffe://cluster.local/ns/default/sa/productpage"},
+			Paths:      []string{"/reviews/*"},
+			Methods:    []string{"GET"},
+		}},
+	}
+	if !reflect.DeepEqual(policy, expected) {
+		t.Errorf("convertAuthorizationPolicy => %#v, want %#v", policy, expected)
+	}
+
+	invalid := []string{
+		`{"action": "AUDIT"}`,
+		`{"rules": [{"paths": ["reviews"]}]}`,
+		`{"rules": [null]}`,
+		`{"rules": 1}`,
+	}
+	for _, spec := range invalid {
+		obj.Spec = []byte(spec)
+		if _, err := convertAuthorizationPolicy(obj); err == nil {
+			t.Errorf("convertAuthorizationPolicy(%s) => no error", spec)
+		}
+	}
+}
+
+func TestExternalAuthorizationConversion(t *testing.T) {
+	obj := Resource{
+		ObjectMeta: metav1.ObjectMeta{Name: "authz", Namespace: "default"},
+		Spec: []byte(`{
+			"host": "authz",
+			"port": "grpc",
+			"services": ["ratings", "reviews.other.svc.cluster.local"],
+			"timeout": "1m500ms"
+		}`),
+	}
+	authz, err := convertExternalAuthorization(obj, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &model.ExternalAuthorization{
+		Name:      "authz",
+		Namespace: "default",
+		Services:  []string{"ratings.default.svc.cluster.local", "reviews.other.svc.cluster.local"},
+		Host:      "authz.default.svc.cluster.local",
+		Port:      "grpc",
+		Timeout:   "60.5s",
+	}
+	if !reflect.DeepEqual(authz, expected) {
+		t.Errorf("convertExternalAuthorization => %#v, want %#v", authz, expected)
+	}
+
+	invalid := []string{
+		`{"port": "grpc"}`,
+		`{"host": "authz"}`,
+		`{"host": "authz", "port": "grpc", "timeout": "500"}`,
+		`{"host": "authz", "port": "grpc", "timeout": "0s"}`,
+	}
+	for _, spec := range invalid {
+		obj.Spec = []byte(spec)
+		if _, err := convertExternalAuthorization(obj, "cluster.local"); err == nil {
+			t.Errorf("convertExternalAuthorization(%s) => no error", spec)
+		}
+	}
+}
+
+func TestSidecarConversion(t *testing.T) {
+	obj := Resource{
+		ObjectMeta: metav1.ObjectMeta{Name: "productpage", Namespace: "default"},
+		Spec: []byte(`{
+			"selector": {"app": "productpage"},
+			"hosts": ["reviews", "other/*", "*/api.example.com", "*/*.example.org", "auth/authz"]
+		}`),
+	}
+	sidecar, err := convertSidecar(obj, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &model.Sidecar{
+		Name:      "productpage",
+		Namespace: "default",
+		Selector:  model.Labels{"app": "productpage"},
+		Hosts: []string{
+			"default/reviews.default.svc.cluster.local",
+			"other/*",
+			"*/api.example.com",
+			"*/*.example.org",
+			"auth/authz.auth.svc.cluster.local",
+		},
+	}
+	if !reflect.DeepEqual(sidecar, expected) {
+		t.Errorf("convertSidecar => %#v, want %#v", sidecar, expected)
+	}
+
+	invalid := []string{
+		`{}`,
+		`{"hosts": ["/reviews"]}`,
+		`{"hosts": ["a/b/c"]}`,
+		`{"hosts": ["*/api.*.com"]}`,
+		`{"hosts": ["*/*api.example.com"]}`,
+	}
+	for _, spec := range invalid {
+		obj.Spec = []byte(spec)
+		if _, err := convertSidecar(obj, "cluster.local"); err == nil {
+			t.Errorf("convertSidecar(%s) => no error", spec)
+		}
+	}
+}
+
+func TestServiceEntryConversion(t *testing.T) {
+	obj := Resource{
+		ObjectMeta: metav1.ObjectMeta{Name: "billing", Namespace: "default"},
+		Spec: []byte(`{
+			"hosts": ["billing", "billing.example.com"],
+			"ports": [{"name": "http", "port": 8080, "protocol": "HTTP"}],
+			"endpoints": [{"address": "10.2.0.1", "labels": {"version": "v1"}}]
+		}`),
+	}
+	entry, err := convertServiceEntry(obj, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &model.ServiceEntry{
+		Name:      "billing",
+		Namespace: "default",
+		Hosts:     []string{"billing.default.svc.cluster.local", "billing.example.com"},
+		Ports:     model.PortList{{Name: "http", Port: 8080, Protocol: model.ProtocolHTTP}},
+		Endpoints: []*model.ServiceEntryEndpoint{{Address: "10.2.0.1", Labels: model.Labels{"version": "v1"}}},
+	}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("convertServiceEntry => %#v, want %#v", entry, expected)
+	}
+
+	invalid := []string{
+		`{"ports": [{"name": "http", "port": 8080}]}`,
+		`{"hosts": ["billing"], "ports": [{"port": 8080}]}`,
+		`{"hosts": ["billing"], "ports": [{"name": "http", "port": 8080}], "address": "billing"}`,
+	}
+	for _, spec := range invalid {
+		obj.Spec = []byte(spec)
+		if _, err := convertServiceEntry(obj, "cluster.local"); err == nil {
+			t.Errorf("convertServiceEntry(%s) => no error", spec)
+		}
+	}
+}
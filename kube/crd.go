@@ -0,0 +1,108 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// CRDGroup is the API group of envoymesh custom resources
+	CRDGroup = "envoymesh.io"
+	// CRDVersion is the API version of envoymesh custom resources
+	CRDVersion = "v1alpha1"
+
+	// RouteRuleKind is the custom resource kind for HTTP routing rules
+	RouteRuleKind = "RouteRule"
+	// AuthorizationPolicyKind is the custom resource kind for access control
+	AuthorizationPolicyKind = "AuthorizationPolicy"
+	// ExternalAuthorizationKind is the custom resource kind for external
+	// authorization services
+	ExternalAuthorizationKind = "ExternalAuthorization"
+	// SidecarKind is the custom resource kind for workload dependencies
+	SidecarKind = "Sidecar"
+	// ServiceEntryKind is the custom resource kind for services outside of
+	// the cluster
+	ServiceEntryKind = "ServiceEntry"
+)
+
+// crdResources maps custom resource kinds to their plural resource names
+var crdResources = map[string]string{
+	RouteRuleKind:             "routerules",
+	AuthorizationPolicyKind:   "authorizationpolicies",
+	ExternalAuthorizationKind: "externalauthorizations",
+	SidecarKind:               "sidecars",
+	ServiceEntryKind:          "serviceentries",
+}
+
+// Resource is a custom resource with an opaque spec
+type Resource struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata"`
+	Spec               json.RawMessage `json:"spec"`
+}
+
+// ResourceList is a list of custom resources
+type ResourceList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata"`
+	Items            []Resource `json:"items"`
+}
+
+// DeepCopyObject implements runtime.Object
+func (in *Resource) DeepCopyObject() runtime.Object {
+	out := &Resource{TypeMeta: in.TypeMeta}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.Spec != nil {
+		out.Spec = make(json.RawMessage, len(in.Spec))
+		copy(out.Spec, in.Spec)
+	}
+	return out
+}
+
+// DeepCopyObject implements runtime.Object
+func (in *ResourceList) DeepCopyObject() runtime.Object {
+	out := &ResourceList{TypeMeta: in.TypeMeta}
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	out.Items = make([]Resource, 0, len(in.Items))
+	for i := range in.Items {
+		out.Items = append(out.Items, *in.Items[i].DeepCopyObject().(*Resource))
+	}
+	return out
+}
+
+// CreateCRDInterface creates a REST client for envoymesh custom resources
+func CreateCRDInterface(config *rest.Config) (rest.Interface, error) {
+	gv := schema.GroupVersion{Group: CRDGroup, Version: CRDVersion}
+	scheme := runtime.NewScheme()
+	for kind := range crdResources {
+		scheme.AddKnownTypeWithName(gv.WithKind(kind), &Resource{})
+		scheme.AddKnownTypeWithName(gv.WithKind(kind+"List"), &ResourceList{})
+	}
+	meta_v1.AddToGroupVersion(scheme, gv)
+
+	crdConfig := *config
+	crdConfig.GroupVersion = &gv
+	crdConfig.APIPath = "/apis"
+	crdConfig.ContentType = runtime.ContentTypeJSON
+	crdConfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: serializer.NewCodecFactory(scheme)}
+	return rest.RESTClientFor(&crdConfig)
+}
@@ -0,0 +1,44 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "envoymesh",
+		Subsystem: "kube",
+		Name:      "queue_depth",
+		Help:      "Number of pending tasks in the event queue of a cluster.",
+	}, []string{"cluster"})
+	queueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "envoymesh",
+		Subsystem: "kube",
+		Name:      "queue_retries_total",
+		Help:      "Number of task retries after handler errors in the event queue of a cluster.",
+	}, []string{"cluster"})
+	informersSynced = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "envoymesh",
+		Subsystem: "kube",
+		Name:      "synced",
+		Help:      "Whether the informers of a cluster completed the initial synchronization (1) or not (0).",
+	}, []string{"cluster"})
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, queueRetries, informersSynced)
+}
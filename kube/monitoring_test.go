@@ -0,0 +1,93 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+func metricValue(t *testing.T, metric prometheus.Metric) float64 {
+	out := &dto.Metric{}
+	if err := metric.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Counter != nil {
+		return out.Counter.GetValue()
+	}
+	return out.Gauge.GetValue()
+}
+
+func TestQueueMetrics(t *testing.T) {
+	q := NewClusterQueue(1*time.Microsecond, "west")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	failed := false
+	q.Push(Task{handler: func(interface{}, model.Event) error {
+		if !failed {
+			failed = true
+			return errors.New("intentional error")
+		}
+		return nil
+	}})
+	q.Push(Task{handler: func(interface{}, model.Event) error {
+		close(done)
+		return nil
+	}})
+	if depth := metricValue(t, queueDepth.WithLabelValues("west")); depth != 2 {
+		t.Errorf("got queue depth %v, want 2", depth)
+	}
+	go q.Run(stop)
+	<-done
+	close(stop)
+
+	if depth := metricValue(t, queueDepth.WithLabelValues("west")); depth != 0 {
+		t.Errorf("got queue depth %v, want 0", depth)
+	}
+	if retries := metricValue(t, queueRetries.WithLabelValues("west")); retries != 1 {
+		t.Errorf("got %v retries, want 1", retries)
+	}
+	if retries := metricValue(t, queueRetries.WithLabelValues("east")); retries != 0 {
+		t.Errorf("got %v retries of another cluster, want 0", retries)
+	}
+}
+
+func TestSyncedMetric(t *testing.T) {
+	c := NewController(fake.NewSimpleClientset(), nil, ControllerOptions{ClusterName: "east", DomainSuffix: "cluster.local"})
+	if synced := metricValue(t, informersSynced.WithLabelValues("east")); synced != 0 {
+		t.Errorf("got synced %v before running, want 0", synced)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Run(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for metricValue(t, informersSynced.WithLabelValues("east")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("informers of the cluster did not report the synchronization")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if synced := metricValue(t, informersSynced.WithLabelValues("west")); synced != 0 {
+		t.Errorf("got synced %v of another cluster, want 0", synced)
+	}
+}
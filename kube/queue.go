@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/client-go/util/flowcontrol"
 
 	"github.com/kyessenov/envoymesh/model"
@@ -52,15 +53,28 @@ type queueImpl struct {
 	queue   []Task
 	lock    sync.Mutex
 	closing bool
+
+	// metrics labeled with the cluster of the queue
+	depth   prometheus.Gauge
+	retries prometheus.Counter
 }
 
-// NewQueue instantiates a queue with a processing function
+// NewQueue instantiates a queue with a processing function. The metrics of
+// the queue have an empty cluster label.
 func NewQueue(errorDelay time.Duration) Queue {
+	return NewClusterQueue(errorDelay, "")
+}
+
+// NewClusterQueue instantiates a queue for the event handlers of a cluster
+// with the metrics labeled by the cluster name
+func NewClusterQueue(errorDelay time.Duration, cluster string) Queue {
 	return &queueImpl{
 		delay:   errorDelay,
 		queue:   make([]Task, 0),
 		closing: false,
 		lock:    sync.Mutex{},
+		depth:   queueDepth.WithLabelValues(cluster),
+		retries: queueRetries.WithLabelValues(cluster),
 	}
 }
 
@@ -68,6 +82,7 @@ func (q *queueImpl) Push(item Task) {
 	q.lock.Lock()
 	if !q.closing {
 		q.queue = append(q.queue, item)
+		q.depth.Inc()
 	}
 	q.lock.Unlock()
 }
@@ -95,11 +110,13 @@ func (q *queueImpl) Run(stop <-chan struct{}) {
 		} else {
 			item, q.queue = q.queue[0], q.queue[1:]
 			q.lock.Unlock()
+			q.depth.Dec()
 
 			for {
 				err := item.handler(item.obj, item.event)
 				if err != nil {
 					glog.V(2).Infof("Work item failed (%v), repeating after delay %v", err, q.delay)
+					q.retries.Inc()
 					time.Sleep(q.delay)
 				} else {
 					break
@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// Config is the traffic configuration of the mesh
+type Config struct {
+	RouteRules             []*model.RouteRule
+	AuthorizationPolicies  []*model.AuthorizationPolicy
+	ExternalAuthorizations []*model.ExternalAuthorization
+	Sidecars               []*model.Sidecar
+	ServiceEntries         []*model.ServiceEntry
+}
+
+// ConfigStore is a model.ConfigStore holding the configuration in memory,
+// e.g. for registries without custom resources. ConfigStore is safe for
+// concurrent use.
+type ConfigStore struct {
+	mu       sync.RWMutex
+	config   Config
+	handlers []func()
+}
+
+// NewConfigStore creates a store with the configuration
+func NewConfigStore(config Config) *ConfigStore {
+	return &ConfigStore{config: config}
+}
+
+// Set replaces the configuration and notifies the handlers
+func (s *ConfigStore) Set(config Config) {
+	s.mu.Lock()
+	s.config = config
+	handlers := s.handlers
+	s.mu.Unlock()
+	for _, f := range handlers {
+		f()
+	}
+}
+
+// RouteRules ...
+func (s *ConfigStore) RouteRules() []*model.RouteRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*model.RouteRule{}, s.config.RouteRules...)
+}
+
+// AuthorizationPolicies ...
+func (s *ConfigStore) AuthorizationPolicies() []*model.AuthorizationPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*model.AuthorizationPolicy{}, s.config.AuthorizationPolicies...)
+}
+
+// ExternalAuthorizations ...
+func (s *ConfigStore) ExternalAuthorizations() []*model.ExternalAuthorization {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*model.ExternalAuthorization{}, s.config.ExternalAuthorizations...)
+}
+
+// Sidecars ...
+func (s *ConfigStore) Sidecars() []*model.Sidecar {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*model.Sidecar{}, s.config.Sidecars...)
+}
+
+// ServiceEntries ...
+func (s *ConfigStore) ServiceEntries() []*model.ServiceEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*model.ServiceEntry{}, s.config.ServiceEntries...)
+}
+
+// RegisterConfigHandler ...
+func (s *ConfigStore) RegisterConfigHandler(f func()) {
+	s.mu.Lock()
+	s.handlers = append(s.handlers, f)
+	s.mu.Unlock()
+}
@@ -0,0 +1,135 @@
+// Package memory implements a service registry holding the services,
+// instances, and workloads in memory, e.g. for tests and registries backed
+// by files
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kyessenov/envoymesh/kube"
+	"github.com/kyessenov/envoymesh/model"
+)
+
+// Registry is a model.Controller updated by its setters. The handlers are
+// notified on the queue of the registry. Registry is safe for concurrent
+// use.
+type Registry struct {
+	queue kube.Queue
+
+	mu        sync.RWMutex
+	services  []*model.Service
+	instances map[string][]model.Endpoint
+	workloads map[string]model.Instance
+
+	serviceHandlers  []func()
+	endpointHandlers []func()
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		queue:     kube.NewQueue(1 * time.Second),
+		services:  make([]*model.Service, 0),
+		instances: make(map[string][]model.Endpoint),
+		workloads: make(map[string]model.Instance),
+	}
+}
+
+// SetServices replaces the services and notifies the service handlers
+func (r *Registry) SetServices(services []*model.Service) {
+	out := append([]*model.Service{}, services...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	r.mu.Lock()
+	r.services = out
+	handlers := r.serviceHandlers
+	r.mu.Unlock()
+	r.notify(handlers)
+}
+
+// SetInstances replaces the instances by "hostname:port" and notifies the
+// endpoint handlers
+func (r *Registry) SetInstances(instances map[string][]model.Endpoint) {
+	out := make(map[string][]model.Endpoint, len(instances))
+	for key, endpoints := range instances {
+		out[key] = endpoints
+	}
+	r.mu.Lock()
+	r.instances = out
+	handlers := r.endpointHandlers
+	r.mu.Unlock()
+	r.notify(handlers)
+}
+
+// SetWorkloads replaces the workloads by ID. Workloads are looked up on
+// demand, so no handlers are notified.
+func (r *Registry) SetWorkloads(workloads map[string]model.Instance) {
+	out := make(map[string]model.Instance, len(workloads))
+	for id, instance := range workloads {
+		out[id] = instance
+	}
+	r.mu.Lock()
+	r.workloads = out
+	r.mu.Unlock()
+}
+
+func (r *Registry) notify(handlers []func()) {
+	for _, f := range handlers {
+		r.QueueSchedule(f)
+	}
+}
+
+// Services implements a service catalog operation
+func (r *Registry) Services() []*model.Service {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*model.Service{}, r.services...)
+}
+
+// Instances implements a service catalog operation
+func (r *Registry) Instances() map[string][]model.Endpoint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string][]model.Endpoint, len(r.instances))
+	for key, endpoints := range r.instances {
+		out[key] = endpoints
+	}
+	return out
+}
+
+// Workload implements a service catalog operation
+func (r *Registry) Workload(id string) (model.Instance, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	instance, exists := r.workloads[id]
+	if !exists {
+		return model.Instance{}, model.ErrUnknownWorkload
+	}
+	return instance, nil
+}
+
+// RegisterServiceHandler ...
+func (r *Registry) RegisterServiceHandler(f func()) {
+	r.mu.Lock()
+	r.serviceHandlers = append(r.serviceHandlers, f)
+	r.mu.Unlock()
+}
+
+// RegisterEndpointHandler ...
+func (r *Registry) RegisterEndpointHandler(f func()) {
+	r.mu.Lock()
+	r.endpointHandlers = append(r.endpointHandlers, f)
+	r.mu.Unlock()
+}
+
+// Run the queue until a signal is received
+func (r *Registry) Run(stop <-chan struct{}) {
+	go r.queue.Run(stop)
+	<-stop
+}
+
+// QueueSchedule ...
+func (r *Registry) QueueSchedule(job func()) {
+	r.queue.Push(kube.NewTask(func(interface{}, model.Event) error { job(); return nil }, nil, model.EventUpdate))
+}
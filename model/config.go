@@ -0,0 +1,400 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigStore exposes the traffic configuration of the mesh
+type ConfigStore interface {
+	// RouteRules lists HTTP routing rules for all services
+	RouteRules() []*RouteRule
+
+	// AuthorizationPolicies lists access control policies for all workloads
+	AuthorizationPolicies() []*AuthorizationPolicy
+
+	// ExternalAuthorizations lists external authorization services for all
+	// namespaces
+	ExternalAuthorizations() []*ExternalAuthorization
+
+	// Sidecars lists the dependency declarations of all workloads
+	Sidecars() []*Sidecar
+
+	// ServiceEntries lists the services registered outside of the platform
+	ServiceEntries() []*ServiceEntry
+
+	// RegisterConfigHandler notifies about changes to the configuration.
+	RegisterConfigHandler(f func())
+}
+
+// RouteRule declares HTTP routes to a destination service. Requests that do
+// not match any route are sent to all instances of the service.
+type RouteRule struct {
+	// Name and namespace of the rule
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+
+	// Host is the destination service hostname
+	Host string `json:"host"`
+
+	// Routes are matched in order
+	Routes []*HTTPRoute `json:"routes"`
+}
+
+// HTTPRoute splits matching requests across subsets of service instances
+type HTTPRoute struct {
+	// Match conditions, all requests match if not set
+	Match *HTTPMatch `json:"match,omitempty"`
+
+	// Splits are the weighted destinations of the route
+	Splits []*Split `json:"splits"`
+}
+
+// HTTPMatch is a conjunction of request conditions
+type HTTPMatch struct {
+	// Prefix of the request path
+	Prefix string `json:"prefix,omitempty"`
+
+	// Path is the exact request path and takes precedence over the prefix
+	Path string `json:"path,omitempty"`
+
+	// Headers with exact values
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Split is a weighted subset of service instances
+type Split struct {
+	// Labels select the subset, all instances if empty
+	Labels Labels `json:"labels,omitempty"`
+
+	// Weight is the percentage of traffic for the subset
+	Weight int `json:"weight"`
+}
+
+// Fault injects delays and aborts into requests to a service
+type Fault struct {
+	// Match restricts the fault to requests matching a route, all requests
+	// if not set
+	Match *HTTPMatch `json:"match,omitempty"`
+
+	// SourceLabels restricts the fault to requests from workloads with the
+	// labels, all workloads if empty
+	SourceLabels Labels `json:"source_labels,omitempty"`
+
+	Delay *FaultDelay `json:"delay,omitempty"`
+	Abort *FaultAbort `json:"abort,omitempty"`
+}
+
+// FaultDelay delays a percentage of requests by a fixed duration
+type FaultDelay struct {
+	Percent int `json:"percent"`
+
+	// FixedDelay is a duration, e.g. "0.5s" or "500ms", converted to seconds
+	// by Validate
+	FixedDelay string `json:"fixed_delay"`
+}
+
+// FaultAbort fails a percentage of requests with an HTTP status
+type FaultAbort struct {
+	Percent    int `json:"percent"`
+	HTTPStatus int `json:"http_status"`
+}
+
+// Validate checks the fault for percentages and well-formed actions, and
+// converts the delay to seconds
+func (fault *Fault) Validate() error {
+	if fault.Delay == nil && fault.Abort == nil {
+		return errors.New("missing delay or abort")
+	}
+	if delay := fault.Delay; delay != nil {
+		if delay.Percent < 0 || delay.Percent > 100 {
+			return fmt.Errorf("delay percent %d out of range", delay.Percent)
+		}
+		fixed, err := seconds(delay.FixedDelay)
+		if err != nil {
+			return fmt.Errorf("invalid delay: %v", err)
+		}
+		delay.FixedDelay = fixed
+	}
+	if abort := fault.Abort; abort != nil {
+		if abort.Percent < 0 || abort.Percent > 100 {
+			return fmt.Errorf("abort percent %d out of range", abort.Percent)
+		}
+		if abort.HTTPStatus < 200 || abort.HTTPStatus > 599 {
+			return fmt.Errorf("invalid abort status %d", abort.HTTPStatus)
+		}
+	}
+	return nil
+}
+
+// seconds converts a positive duration in the syntax of time.ParseDuration,
+// e.g. "500ms", to the seconds of the JSON mapping of protobuf durations,
+// e.g. "0.5s", which is what Envoy accepts
+func seconds(duration string) (string, error) {
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		return "", fmt.Errorf("invalid duration %q", duration)
+	}
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s", nil
+}
+
+// Validate checks the rule for a destination and consistent weights
+func (rule *RouteRule) Validate() error {
+	if rule.Host == "" {
+		return errors.New("missing host")
+	}
+	for i, route := range rule.Routes {
+		if route == nil || len(route.Splits) == 0 {
+			return fmt.Errorf("route %d: missing splits", i)
+		}
+		if len(route.Splits) == 1 {
+			continue
+		}
+		sum := 0
+		for _, split := range route.Splits {
+			if split.Weight < 0 {
+				return fmt.Errorf("route %d: negative weight %d", i, split.Weight)
+			}
+			sum += split.Weight
+		}
+		if sum != 100 {
+			return fmt.Errorf("route %d: weights add up to %d, want 100", i, sum)
+		}
+	}
+	return nil
+}
+
+// Subsets returns the distinct label selectors used by the rule
+func (rule *RouteRule) Subsets() []Labels {
+	keys := make(map[string]bool)
+	out := make([]Labels, 0)
+	for _, route := range rule.Routes {
+		for _, split := range route.Splits {
+			key := SubsetKey("", split.Labels)
+			if len(split.Labels) > 0 && !keys[key] {
+				keys[key] = true
+				out = append(out, split.Labels)
+			}
+		}
+	}
+	return out
+}
+
+// SubsetKey appends the subset labels sorted by name to the key of the
+// instances, e.g. "hello.default.svc.cluster.local:http|version=v1"
+func SubsetKey(key string, labels Labels) string {
+	if len(labels) == 0 {
+		return key
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+labels[name])
+	}
+	return key + "|" + strings.Join(pairs, ",")
+}
+
+// AuthorizationAction is the effect of an authorization policy
+type AuthorizationAction string
+
+const (
+	// AuthorizationAllow only lets through requests that match a rule of an
+	// allow policy of the workload
+	AuthorizationAllow AuthorizationAction = "ALLOW"
+	// AuthorizationDeny rejects requests that match a rule
+	AuthorizationDeny AuthorizationAction = "DENY"
+)
+
+// AuthorizationPolicy controls access to the workloads in its namespace.
+// Deny policies take precedence over allow policies. A workload without
+// allow policies accepts all requests that are not denied.
+type AuthorizationPolicy struct {
+	// Name and namespace of the policy
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+
+	// Selector restricts the policy to workloads with the labels, all
+	// workloads in the namespace if empty
+	Selector Labels `json:"selector,omitempty"`
+
+	Action AuthorizationAction `json:"action"`
+
+	// Rules match a request if any of them matches. An allow policy
+	// without rules denies all requests.
+	Rules []*AuthorizationRule `json:"rules"`
+}
+
+// AuthorizationRule is a conjunction of request conditions. Each condition
+// matches if any of its values matches, or if it is empty.
+type AuthorizationRule struct {
+	// Principals are the SPIFFE identities of the source workloads
+	Principals []string `json:"principals,omitempty"`
+
+	// Namespaces of the source workloads
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Paths are exact request paths, or prefixes if ending with "*"
+	Paths []string `json:"paths,omitempty"`
+
+	// Methods are HTTP request methods
+	Methods []string `json:"methods,omitempty"`
+}
+
+// Validate checks the policy for a known action and well-formed rules
+func (policy *AuthorizationPolicy) Validate() error {
+	if policy.Action != AuthorizationAllow && policy.Action != AuthorizationDeny {
+		return fmt.Errorf("unknown action %q", policy.Action)
+	}
+	for i, rule := range policy.Rules {
+		if rule == nil {
+			return fmt.Errorf("rule %d: empty rule", i)
+		}
+		for _, path := range rule.Paths {
+			if !strings.HasPrefix(path, "/") && path != "*" {
+				return fmt.Errorf("rule %d: path %q must start with /", i, path)
+			}
+		}
+	}
+	return nil
+}
+
+// AppliesTo is true if the policy selects a workload in the namespace with
+// the labels
+func (policy *AuthorizationPolicy) AppliesTo(namespace string, labels Labels) bool {
+	return policy.Namespace == namespace && policy.Selector.SubsetOf(labels)
+}
+
+// HTTPOnly is true if the rule has conditions that only apply to HTTP
+func (rule *AuthorizationRule) HTTPOnly() bool {
+	return len(rule.Paths) > 0 || len(rule.Methods) > 0
+}
+
+// ExternalAuthorization delegates access decisions for the workloads in its
+// namespace to an external authorization gRPC service, e.g. cmd/authz
+type ExternalAuthorization struct {
+	// Name and namespace of the configuration
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+
+	// Services restricts the checks to the workloads of the service
+	// hostnames, all workloads in the namespace if empty
+	Services []string `json:"services,omitempty"`
+
+	// Host and port name of the authorization service. The port must use the
+	// gRPC protocol.
+	Host string `json:"host"`
+	Port string `json:"port"`
+
+	// Timeout of a check, e.g. "0.5s" or "500ms", converted to seconds by
+	// Validate
+	Timeout string `json:"timeout,omitempty"`
+
+	// FailureModeAllow lets requests through if the service is unavailable
+	FailureModeAllow bool `json:"failure_mode_allow,omitempty"`
+}
+
+// Validate checks the configuration for the authorization service, and
+// converts the timeout to seconds
+func (authz *ExternalAuthorization) Validate() error {
+	if authz.Host == "" {
+		return errors.New("missing host")
+	}
+	if authz.Port == "" {
+		return errors.New("missing port")
+	}
+	if authz.Timeout != "" {
+		timeout, err := seconds(authz.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %v", err)
+		}
+		authz.Timeout = timeout
+	}
+	return nil
+}
+
+// Sidecar restricts the outbound services of the workloads in its namespace
+// to their dependencies. Workloads without sidecars depend on all services,
+// and workloads with several sidecars depend on the hosts of all of them.
+type Sidecar struct {
+	// Name and namespace of the sidecar
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+
+	// Selector restricts the sidecar to workloads with the labels, all
+	// workloads in the namespace if empty
+	Selector Labels `json:"selector,omitempty"`
+
+	// Hosts are the dependencies of the workloads as "namespace/hostname",
+	// where either part may be "*", e.g. "default/*" for all services in the
+	// default namespace. Hostnames may also start with a "*." wildcard for a
+	// domain suffix, e.g. "*/*.example.com".
+	Hosts []string `json:"hosts"`
+}
+
+// Validate checks the sidecar for well-formed hosts
+func (sidecar *Sidecar) Validate() error {
+	if len(sidecar.Hosts) == 0 {
+		return errors.New("missing hosts")
+	}
+	for _, host := range sidecar.Hosts {
+		parts := strings.Split(host, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("host %q must be namespace/hostname", host)
+		}
+		if parts[1] != "*" && strings.Contains(strings.TrimPrefix(parts[1], "*."), "*") {
+			return fmt.Errorf("host %q may only have a leading wildcard", host)
+		}
+	}
+	return nil
+}
+
+// AppliesTo is true if the sidecar selects a workload in the namespace with
+// the labels
+func (sidecar *Sidecar) AppliesTo(namespace string, labels Labels) bool {
+	return sidecar.Namespace == namespace && sidecar.Selector.SubsetOf(labels)
+}
+
+// Imports is true if a host of the sidecar matches the service
+func (sidecar *Sidecar) Imports(service *Service) bool {
+	for _, host := range sidecar.Hosts {
+		parts := strings.SplitN(host, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if (parts[0] == "*" || parts[0] == service.Namespace) && matchHostname(parts[1], service.Hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHostname is true if the hostname is "*", equals the host, or the
+// hostname is a wildcard "*.suffix" and the host ends with ".suffix"
+func matchHostname(hostname, host string) bool {
+	if hostname == "*" || hostname == host {
+		return true
+	}
+	return strings.HasPrefix(hostname, "*.") && strings.HasSuffix(host, hostname[1:])
+}
@@ -0,0 +1,149 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// ServiceEntry registers a service missing from the platform registry, e.g.
+// a service running on VMs or a SaaS API, with static endpoints
+type ServiceEntry struct {
+	// Name and namespace of the entry
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+
+	// Hosts are the hostnames of the service, e.g. "api.example.com"
+	Hosts []string `json:"hosts"`
+
+	// Address is the virtual IP of the service, optional
+	Address string `json:"address,omitempty"`
+
+	// Ports of the service. The protocol defaults to TCP.
+	Ports PortList `json:"ports"`
+
+	// Endpoints are the instances of the service
+	Endpoints []*ServiceEntryEndpoint `json:"endpoints,omitempty"`
+}
+
+// ServiceEntryEndpoint is a static instance of a service entry
+type ServiceEntryEndpoint struct {
+	// Address is the IP of the instance. DNS names are not supported since
+	// the proxies receive the instances as EDS endpoints.
+	Address string `json:"address"`
+
+	// Ports maps the port names of the entry to the ports of the instance,
+	// the service port if not set
+	Ports map[string]int `json:"ports,omitempty"`
+
+	// Labels of the instance, used to select subsets
+	Labels Labels `json:"labels,omitempty"`
+}
+
+// Validate checks the entry for hosts, named ports, and IP endpoints
+func (entry *ServiceEntry) Validate() error {
+	if len(entry.Hosts) == 0 {
+		return errors.New("missing hosts")
+	}
+	if len(entry.Ports) == 0 {
+		return errors.New("missing ports")
+	}
+	if entry.Address != "" && net.ParseIP(entry.Address) == nil {
+		return fmt.Errorf("invalid address %q", entry.Address)
+	}
+	names := make(map[string]bool, len(entry.Ports))
+	for i, port := range entry.Ports {
+		if port == nil || port.Name == "" {
+			return fmt.Errorf("port %d: missing name", i)
+		}
+		if port.Port <= 0 || port.Port > 65535 {
+			return fmt.Errorf("port %q: invalid number %d", port.Name, port.Port)
+		}
+		names[port.Name] = true
+	}
+	for i, ep := range entry.Endpoints {
+		if ep == nil || net.ParseIP(ep.Address) == nil {
+			return fmt.Errorf("endpoint %d: invalid address", i)
+		}
+		for name, port := range ep.Ports {
+			if !names[name] {
+				return fmt.Errorf("endpoint %s: unknown port %q", ep.Address, name)
+			}
+			if port <= 0 || port > 65535 {
+				return fmt.Errorf("endpoint %s: invalid port %d", ep.Address, port)
+			}
+		}
+	}
+	return nil
+}
+
+// ServiceEntries is the service discovery of a set of service entries
+type ServiceEntries []*ServiceEntry
+
+// Services lists a service for each host of the entries sorted by hostname.
+// Hosts declared by several entries are taken from the first entry.
+func (entries ServiceEntries) Services() []*Service {
+	out := make([]*Service, 0)
+	hosts := make(map[string]bool)
+	for _, entry := range entries {
+		for _, host := range entry.Hosts {
+			if hosts[host] {
+				continue
+			}
+			hosts[host] = true
+			ports := make(PortList, 0, len(entry.Ports))
+			for _, port := range entry.Ports {
+				copied := *port
+				if copied.Protocol == "" {
+					copied.Protocol = ProtocolTCP
+				}
+				ports = append(ports, &copied)
+			}
+			out = append(out, &Service{
+				Hostname:  host,
+				Namespace: entry.Namespace,
+				Address:   entry.Address,
+				Ports:     ports,
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return out
+}
+
+// Instances lists the endpoints of the entries by "hostname:port"
+func (entries ServiceEntries) Instances() map[string][]Endpoint {
+	out := make(map[string][]Endpoint)
+	hosts := make(map[string]bool)
+	for _, entry := range entries {
+		for _, host := range entry.Hosts {
+			if hosts[host] {
+				continue
+			}
+			hosts[host] = true
+			for _, port := range entry.Ports {
+				key := host + ":" + port.Name
+				for _, ep := range entry.Endpoints {
+					number := port.Port
+					if target, exists := ep.Ports[port.Name]; exists {
+						number = target
+					}
+					out[key] = append(out[key], Endpoint{IP: ep.Address, Port: number, Labels: ep.Labels})
+				}
+			}
+		}
+	}
+	for _, val := range out {
+		sort.Slice(val, func(i, j int) bool {
+			return val[i].IP < val[j].IP || val[i].IP == val[j].IP && val[i].Port < val[j].Port
+		})
+	}
+	return out
+}
+
+// Workload is not supported since the instances of the entries run no
+// sidecars of the mesh
+func (entries ServiceEntries) Workload(id string) (Instance, error) {
+	return Instance{}, ErrUnknownWorkload
+}
@@ -24,6 +24,7 @@ package model
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
@@ -45,6 +46,9 @@ type Service struct {
 	// Hostname of the service, e.g. "catalog.mystore.com"
 	Hostname string `json:"hostname"`
 
+	// Namespace of the service in the registry, used to scope sidecars
+	Namespace string `json:"namespace,omitempty"`
+
 	// Address specifies the service IPv4 address of the load balancer
 	Address string `json:"address,omitempty"`
 
@@ -60,6 +64,9 @@ type Service struct {
 	// ServiceAccounts specifies the service accounts that run the service.
 	ServiceAccounts []string `json:"serviceaccounts,omitempty"`
 
+	// Faults injected into requests to the service, applied in order
+	Faults []*Fault `json:"faults,omitempty"`
+
 	// LoadBalancingDisabled indicates that no load balancing should be done for this service.
 	LoadBalancingDisabled bool `json:"-"`
 }
@@ -144,6 +151,19 @@ type Endpoint struct {
 
 	// Used by EDS
 	UID string `json:"uid"`
+
+	// Labels of the workload, used to select subsets
+	Labels Labels `json:"labels,omitempty"`
+
+	// AuthenticationPolicy of the service port, set for workload endpoints
+	AuthenticationPolicy proxyconfig.AuthenticationPolicy `json:"authentication_policy,omitempty"`
+
+	// Service hostname of the port, set for workload endpoints
+	Service string `json:"service,omitempty"`
+
+	// Locality of the endpoint, the name of its cluster in a multi-cluster
+	// registry
+	Locality string `json:"locality,omitempty"`
 }
 
 // Instance is a workload descriptor
@@ -151,6 +171,10 @@ type Instance struct {
 	Endpoints []Endpoint `json:"endpoints"`
 	Labels    Labels     `json:"labels"`
 	UID       string     `json:"uid"`
+
+	// ServiceAccount is the SPIFFE identity of the workload, e.g.
+	// "spiffe://cluster.local/ns/default/sa/bookinfo"
+	ServiceAccount string `json:"serviceaccount,omitempty"`
 }
 
 // ServiceDiscovery enumerates Istio service instances.
@@ -161,10 +185,25 @@ type ServiceDiscovery interface {
 	// Instances ...
 	Instances() map[string][]Endpoint
 
-	// Workload ...
+	// Workload returns the instance of a workload by its ID, or
+	// ErrUnknownWorkload if the workload is missing from the registry
 	Workload(id string) (Instance, error)
 }
 
+// ClusterDiscovery looks up workloads in the registries of the clusters of a
+// multi-cluster mesh, where the same workload ID may exist in several
+// clusters
+type ClusterDiscovery interface {
+	// ClusterWorkload returns the instance of a workload by its ID in the
+	// registry of the cluster, or ErrUnknownWorkload if the workload or the
+	// cluster is missing
+	ClusterWorkload(cluster, id string) (Instance, error)
+}
+
+// ErrUnknownWorkload is returned for workloads missing from the registry,
+// e.g. pods not yet observed by the informers
+var ErrUnknownWorkload = errors.New("unknown workload")
+
 // ServiceAccounts exposes Istio service accounts
 type ServiceAccounts interface {
 	// GetIstioServiceAccounts returns a list of service accounts looked up from